@@ -24,6 +24,18 @@ const _ = grpc.SupportPackageIsVersion7
 type CDNClient interface {
 	Publish(ctx context.Context, opts ...grpc.CallOption) (CDN_PublishClient, error)
 	Subscribe(ctx context.Context, opts ...grpc.CallOption) (CDN_SubscribeClient, error)
+	Ingest(ctx context.Context, in *IngestRequest, opts ...grpc.CallOption) (*IngestResponse, error)
+	StopIngest(ctx context.Context, in *StopIngestRequest, opts ...grpc.CallOption) (*IngestSession, error)
+	ListIngests(ctx context.Context, in *ListIngestsRequest, opts ...grpc.CallOption) (*ListIngestsResponse, error)
+	ListStreams(ctx context.Context, in *ListStreamsRequest, opts ...grpc.CallOption) (*ListStreamsResponse, error)
+	StartRecording(ctx context.Context, in *StartRecordingRequest, opts ...grpc.CallOption) (*Recording, error)
+	StopRecording(ctx context.Context, in *StopRecordingRequest, opts ...grpc.CallOption) (*Recording, error)
+	ListRecordings(ctx context.Context, in *ListRecordingsRequest, opts ...grpc.CallOption) (*ListRecordingsResponse, error)
+	StartPush(ctx context.Context, in *StartPushRequest, opts ...grpc.CallOption) (*Push, error)
+	StopPush(ctx context.Context, in *StopPushRequest, opts ...grpc.CallOption) (*Push, error)
+	ListPushes(ctx context.Context, in *ListPushesRequest, opts ...grpc.CallOption) (*ListPushesResponse, error)
+	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*GetStatsResponse, error)
+	GetStream(ctx context.Context, in *GetStreamRequest, opts ...grpc.CallOption) (*Stream, error)
 }
 
 type cDNClient struct {
@@ -96,12 +108,132 @@ func (x *cDNSubscribeClient) Recv() (*SubscribeResponse, error) {
 	return m, nil
 }
 
+func (c *cDNClient) Ingest(ctx context.Context, in *IngestRequest, opts ...grpc.CallOption) (*IngestResponse, error) {
+	out := new(IngestResponse)
+	err := c.cc.Invoke(ctx, "/api.CDN/Ingest", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cDNClient) StopIngest(ctx context.Context, in *StopIngestRequest, opts ...grpc.CallOption) (*IngestSession, error) {
+	out := new(IngestSession)
+	err := c.cc.Invoke(ctx, "/api.CDN/StopIngest", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cDNClient) ListIngests(ctx context.Context, in *ListIngestsRequest, opts ...grpc.CallOption) (*ListIngestsResponse, error) {
+	out := new(ListIngestsResponse)
+	err := c.cc.Invoke(ctx, "/api.CDN/ListIngests", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cDNClient) ListStreams(ctx context.Context, in *ListStreamsRequest, opts ...grpc.CallOption) (*ListStreamsResponse, error) {
+	out := new(ListStreamsResponse)
+	err := c.cc.Invoke(ctx, "/api.CDN/ListStreams", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cDNClient) StartRecording(ctx context.Context, in *StartRecordingRequest, opts ...grpc.CallOption) (*Recording, error) {
+	out := new(Recording)
+	err := c.cc.Invoke(ctx, "/api.CDN/StartRecording", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cDNClient) StopRecording(ctx context.Context, in *StopRecordingRequest, opts ...grpc.CallOption) (*Recording, error) {
+	out := new(Recording)
+	err := c.cc.Invoke(ctx, "/api.CDN/StopRecording", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cDNClient) ListRecordings(ctx context.Context, in *ListRecordingsRequest, opts ...grpc.CallOption) (*ListRecordingsResponse, error) {
+	out := new(ListRecordingsResponse)
+	err := c.cc.Invoke(ctx, "/api.CDN/ListRecordings", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cDNClient) StartPush(ctx context.Context, in *StartPushRequest, opts ...grpc.CallOption) (*Push, error) {
+	out := new(Push)
+	err := c.cc.Invoke(ctx, "/api.CDN/StartPush", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cDNClient) StopPush(ctx context.Context, in *StopPushRequest, opts ...grpc.CallOption) (*Push, error) {
+	out := new(Push)
+	err := c.cc.Invoke(ctx, "/api.CDN/StopPush", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cDNClient) ListPushes(ctx context.Context, in *ListPushesRequest, opts ...grpc.CallOption) (*ListPushesResponse, error) {
+	out := new(ListPushesResponse)
+	err := c.cc.Invoke(ctx, "/api.CDN/ListPushes", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cDNClient) GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*GetStatsResponse, error) {
+	out := new(GetStatsResponse)
+	err := c.cc.Invoke(ctx, "/api.CDN/GetStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cDNClient) GetStream(ctx context.Context, in *GetStreamRequest, opts ...grpc.CallOption) (*Stream, error) {
+	out := new(Stream)
+	err := c.cc.Invoke(ctx, "/api.CDN/GetStream", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // CDNServer is the server API for CDN service.
 // All implementations should embed UnimplementedCDNServer
 // for forward compatibility
 type CDNServer interface {
 	Publish(CDN_PublishServer) error
 	Subscribe(CDN_SubscribeServer) error
+	Ingest(context.Context, *IngestRequest) (*IngestResponse, error)
+	StopIngest(context.Context, *StopIngestRequest) (*IngestSession, error)
+	ListIngests(context.Context, *ListIngestsRequest) (*ListIngestsResponse, error)
+	ListStreams(context.Context, *ListStreamsRequest) (*ListStreamsResponse, error)
+	StartRecording(context.Context, *StartRecordingRequest) (*Recording, error)
+	StopRecording(context.Context, *StopRecordingRequest) (*Recording, error)
+	ListRecordings(context.Context, *ListRecordingsRequest) (*ListRecordingsResponse, error)
+	StartPush(context.Context, *StartPushRequest) (*Push, error)
+	StopPush(context.Context, *StopPushRequest) (*Push, error)
+	ListPushes(context.Context, *ListPushesRequest) (*ListPushesResponse, error)
+	GetStats(context.Context, *GetStatsRequest) (*GetStatsResponse, error)
+	GetStream(context.Context, *GetStreamRequest) (*Stream, error)
 }
 
 // UnimplementedCDNServer should be embedded to have forward compatible implementations.
@@ -114,6 +246,42 @@ func (UnimplementedCDNServer) Publish(CDN_PublishServer) error {
 func (UnimplementedCDNServer) Subscribe(CDN_SubscribeServer) error {
 	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
 }
+func (UnimplementedCDNServer) Ingest(context.Context, *IngestRequest) (*IngestResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Ingest not implemented")
+}
+func (UnimplementedCDNServer) StopIngest(context.Context, *StopIngestRequest) (*IngestSession, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StopIngest not implemented")
+}
+func (UnimplementedCDNServer) ListIngests(context.Context, *ListIngestsRequest) (*ListIngestsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListIngests not implemented")
+}
+func (UnimplementedCDNServer) ListStreams(context.Context, *ListStreamsRequest) (*ListStreamsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListStreams not implemented")
+}
+func (UnimplementedCDNServer) StartRecording(context.Context, *StartRecordingRequest) (*Recording, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartRecording not implemented")
+}
+func (UnimplementedCDNServer) StopRecording(context.Context, *StopRecordingRequest) (*Recording, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StopRecording not implemented")
+}
+func (UnimplementedCDNServer) ListRecordings(context.Context, *ListRecordingsRequest) (*ListRecordingsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListRecordings not implemented")
+}
+func (UnimplementedCDNServer) StartPush(context.Context, *StartPushRequest) (*Push, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartPush not implemented")
+}
+func (UnimplementedCDNServer) StopPush(context.Context, *StopPushRequest) (*Push, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StopPush not implemented")
+}
+func (UnimplementedCDNServer) ListPushes(context.Context, *ListPushesRequest) (*ListPushesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPushes not implemented")
+}
+func (UnimplementedCDNServer) GetStats(context.Context, *GetStatsRequest) (*GetStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedCDNServer) GetStream(context.Context, *GetStreamRequest) (*Stream, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStream not implemented")
+}
 
 // UnsafeCDNServer may be embedded to opt out of forward compatibility for this service.
 // Use of this interface is not recommended, as added methods to CDNServer will
@@ -178,13 +346,278 @@ func (x *cDNSubscribeServer) Recv() (*SubscribeRequest, error) {
 	return m, nil
 }
 
+func _CDN_Ingest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IngestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CDNServer).Ingest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.CDN/Ingest",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CDNServer).Ingest(ctx, req.(*IngestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CDN_StopIngest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StopIngestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CDNServer).StopIngest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.CDN/StopIngest",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CDNServer).StopIngest(ctx, req.(*StopIngestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CDN_ListIngests_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListIngestsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CDNServer).ListIngests(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.CDN/ListIngests",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CDNServer).ListIngests(ctx, req.(*ListIngestsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CDN_ListStreams_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListStreamsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CDNServer).ListStreams(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.CDN/ListStreams",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CDNServer).ListStreams(ctx, req.(*ListStreamsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CDN_StartRecording_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StartRecordingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CDNServer).StartRecording(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.CDN/StartRecording",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CDNServer).StartRecording(ctx, req.(*StartRecordingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CDN_StopRecording_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StopRecordingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CDNServer).StopRecording(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.CDN/StopRecording",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CDNServer).StopRecording(ctx, req.(*StopRecordingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CDN_ListRecordings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRecordingsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CDNServer).ListRecordings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.CDN/ListRecordings",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CDNServer).ListRecordings(ctx, req.(*ListRecordingsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CDN_StartPush_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StartPushRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CDNServer).StartPush(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.CDN/StartPush",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CDNServer).StartPush(ctx, req.(*StartPushRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CDN_StopPush_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StopPushRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CDNServer).StopPush(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.CDN/StopPush",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CDNServer).StopPush(ctx, req.(*StopPushRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CDN_ListPushes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPushesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CDNServer).ListPushes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.CDN/ListPushes",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CDNServer).ListPushes(ctx, req.(*ListPushesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CDN_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CDNServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.CDN/GetStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CDNServer).GetStats(ctx, req.(*GetStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CDN_GetStream_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStreamRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CDNServer).GetStream(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.CDN/GetStream",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CDNServer).GetStream(ctx, req.(*GetStreamRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // CDN_ServiceDesc is the grpc.ServiceDesc for CDN service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
 var CDN_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "api.CDN",
 	HandlerType: (*CDNServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Ingest",
+			Handler:    _CDN_Ingest_Handler,
+		},
+		{
+			MethodName: "StopIngest",
+			Handler:    _CDN_StopIngest_Handler,
+		},
+		{
+			MethodName: "ListIngests",
+			Handler:    _CDN_ListIngests_Handler,
+		},
+		{
+			MethodName: "ListStreams",
+			Handler:    _CDN_ListStreams_Handler,
+		},
+		{
+			MethodName: "StartRecording",
+			Handler:    _CDN_StartRecording_Handler,
+		},
+		{
+			MethodName: "StopRecording",
+			Handler:    _CDN_StopRecording_Handler,
+		},
+		{
+			MethodName: "ListRecordings",
+			Handler:    _CDN_ListRecordings_Handler,
+		},
+		{
+			MethodName: "StartPush",
+			Handler:    _CDN_StartPush_Handler,
+		},
+		{
+			MethodName: "StopPush",
+			Handler:    _CDN_StopPush_Handler,
+		},
+		{
+			MethodName: "ListPushes",
+			Handler:    _CDN_ListPushes_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _CDN_GetStats_Handler,
+		},
+		{
+			MethodName: "GetStream",
+			Handler:    _CDN_GetStream_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "Publish",
@@ -1,23 +1,52 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/blendle/zapdriver"
+	"github.com/muxable/cdn/internal/config"
+	"github.com/muxable/cdn/internal/store"
 	"github.com/muxable/cdn/pkg/server"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
 	"go.uber.org/zap"
 )
 
-func logger() (*zap.Logger, error) {
-	if os.Getenv("APP_ENV") == "production" {
-		return zapdriver.NewProduction()
-	} else {
-		return zap.NewDevelopment()
+// tracerProvider exports spans over OTLP to the collector configured by the standard
+// OTEL_EXPORTER_OTLP_* environment variables.
+func tracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String("cdn"),
+		attribute.String("region", store.GetTag())))
+	if err != nil {
+		return nil, err
 	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)), nil
 }
 
 func main() {
-	logger, err := logger()
+	flags := config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	c, err := config.Load(flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(2)
+	}
+
+	logger, err := c.Logger()
 	if err != nil {
 		panic(err)
 	}
@@ -25,12 +54,27 @@ func main() {
 	undo := zap.ReplaceGlobals(logger)
 	defer undo()
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "50051"
+	// export traces if a collector is configured.
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+		tp, err := tracerProvider(context.Background())
+		if err != nil {
+			panic(err)
+		}
+		defer tp.Shutdown(context.Background())
+		otel.SetTracerProvider(tp)
+	}
+
+	options, err := c.ServeOptions()
+	if err != nil {
+		panic(err)
 	}
 
-	if err := server.ServeCDN("0.0.0.0:50051"); err != nil {
+	// drain before shutting down on SIGINT or SIGTERM. the drain period must be shorter than the
+	// deployment's kill timeout.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := server.ServeCDNContext(ctx, c.ListenAddress, options); err != nil {
 		panic(err)
 	}
 }
@@ -1,23 +1,28 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"io"
 	"log"
 	"os"
-	"time"
+	"os/signal"
 
+	"github.com/muxable/cdn/pkg/auth"
 	"github.com/muxable/cdn/pkg/cdn"
-	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
-	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
 func main() {
 	addr := flag.String("addr", "", "destination address")
+	ca := flag.String("ca", "", "ca certificate file, connects over tls if set")
+	token := flag.String("token", "", "bearer token, if the server requires one")
+	file := flag.String("file", "test/input.ivf", "IVF file to publish")
+	loop := flag.Bool("loop", false, "restart the file when it ends")
+	streamID := flag.String("stream", "pion", "stream id to publish as")
+	title := flag.String("title", "", "stream title metadata")
 	flag.Parse()
 
 	logger, err := zap.NewDevelopment()
@@ -28,56 +33,52 @@ func main() {
 	undo := zap.ReplaceGlobals(logger)
 	defer undo()
 
-	conn, err := grpc.Dial(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		panic(err)
+	creds := insecure.NewCredentials()
+	if *ca != "" {
+		if creds, err = credentials.NewClientTLSFromFile(*ca, ""); err != nil {
+			panic(err)
+		}
 	}
-	client, err := cdn.NewClient(conn)
+	conn, err := grpc.Dial(*addr, grpc.WithTransportCredentials(creds))
 	if err != nil {
 		panic(err)
 	}
-
-	tl, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "pion")
+	var options []cdn.ClientOption
+	if *token != "" {
+		options = append(options, cdn.WithCredentials(auth.Token(*token)))
+	}
+	client, err := cdn.NewClient(conn, options...)
 	if err != nil {
 		panic(err)
 	}
 
-	pc, err := client.Publish()
+	f, err := os.Open(*file)
 	if err != nil {
 		panic(err)
 	}
+	defer f.Close()
 
-	if _, err := pc.AddTrack(tl); err != nil {
-		panic(err)
+	var source cdn.MediaSource
+	if *loop {
+		source, err = cdn.Loop(f, cdn.NewIVFSource)
+	} else {
+		source, err = cdn.NewIVFSource(f)
 	}
-	
-	log.Printf("publishing")
-
-	// Open a IVF file and start reading using our IVFReader
-	file, err := os.Open("test/input.ivf")
 	if err != nil {
 		panic(err)
 	}
 
-	ivf, header, err := ivfreader.NewWith(file)
-	if err != nil {
-		panic(err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var publishOptions []cdn.PublisherConfiguration
+	if *title != "" {
+		publishOptions = append(publishOptions, cdn.WithMetadata("title", *title))
 	}
 
-	delta := time.Duration((float32(header.TimebaseNumerator) / float32(header.TimebaseDenominator)) * 1000)
-	ticker := time.NewTicker(time.Millisecond * delta)
-	for range ticker.C {
-		frame, _, err := ivf.ParseNextFrame()
-		if err == io.EOF {
-			return
-		}
+	log.Printf("publishing %s", *streamID)
 
-		if err != nil {
-			panic(err)
-		}
-
-		if err = tl.WriteSample(media.Sample{Data: frame, Duration: delta}); err != nil {
-			panic(err)
-		}
+	if err := client.PublishMedia(ctx, *streamID, []cdn.MediaSource{source}, publishOptions...); err != nil && err != context.Canceled {
+		panic(err)
 	}
 }
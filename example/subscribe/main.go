@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
 
+	"github.com/muxable/cdn/pkg/auth"
 	"github.com/muxable/cdn/pkg/cdn"
-	"github.com/pion/webrtc/v3"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
 func main() {
-	addr := flag.String("addr", "", "destination address")
+	addr := flag.String("addr", "", "comma separated node addresses, tried in order when reconnecting")
+	ca := flag.String("ca", "", "ca certificate file, connects over tls if set")
+	token := flag.String("token", "", "bearer token, if the server requires one")
+	playbackToken := flag.String("playback-token", "", "signed playback token for the stream")
+	offset := flag.Duration("offset", 0, "start this far behind live")
 	flag.Parse()
 
 	logger, err := zap.NewDevelopment()
@@ -23,29 +32,37 @@ func main() {
 	undo := zap.ReplaceGlobals(logger)
 	defer undo()
 
-	conn, err := grpc.Dial(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		panic(err)
+	creds := insecure.NewCredentials()
+	if *ca != "" {
+		if creds, err = credentials.NewClientTLSFromFile(*ca, ""); err != nil {
+			panic(err)
+		}
 	}
-	client, err := cdn.NewClient(conn)
-	if err != nil {
-		panic(err)
+	var clientOptions []cdn.ClientOption
+	if *token != "" {
+		clientOptions = append(clientOptions, cdn.WithCredentials(auth.Token(*token)))
 	}
 
-	pc, err := client.Subscribe("pion")
-	if err != nil {
-		panic(err)
-	}
+	subscriber := cdn.NewSubscriber(cdn.Nodes(strings.Split(*addr, ",")...), "pion",
+		cdn.WithDialOptions(grpc.WithTransportCredentials(creds)),
+		cdn.WithClientOptions(clientOptions...),
+		cdn.WithSubscription(cdn.WithStartOffset(*offset), cdn.WithPlaybackToken(*playbackToken)),
+		cdn.WithConnectHandler(func(node string) {
+			log.Printf("connected to %s", node)
+		}))
 
-	pc.OnTrack(func(tr *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	subscriber.OnTrack(func(tr *cdn.Track) {
 		for {
-			p, _, err := tr.ReadRTP()
+			p, err := tr.ReadRTP()
 			if err != nil {
-				panic(err)
+				return
 			}
 			log.Printf("received %d bytes", p.MarshalSize())
 		}
 	})
 
-	select{}
-}
\ No newline at end of file
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	log.Printf("subscriber stopped: %v", subscriber.Run(ctx))
+}
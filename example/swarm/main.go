@@ -22,11 +22,11 @@ func main() {
 	defer undo()
 
 	for i := 0; i < *size; i++ {
-		go server.ServeCDN(fmt.Sprintf("127.0.0.1:%d", i+50051))
+		go server.ServeCDN(fmt.Sprintf("127.0.0.1:%d", i+50051), server.ServeOptions{})
 		// in order to guarantee a connected graph, we need to wait a bit
 		// to let each individual server start up.
 		time.Sleep(1 * time.Second)
 	}
 
-	select{}
+	select {}
 }
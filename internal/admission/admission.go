@@ -0,0 +1,188 @@
+package admission
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTooManyPublishers  = errors.New("too many publishers")
+	ErrTooManySubscribers = errors.New("too many subscribers")
+	ErrEgressExhausted    = errors.New("egress bitrate exhausted")
+	ErrRateLimited        = errors.New("too many sessions from this address")
+)
+
+// Limits configures admission control. A zero value disables the corresponding limit.
+type Limits struct {
+	MaxPublishers  int
+	MaxSubscribers int
+	// MaxEgressBitrate is the egress, in bits per second, above which new subscribers are rejected.
+	MaxEgressBitrate int64
+
+	// SessionsPerMinute is the rate at which a single client address may start sessions, allowing
+	// bursts of up to SessionBurst sessions.
+	SessionsPerMinute float64
+	SessionBurst      int
+}
+
+// Load is a snapshot of the sessions admitted by a controller.
+type Load struct {
+	Publishers    int
+	Subscribers   int
+	EgressBitrate int64
+}
+
+// bucket is a token bucket limiting the session rate of a single address.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// sampleInterval is the minimum interval over which the egress bitrate is measured.
+const sampleInterval = time.Second
+
+// Controller admits sessions subject to its limits.
+type Controller struct {
+	sync.Mutex
+
+	limits Limits
+	egress func() uint64
+
+	publishers  int
+	subscribers int
+
+	lastBytes  uint64
+	lastSample time.Time
+	bitrate    int64
+
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+// NewController creates a controller. egress returns the total number of bytes sent to
+// subscribers and is sampled to measure the egress bitrate.
+func NewController(limits Limits, egress func() uint64) *Controller {
+	if limits.SessionBurst <= 0 {
+		limits.SessionBurst = 1
+	}
+	return &Controller{
+		limits:     limits,
+		egress:     egress,
+		lastSample: time.Now(),
+		buckets:    make(map[string]*bucket),
+	}
+}
+
+// sample updates the egress bitrate. It must be called with the lock held.
+func (c *Controller) sample(now time.Time) {
+	if c.egress == nil {
+		return
+	}
+	elapsed := now.Sub(c.lastSample)
+	if elapsed < sampleInterval {
+		return
+	}
+	bytes := c.egress()
+	c.bitrate = int64(float64(bytes-c.lastBytes) * 8 / elapsed.Seconds())
+	c.lastBytes, c.lastSample = bytes, now
+}
+
+// allow consumes a token from the address's bucket. It must be called with the lock held.
+func (c *Controller) allow(addr string, now time.Time) bool {
+	if c.limits.SessionsPerMinute <= 0 || addr == "" {
+		return true
+	}
+	rate := c.limits.SessionsPerMinute / 60
+	burst := float64(c.limits.SessionBurst)
+
+	if now.Sub(c.lastPrune) > time.Minute {
+		// drop buckets that have refilled since they're equivalent to new ones.
+		for key, b := range c.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+				delete(c.buckets, key)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	b, ok := c.buckets[addr]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		c.buckets[addr] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// AdmitPublisher admits a publishing session from addr. release must be called when the session
+// ends.
+func (c *Controller) AdmitPublisher(addr string) (release func(), err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.limits.MaxPublishers > 0 && c.publishers >= c.limits.MaxPublishers {
+		return nil, ErrTooManyPublishers
+	}
+	if !c.allow(addr, time.Now()) {
+		return nil, ErrRateLimited
+	}
+	c.publishers++
+	return c.releaser(&c.publishers), nil
+}
+
+// AdmitSubscriber admits a subscribing session from addr. release must be called when the session
+// ends.
+func (c *Controller) AdmitSubscriber(addr string) (release func(), err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	c.sample(now)
+	if c.limits.MaxSubscribers > 0 && c.subscribers >= c.limits.MaxSubscribers {
+		return nil, ErrTooManySubscribers
+	}
+	if c.limits.MaxEgressBitrate > 0 && c.bitrate >= c.limits.MaxEgressBitrate {
+		return nil, ErrEgressExhausted
+	}
+	if !c.allow(addr, now) {
+		return nil, ErrRateLimited
+	}
+	c.subscribers++
+	return c.releaser(&c.subscribers), nil
+}
+
+func (c *Controller) releaser(count *int) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.Lock()
+			*count--
+			c.Unlock()
+		})
+	}
+}
+
+// Load returns the current load.
+func (c *Controller) Load() Load {
+	c.Lock()
+	defer c.Unlock()
+
+	c.sample(time.Now())
+	return Load{Publishers: c.publishers, Subscribers: c.subscribers, EgressBitrate: c.bitrate}
+}
+
+// Full reports whether new subscribers would be rejected regardless of their address.
+func (c *Controller) Full() bool {
+	load := c.Load()
+	return c.limits.MaxSubscribers > 0 && load.Subscribers >= c.limits.MaxSubscribers ||
+		c.limits.MaxEgressBitrate > 0 && load.EgressBitrate >= c.limits.MaxEgressBitrate
+}
@@ -0,0 +1,163 @@
+package admission
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	type attempt struct {
+		after time.Duration
+		addr  string
+		want  bool
+	}
+	tests := []struct {
+		name     string
+		limits   Limits
+		attempts []attempt
+	}{
+		{
+			name:   "unlimited",
+			limits: Limits{},
+			attempts: []attempt{
+				{0, "a", true}, {0, "a", true}, {0, "a", true},
+			},
+		},
+		{
+			name:   "burst then rejection",
+			limits: Limits{SessionsPerMinute: 6, SessionBurst: 3},
+			attempts: []attempt{
+				{0, "a", true}, {0, "a", true}, {0, "a", true}, {0, "a", false},
+			},
+		},
+		{
+			name:   "burst defaults to one",
+			limits: Limits{SessionsPerMinute: 6},
+			attempts: []attempt{
+				{0, "a", true}, {0, "a", false},
+			},
+		},
+		{
+			name:   "refill",
+			limits: Limits{SessionsPerMinute: 6, SessionBurst: 1},
+			attempts: []attempt{
+				// a token every ten seconds.
+				{0, "a", true}, {5 * time.Second, "a", false}, {10 * time.Second, "a", true}, {10 * time.Second, "a", false},
+			},
+		},
+		{
+			name:   "refill is capped at the burst",
+			limits: Limits{SessionsPerMinute: 6, SessionBurst: 2},
+			attempts: []attempt{
+				{0, "a", true}, {0, "a", true}, {time.Hour, "a", true}, {time.Hour, "a", true}, {time.Hour, "a", false},
+			},
+		},
+		{
+			name:   "addresses have their own buckets",
+			limits: Limits{SessionsPerMinute: 6, SessionBurst: 1},
+			attempts: []attempt{
+				{0, "a", true}, {0, "a", false}, {0, "b", true}, {0, "b", false},
+			},
+		},
+		{
+			name:   "unknown addresses aren't limited",
+			limits: Limits{SessionsPerMinute: 6, SessionBurst: 1},
+			attempts: []attempt{
+				{0, "", true}, {0, "", true},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewController(test.limits, nil)
+			start := time.Now()
+			for i, attempt := range test.attempts {
+				if got := c.allow(attempt.addr, start.Add(attempt.after)); got != attempt.want {
+					t.Errorf("attempt %d from %q after %s: got %v, want %v", i, attempt.addr, attempt.after, got, attempt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	tests := []struct {
+		name       string
+		limits     Limits
+		publisher  bool
+		admitted   int
+		wantErr    error
+		wantLoaded Load
+	}{
+		{
+			name:       "publishers",
+			limits:     Limits{MaxPublishers: 2},
+			publisher:  true,
+			admitted:   2,
+			wantErr:    ErrTooManyPublishers,
+			wantLoaded: Load{Publishers: 2},
+		},
+		{
+			name:       "subscribers",
+			limits:     Limits{MaxSubscribers: 3},
+			admitted:   3,
+			wantErr:    ErrTooManySubscribers,
+			wantLoaded: Load{Subscribers: 3},
+		},
+		{
+			name:       "rate limited",
+			limits:     Limits{SessionsPerMinute: 1, SessionBurst: 2},
+			admitted:   2,
+			wantErr:    ErrRateLimited,
+			wantLoaded: Load{Subscribers: 2},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewController(test.limits, nil)
+			admit := c.AdmitSubscriber
+			if test.publisher {
+				admit = c.AdmitPublisher
+			}
+			var releases []func()
+			for i := 0; i < test.admitted; i++ {
+				release, err := admit("a")
+				if err != nil {
+					t.Fatalf("session %d: %v", i, err)
+				}
+				releases = append(releases, release)
+			}
+			if _, err := admit("a"); err != test.wantErr {
+				t.Errorf("got %v, want %v", err, test.wantErr)
+			}
+			if load := c.Load(); load != test.wantLoaded {
+				t.Errorf("got load %+v, want %+v", load, test.wantLoaded)
+			}
+
+			// releasing twice only frees one session.
+			releases[0]()
+			releases[0]()
+			if load := c.Load(); load.Publishers+load.Subscribers != test.admitted-1 {
+				t.Errorf("got load %+v after a release, want %d sessions", load, test.admitted-1)
+			}
+		})
+	}
+}
+
+func TestEgress(t *testing.T) {
+	var sent uint64
+	c := NewController(Limits{MaxEgressBitrate: 1000}, func() uint64 { return sent })
+
+	if _, err := c.AdmitSubscriber("a"); err != nil {
+		t.Fatal(err)
+	}
+	// 1000 bytes over a second is 8000 bits per second.
+	sent = 1000
+	c.sample(c.lastSample.Add(sampleInterval))
+	if _, err := c.AdmitSubscriber("a"); err != ErrEgressExhausted {
+		t.Errorf("got %v, want %v", err, ErrEgressExhausted)
+	}
+	if !c.Full() {
+		t.Error("controller should be full")
+	}
+}
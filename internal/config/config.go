@@ -0,0 +1,614 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blendle/zapdriver"
+	"github.com/muxable/cdn/internal/admission"
+	"github.com/muxable/cdn/pkg/auth"
+	"github.com/muxable/cdn/pkg/server"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+// FieldError is a configuration error in a single field.
+type FieldError struct {
+	// Field is the field's path in the config file, for example limits.max_publishers.
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+type ICEServer struct {
+	URLs       []string `yaml:"urls"`
+	Username   string   `yaml:"username"`
+	Credential string   `yaml:"credential"`
+}
+
+type ICE struct {
+	// PortMin and PortMax restrict the UDP ports of host candidates, zero allows any port.
+	PortMin uint16 `yaml:"port_min"`
+	PortMax uint16 `yaml:"port_max"`
+	// NAT1To1IPs are the public IPs of the node when it is behind a 1:1 NAT.
+	NAT1To1IPs []string `yaml:"nat_1to1_ips"`
+	// NAT1To1CandidateType is the candidate type of the NAT IPs, host or srflx.
+	NAT1To1CandidateType string `yaml:"nat_1to1_candidate_type"`
+	// NetworkTypes restricts candidates to udp4, udp6, tcp4 or tcp6, empty allows all.
+	NetworkTypes []string `yaml:"network_types"`
+	// Interfaces restricts host candidates to the named interfaces, empty allows all.
+	Interfaces []string `yaml:"interfaces"`
+	// RelayOnly only gathers relay candidates for publishers and subscribers.
+	RelayOnly bool `yaml:"relay_only"`
+	// UDPMuxAddress, if set, serves all host candidates from one UDP port bound to it.
+	UDPMuxAddress string `yaml:"udp_mux_address"`
+	// TCPMuxAddress, if set, accepts ICE-TCP on one port bound to it.
+	TCPMuxAddress string `yaml:"tcp_mux_address"`
+}
+
+type TURN struct {
+	// Secret, if set, runs a TURN server issuing credentials signed with it.
+	Secret string `yaml:"secret"`
+	// Address is the UDP address of the TURN server.
+	Address string `yaml:"address"`
+	// PublicIP is advertised to clients, defaults to the first of ice.nat_1to1_ips.
+	PublicIP     string `yaml:"public_ip"`
+	RelayPortMin uint16 `yaml:"relay_port_min"`
+	RelayPortMax uint16 `yaml:"relay_port_max"`
+	Realm        string `yaml:"realm"`
+	// CredentialTTL is how long the credentials handed to sessions are valid for. Relayed sessions
+	// get new credentials when they reconnect.
+	CredentialTTL time.Duration `yaml:"credential_ttl"`
+}
+
+type Directory struct {
+	// Backend is the directory implementation, only "firestore" is supported.
+	Backend   string `yaml:"backend"`
+	ProjectID string `yaml:"project_id"`
+}
+
+type TLS struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	CAFile   string `yaml:"ca_file"`
+}
+
+type Auth struct {
+	// JWTSecret, if set, requires HS256 tokens signed with it.
+	JWTSecret string `yaml:"jwt_secret"`
+	// PlaybackSecret, if set, accepts playback tokens signed with it.
+	PlaybackSecret string `yaml:"playback_secret"`
+}
+
+type Limits struct {
+	MaxPublishers     int     `yaml:"max_publishers"`
+	MaxSubscribers    int     `yaml:"max_subscribers"`
+	MaxEgressBitrate  int64   `yaml:"max_egress_bitrate"`
+	SessionsPerMinute float64 `yaml:"sessions_per_minute"`
+	SessionBurst      int     `yaml:"session_burst"`
+}
+
+type Log struct {
+	// Level is one of debug, info, warn or error.
+	Level string `yaml:"level"`
+	// Format is "console" for development or "stackdriver" for production.
+	Format string `yaml:"format"`
+}
+
+// Config is the configuration of the cdn binary.
+type Config struct {
+	// ListenAddress is the gRPC address.
+	ListenAddress string `yaml:"listen_address"`
+	// HTTPAddress serves HLS and metrics if set.
+	HTTPAddress string `yaml:"http_address"`
+	// InboundAddress is the address other nodes relay from, defaults to ListenAddress.
+	InboundAddress string `yaml:"inbound_address"`
+
+	ICEServers   []ICEServer   `yaml:"ice_servers"`
+	ICE          ICE           `yaml:"ice"`
+	TURN         TURN          `yaml:"turn"`
+	Directory    Directory     `yaml:"directory"`
+	TLS          TLS           `yaml:"tls"`
+	Auth         Auth          `yaml:"auth"`
+	Limits       Limits        `yaml:"limits"`
+	BufferWindow time.Duration `yaml:"buffer_window"`
+	DrainPeriod  time.Duration `yaml:"drain_period"`
+	Log          Log           `yaml:"log"`
+}
+
+// Default returns the configuration used when nothing is overridden.
+func Default() *Config {
+	return &Config{
+		ListenAddress: "0.0.0.0:50051",
+		ICEServers:    []ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
+		// the ports published by the Dockerfile.
+		ICE:          ICE{PortMin: 5000, PortMax: 5200, NAT1To1CandidateType: "host"},
+		TURN:         TURN{Address: "0.0.0.0:3478", Realm: "cdn", CredentialTTL: 10 * time.Minute},
+		Directory:    Directory{Backend: "firestore", ProjectID: "rtirl-a1d7f"},
+		BufferWindow: 30 * time.Second,
+		DrainPeriod:  20 * time.Second,
+		Log:          Log{Level: "info", Format: "console"},
+	}
+}
+
+// LoadFile overrides the configuration with the YAML file at path. Unknown fields are rejected.
+func (c *Config) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// setter parses a string value into a field.
+type setter struct {
+	field string
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+func setString(f func(c *Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*f(c) = value
+		return nil
+	}
+}
+
+func setInt(f func(c *Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		*f(c) = n
+		return nil
+	}
+}
+
+// setList sets a comma separated list.
+func setList(f func(c *Config) *[]string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*f(c) = list
+		return nil
+	}
+}
+
+func setFloat(f func(c *Config) *float64) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		*f(c) = n
+		return nil
+	}
+}
+
+func setDuration(f func(c *Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.New("must be a duration")
+		}
+		*f(c) = d
+		return nil
+	}
+}
+
+// setPortRange sets a port range like 5000-5200.
+func setPortRange(f func(c *Config) (*uint16, *uint16)) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		var min, max uint16
+		if _, err := fmt.Sscanf(value, "%d-%d", &min, &max); err != nil {
+			return errors.New("must be a range like 5000-5200")
+		}
+		pmin, pmax := f(c)
+		*pmin, *pmax = min, max
+		return nil
+	}
+}
+
+// setters maps environment variables and flags onto fields. The environment variables are the
+// ones the binary has always read.
+var setters = []setter{
+	{"listen_address", "PORT", "listen", "gRPC listen address, PORT sets only the port", func(c *Config, value string) error {
+		if !strings.Contains(value, ":") {
+			// PORT is a bare port.
+			value = "0.0.0.0:" + value
+		}
+		c.ListenAddress = value
+		return nil
+	}},
+	{"http_address", "HTTP_PORT", "http", "HLS and metrics listen address, HTTP_PORT sets only the port", func(c *Config, value string) error {
+		if !strings.Contains(value, ":") {
+			value = "0.0.0.0:" + value
+		}
+		c.HTTPAddress = value
+		return nil
+	}},
+	{"inbound_address", "INBOUND_ADDRESS", "inbound", "address advertised to other nodes", setString(func(c *Config) *string { return &c.InboundAddress })},
+	{"ice_servers", "ICE_SERVERS", "ice-servers", "comma separated ICE server urls", func(c *Config, value string) error {
+		c.ICEServers = nil
+		for _, url := range strings.Split(value, ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				c.ICEServers = append(c.ICEServers, ICEServer{URLs: []string{url}})
+			}
+		}
+		return nil
+	}},
+	{"ice.port_min", "ICE_PORT_RANGE", "ice-port-range", "UDP port range of host candidates, for example 5000-5200", setPortRange(func(c *Config) (*uint16, *uint16) { return &c.ICE.PortMin, &c.ICE.PortMax })},
+	{"ice.nat_1to1_ips", "NAT_1TO1_IPS", "nat-1to1-ips", "comma separated public IPs of the node behind a 1:1 NAT", setList(func(c *Config) *[]string { return &c.ICE.NAT1To1IPs })},
+	{"ice.nat_1to1_candidate_type", "NAT_1TO1_CANDIDATE_TYPE", "nat-1to1-candidate-type", "host or srflx", setString(func(c *Config) *string { return &c.ICE.NAT1To1CandidateType })},
+	{"ice.network_types", "ICE_NETWORK_TYPES", "ice-network-types", "comma separated network types of candidates", setList(func(c *Config) *[]string { return &c.ICE.NetworkTypes })},
+	{"ice.interfaces", "ICE_INTERFACES", "ice-interfaces", "comma separated interfaces of host candidates", setList(func(c *Config) *[]string { return &c.ICE.Interfaces })},
+	{"ice.relay_only", "ICE_RELAY_ONLY", "ice-relay-only", "only gather relay candidates", func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("must be a boolean")
+		}
+		c.ICE.RelayOnly = b
+		return nil
+	}},
+	{"ice.udp_mux_address", "ICE_UDP_MUX_ADDRESS", "ice-udp-mux", "single UDP address shared by all host candidates", setString(func(c *Config) *string { return &c.ICE.UDPMuxAddress })},
+	{"ice.tcp_mux_address", "ICE_TCP_MUX_ADDRESS", "ice-tcp-mux", "single ICE-TCP address shared by all sessions", setString(func(c *Config) *string { return &c.ICE.TCPMuxAddress })},
+	{"turn.secret", "TURN_SECRET", "turn-secret", "runs a TURN server issuing credentials signed with this secret", setString(func(c *Config) *string { return &c.TURN.Secret })},
+	{"turn.address", "TURN_ADDRESS", "turn-address", "TURN server UDP address", setString(func(c *Config) *string { return &c.TURN.Address })},
+	{"turn.public_ip", "TURN_PUBLIC_IP", "turn-public-ip", "IP advertised to TURN clients", setString(func(c *Config) *string { return &c.TURN.PublicIP })},
+	{"turn.relay_port_min", "TURN_RELAY_PORT_RANGE", "turn-relay-port-range", "UDP port range of TURN allocations, for example 5201-5400", setPortRange(func(c *Config) (*uint16, *uint16) { return &c.TURN.RelayPortMin, &c.TURN.RelayPortMax })},
+	{"turn.credential_ttl", "TURN_CREDENTIAL_TTL", "turn-credential-ttl", "how long TURN credentials are valid for, sessions get new ones on reconnect", setDuration(func(c *Config) *time.Duration { return &c.TURN.CredentialTTL })},
+	{"directory.backend", "DIRECTORY_BACKEND", "directory", "directory backend", setString(func(c *Config) *string { return &c.Directory.Backend })},
+	{"directory.project_id", "FIREBASE_PROJECT_ID", "project", "Firebase project of the directory", setString(func(c *Config) *string { return &c.Directory.ProjectID })},
+	{"tls.cert_file", "TLS_CERT_FILE", "tls-cert", "TLS certificate file", setString(func(c *Config) *string { return &c.TLS.CertFile })},
+	{"tls.key_file", "TLS_KEY_FILE", "tls-key", "TLS key file", setString(func(c *Config) *string { return &c.TLS.KeyFile })},
+	{"tls.ca_file", "TLS_CA_FILE", "tls-ca", "CA of relay peer certificates", setString(func(c *Config) *string { return &c.TLS.CAFile })},
+	{"auth.jwt_secret", "JWT_SECRET", "jwt-secret", "HS256 token secret", setString(func(c *Config) *string { return &c.Auth.JWTSecret })},
+	{"auth.playback_secret", "PLAYBACK_SECRET", "playback-secret", "playback token secret", setString(func(c *Config) *string { return &c.Auth.PlaybackSecret })},
+	{"limits.max_publishers", "MAX_PUBLISHERS", "max-publishers", "maximum publishers", setInt(func(c *Config) *int { return &c.Limits.MaxPublishers })},
+	{"limits.max_subscribers", "MAX_SUBSCRIBERS", "max-subscribers", "maximum subscribers", setInt(func(c *Config) *int { return &c.Limits.MaxSubscribers })},
+	{"limits.max_egress_bitrate", "MAX_EGRESS_BITRATE", "max-egress-bitrate", "egress bits per second above which subscribers are rejected", func(c *Config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		c.Limits.MaxEgressBitrate = n
+		return nil
+	}},
+	{"limits.sessions_per_minute", "SESSIONS_PER_MINUTE", "sessions-per-minute", "sessions per minute per address", setFloat(func(c *Config) *float64 { return &c.Limits.SessionsPerMinute })},
+	{"limits.session_burst", "SESSION_BURST", "session-burst", "session burst per address", setInt(func(c *Config) *int { return &c.Limits.SessionBurst })},
+	{"buffer_window", "BUFFER_WINDOW", "buffer-window", "how far behind live subscriptions may start", setDuration(func(c *Config) *time.Duration { return &c.BufferWindow })},
+	{"drain_period", "DRAIN_PERIOD", "drain-period", "how long to drain before shutting down", setDuration(func(c *Config) *time.Duration { return &c.DrainPeriod })},
+	{"log.level", "LOG_LEVEL", "log-level", "debug, info, warn or error", setString(func(c *Config) *string { return &c.Log.Level })},
+	{"log.format", "LOG_FORMAT", "log-format", "console or stackdriver", setString(func(c *Config) *string { return &c.Log.Format })},
+}
+
+// LoadEnv overrides the configuration with the environment variables that are set.
+func (c *Config) LoadEnv(lookup func(string) (string, bool)) error {
+	// APP_ENV=production predates LOG_FORMAT.
+	if env, ok := lookup("APP_ENV"); ok && env == "production" {
+		c.Log.Format = "stackdriver"
+	}
+	for _, s := range setters {
+		value, ok := lookup(s.env)
+		if !ok || value == "" {
+			continue
+		}
+		if err := s.set(c, value); err != nil {
+			return &FieldError{Field: s.field, Err: fmt.Errorf("%s: %w", s.env, err)}
+		}
+	}
+	return nil
+}
+
+// Flags holds the command line overrides until they are applied.
+type Flags struct {
+	// Path is the config file, if any.
+	Path string
+
+	apply []func(c *Config) error
+}
+
+// RegisterFlags registers a flag for the config file and for every field on fs.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{}
+	fs.StringVar(&f.Path, "config", "", "YAML config file")
+	for _, s := range setters {
+		s := s
+		fs.Func(s.flag, s.usage, func(value string) error {
+			f.apply = append(f.apply, func(c *Config) error {
+				if err := s.set(c, value); err != nil {
+					return &FieldError{Field: s.field, Err: fmt.Errorf("-%s: %w", s.flag, err)}
+				}
+				return nil
+			})
+			return nil
+		})
+	}
+	return f
+}
+
+// Apply overrides the configuration with the flags that were set.
+func (f *Flags) Apply(c *Config) error {
+	for _, apply := range f.apply {
+		if err := apply(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load builds the configuration from the defaults, the config file named by the flags, the
+// environment and the flags, in increasing precedence, and validates it.
+func Load(f *Flags) (*Config, error) {
+	c := Default()
+	if f.Path != "" {
+		if err := c.LoadFile(f.Path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.LoadEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := f.Apply(c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func validateAddress(field, address string) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return &FieldError{Field: field, Err: err}
+	}
+	return nil
+}
+
+// Validate checks the configuration, returning a *FieldError for the first invalid field.
+func (c *Config) Validate() error {
+	if err := validateAddress("listen_address", c.ListenAddress); err != nil {
+		return err
+	}
+	if c.HTTPAddress != "" {
+		if err := validateAddress("http_address", c.HTTPAddress); err != nil {
+			return err
+		}
+	}
+	if c.InboundAddress != "" {
+		if err := validateAddress("inbound_address", c.InboundAddress); err != nil {
+			return err
+		}
+	}
+	for i, iceServer := range c.ICEServers {
+		field := fmt.Sprintf("ice_servers[%d]", i)
+		if len(iceServer.URLs) == 0 {
+			return &FieldError{Field: field + ".urls", Err: errors.New("must not be empty")}
+		}
+		for _, url := range iceServer.URLs {
+			if !strings.HasPrefix(url, "stun:") && !strings.HasPrefix(url, "stuns:") && !strings.HasPrefix(url, "turn:") && !strings.HasPrefix(url, "turns:") {
+				return &FieldError{Field: field + ".urls", Err: fmt.Errorf("%q is not a stun or turn url", url)}
+			}
+		}
+	}
+	if c.ICE.PortMin > c.ICE.PortMax {
+		return &FieldError{Field: "ice.port_min", Err: errors.New("must not be greater than ice.port_max")}
+	}
+	for i, ip := range c.ICE.NAT1To1IPs {
+		if net.ParseIP(ip) == nil {
+			return &FieldError{Field: fmt.Sprintf("ice.nat_1to1_ips[%d]", i), Err: fmt.Errorf("%q is not an IP", ip)}
+		}
+	}
+	if c.ICE.NAT1To1CandidateType != "host" && c.ICE.NAT1To1CandidateType != "srflx" {
+		return &FieldError{Field: "ice.nat_1to1_candidate_type", Err: fmt.Errorf("unsupported candidate type %q", c.ICE.NAT1To1CandidateType)}
+	}
+	for i, networkType := range c.ICE.NetworkTypes {
+		if _, err := webrtc.NewNetworkType(networkType); err != nil {
+			return &FieldError{Field: fmt.Sprintf("ice.network_types[%d]", i), Err: err}
+		}
+	}
+	if c.ICE.UDPMuxAddress != "" {
+		if err := validateAddress("ice.udp_mux_address", c.ICE.UDPMuxAddress); err != nil {
+			return err
+		}
+	}
+	if c.ICE.TCPMuxAddress != "" {
+		if err := validateAddress("ice.tcp_mux_address", c.ICE.TCPMuxAddress); err != nil {
+			return err
+		}
+	}
+	if c.TURN.Secret != "" {
+		if err := validateAddress("turn.address", c.TURN.Address); err != nil {
+			return err
+		}
+		if c.TURN.PublicIP == "" && len(c.ICE.NAT1To1IPs) == 0 {
+			return &FieldError{Field: "turn.public_ip", Err: errors.New("required if ice.nat_1to1_ips is empty")}
+		}
+		if c.TURN.PublicIP != "" && net.ParseIP(c.TURN.PublicIP) == nil {
+			return &FieldError{Field: "turn.public_ip", Err: fmt.Errorf("%q is not an IP", c.TURN.PublicIP)}
+		}
+		if c.TURN.RelayPortMin > c.TURN.RelayPortMax {
+			return &FieldError{Field: "turn.relay_port_min", Err: errors.New("must not be greater than turn.relay_port_max")}
+		}
+		if c.TURN.CredentialTTL <= 0 {
+			return &FieldError{Field: "turn.credential_ttl", Err: errors.New("must be positive")}
+		}
+	}
+	if c.Directory.Backend != "firestore" {
+		return &FieldError{Field: "directory.backend", Err: fmt.Errorf("unsupported backend %q", c.Directory.Backend)}
+	}
+	if c.Directory.ProjectID == "" {
+		return &FieldError{Field: "directory.project_id", Err: errors.New("must be set")}
+	}
+	if c.TLS.CertFile != "" && c.TLS.KeyFile == "" {
+		return &FieldError{Field: "tls.key_file", Err: errors.New("must be set with tls.cert_file")}
+	}
+	if c.TLS.CertFile == "" && (c.TLS.KeyFile != "" || c.TLS.CAFile != "") {
+		return &FieldError{Field: "tls.cert_file", Err: errors.New("must be set with tls.key_file or tls.ca_file")}
+	}
+	for _, limit := range []struct {
+		field string
+		value float64
+	}{
+		{"limits.max_publishers", float64(c.Limits.MaxPublishers)},
+		{"limits.max_subscribers", float64(c.Limits.MaxSubscribers)},
+		{"limits.max_egress_bitrate", float64(c.Limits.MaxEgressBitrate)},
+		{"limits.sessions_per_minute", c.Limits.SessionsPerMinute},
+		{"limits.session_burst", float64(c.Limits.SessionBurst)},
+	} {
+		if limit.value < 0 {
+			return &FieldError{Field: limit.field, Err: errors.New("must not be negative")}
+		}
+	}
+	if c.BufferWindow <= 0 {
+		return &FieldError{Field: "buffer_window", Err: errors.New("must be positive")}
+	}
+	if c.DrainPeriod < 0 {
+		return &FieldError{Field: "drain_period", Err: errors.New("must not be negative")}
+	}
+	if _, err := parseLevel(c.Log.Level); err != nil {
+		return &FieldError{Field: "log.level", Err: err}
+	}
+	if c.Log.Format != "console" && c.Log.Format != "stackdriver" {
+		return &FieldError{Field: "log.format", Err: fmt.Errorf("unsupported format %q", c.Log.Format)}
+	}
+	return nil
+}
+
+func parseLevel(text string) (zapcore.Level, error) {
+	var level zapcore.Level
+	err := level.UnmarshalText([]byte(text))
+	return level, err
+}
+
+// Logger builds the logger described by the configuration.
+func (c *Config) Logger() (*zap.Logger, error) {
+	level, err := parseLevel(c.Log.Level)
+	if err != nil {
+		return nil, &FieldError{Field: "log.level", Err: err}
+	}
+	var config zap.Config
+	if c.Log.Format == "stackdriver" {
+		config = zapdriver.NewProductionConfig()
+	} else {
+		config = zap.NewDevelopmentConfig()
+	}
+	config.Level = zap.NewAtomicLevelAt(level)
+	if c.Log.Format == "stackdriver" {
+		return config.Build(zapdriver.WrapCore())
+	}
+	return config.Build()
+}
+
+// ServeOptions maps the configuration onto the server's options.
+func (c *Config) ServeOptions() (server.ServeOptions, error) {
+	options := server.ServeOptions{
+		HTTPAddress:    c.HTTPAddress,
+		InboundAddress: c.InboundAddress,
+		ProjectID:      c.Directory.ProjectID,
+		Limits: admission.Limits{
+			MaxPublishers:     c.Limits.MaxPublishers,
+			MaxSubscribers:    c.Limits.MaxSubscribers,
+			MaxEgressBitrate:  c.Limits.MaxEgressBitrate,
+			SessionsPerMinute: c.Limits.SessionsPerMinute,
+			SessionBurst:      c.Limits.SessionBurst,
+		},
+		BufferWindow: c.BufferWindow,
+		DrainPeriod:  c.DrainPeriod,
+	}
+	options.ICE = server.ICEOptions{
+		PortMin:    c.ICE.PortMin,
+		PortMax:    c.ICE.PortMax,
+		NAT1To1IPs: c.ICE.NAT1To1IPs,
+		Interfaces: c.ICE.Interfaces,
+		RelayOnly:  c.ICE.RelayOnly,
+
+		UDPMuxAddress: c.ICE.UDPMuxAddress,
+		TCPMuxAddress: c.ICE.TCPMuxAddress,
+	}
+	if len(c.ICE.NAT1To1IPs) > 0 {
+		candidateType, err := webrtc.NewICECandidateType(c.ICE.NAT1To1CandidateType)
+		if err != nil {
+			return options, &FieldError{Field: "ice.nat_1to1_candidate_type", Err: err}
+		}
+		options.ICE.NAT1To1CandidateType = candidateType
+	}
+	for i, networkType := range c.ICE.NetworkTypes {
+		t, err := webrtc.NewNetworkType(networkType)
+		if err != nil {
+			return options, &FieldError{Field: fmt.Sprintf("ice.network_types[%d]", i), Err: err}
+		}
+		options.ICE.NetworkTypes = append(options.ICE.NetworkTypes, t)
+	}
+	if c.TURN.Secret != "" {
+		publicIP := c.TURN.PublicIP
+		if publicIP == "" {
+			publicIP = c.ICE.NAT1To1IPs[0]
+		}
+		options.TURN = &server.TURNOptions{
+			Address:       c.TURN.Address,
+			PublicIP:      publicIP,
+			RelayPortMin:  c.TURN.RelayPortMin,
+			RelayPortMax:  c.TURN.RelayPortMax,
+			Realm:         c.TURN.Realm,
+			Secret:        c.TURN.Secret,
+			CredentialTTL: c.TURN.CredentialTTL,
+		}
+	}
+	for _, iceServer := range c.ICEServers {
+		options.ICEServers = append(options.ICEServers, webrtc.ICEServer{
+			URLs:       iceServer.URLs,
+			Username:   iceServer.Username,
+			Credential: iceServer.Credential,
+		})
+	}
+
+	// nodes presenting a certificate signed by the ca are trusted as relay peers.
+	if c.TLS.CertFile != "" {
+		options.TLS = &server.TLSOptions{CertFile: c.TLS.CertFile, KeyFile: c.TLS.KeyFile, CAFile: c.TLS.CAFile}
+	}
+
+	// nodes share the secret so they mint their own token to relay from each other.
+	if c.Auth.JWTSecret != "" {
+		hmac := auth.NewHMACAuthorizer([]byte(c.Auth.JWTSecret))
+		token, err := hmac.Sign(&auth.Claims{Roles: []auth.Role{auth.RoleSubscribe}, StreamIDPrefixes: []string{""}})
+		if err != nil {
+			return options, err
+		}
+		options.Authorizer, options.RelayCredentials = hmac, auth.Token(token)
+	}
+
+	if c.Auth.PlaybackSecret != "" {
+		options.PlaybackSigner = auth.NewPlaybackSigner([]byte(c.Auth.PlaybackSecret))
+	}
+	return options, nil
+}
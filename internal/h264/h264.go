@@ -0,0 +1,312 @@
+package h264
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+const (
+	NALUTypeIDR = 5
+	NALUTypeSPS = 7
+	NALUTypePPS = 8
+	NALUTypeAUD = 9
+)
+
+// NALUType returns the type of the given NAL unit.
+func NALUType(nalu []byte) int {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return int(nalu[0] & 0x1F)
+}
+
+// AccessUnit is a single coded picture.
+type AccessUnit struct {
+	NALUs     [][]byte
+	Timestamp uint32
+	Keyframe  bool
+}
+
+// AVCC returns the access unit's NAL units in length-prefixed form, excluding parameter sets.
+func (au *AccessUnit) AVCC() []byte {
+	var buf []byte
+	for _, nalu := range au.NALUs {
+		switch NALUType(nalu) {
+		case NALUTypeSPS, NALUTypePPS, NALUTypeAUD:
+			continue
+		}
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(nalu)))
+		buf = append(append(buf, size...), nalu...)
+	}
+	return buf
+}
+
+// Depacketizer reassembles access units from H.264 RTP packets.
+type Depacketizer struct {
+	packet  codecs.H264Packet
+	current *AccessUnit
+	lastSeq uint16
+	started bool
+	broken  bool
+
+	// SPS and PPS hold the most recently received parameter sets.
+	SPS []byte
+	PPS []byte
+}
+
+func NewDepacketizer() *Depacketizer {
+	return &Depacketizer{packet: codecs.H264Packet{IsAVC: true}}
+}
+
+// Push adds a packet to the depacketizer and returns an access unit if one was completed.
+// Access units that lost packets are dropped.
+func (d *Depacketizer) Push(p *rtp.Packet) *AccessUnit {
+	var completed *AccessUnit
+	if d.started && p.SequenceNumber != d.lastSeq+1 {
+		// a packet was lost, so the current access unit and any fragmented nalu is corrupt.
+		d.packet = codecs.H264Packet{IsAVC: true}
+		d.current = nil
+		d.broken = true
+	}
+	d.started = true
+	d.lastSeq = p.SequenceNumber
+
+	if d.current != nil && d.current.Timestamp != p.Timestamp {
+		// the marker bit was lost, flush on timestamp change.
+		completed = d.flush()
+	}
+	if d.current == nil {
+		d.current = &AccessUnit{Timestamp: p.Timestamp}
+	}
+
+	buf, err := d.packet.Unmarshal(p.Payload)
+	if err != nil {
+		d.broken = true
+		return completed
+	}
+	for len(buf) >= 4 {
+		size := int(binary.BigEndian.Uint32(buf))
+		if size > len(buf)-4 {
+			break
+		}
+		nalu := buf[4 : 4+size]
+		buf = buf[4+size:]
+		switch NALUType(nalu) {
+		case NALUTypeIDR:
+			d.current.Keyframe = true
+		case NALUTypeSPS:
+			d.SPS = append([]byte{}, nalu...)
+		case NALUTypePPS:
+			d.PPS = append([]byte{}, nalu...)
+		}
+		d.current.NALUs = append(d.current.NALUs, nalu)
+	}
+
+	if p.Marker {
+		if au := d.flush(); au != nil {
+			completed = au
+		}
+	}
+	return completed
+}
+
+func (d *Depacketizer) flush() *AccessUnit {
+	au := d.current
+	d.current = nil
+	if au == nil || len(au.NALUs) == 0 {
+		return nil
+	}
+	if d.broken {
+		// wait for a keyframe to recover.
+		if !au.Keyframe {
+			return nil
+		}
+		d.broken = false
+	}
+	return au
+}
+
+// IsKeyframe reports whether an H.264 RTP payload starts or contains an IDR picture.
+func IsKeyframe(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	switch t := payload[0] & 0x1F; {
+	case t == NALUTypeIDR || t == NALUTypeSPS:
+		return true
+	case t == 24:
+		// STAP-A, check each aggregated nalu.
+		for i := 1; i+2 < len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[i:]))
+			if nt := payload[i+2] & 0x1F; nt == NALUTypeIDR || nt == NALUTypeSPS {
+				return true
+			}
+			i += 2 + size
+		}
+	case t == 28:
+		// FU-A, check the start fragment.
+		return payload[1]&0x80 != 0 && payload[1]&0x1F == NALUTypeIDR
+	}
+	return false
+}
+
+var ErrInvalidSPS = errors.New("invalid sps")
+
+// SPSInfo holds the fields of a sequence parameter set needed for container headers.
+type SPSInfo struct {
+	ProfileIDC           uint8
+	ProfileCompatibility uint8
+	LevelIDC             uint8
+	Width                int
+	Height               int
+}
+
+// ParseSPS parses the dimensions out of a sequence parameter set.
+func ParseSPS(sps []byte) (*SPSInfo, error) {
+	if len(sps) < 4 {
+		return nil, ErrInvalidSPS
+	}
+	info := &SPSInfo{ProfileIDC: sps[1], ProfileCompatibility: sps[2], LevelIDC: sps[3]}
+	r := &bitReader{buf: unescape(sps[4:])}
+
+	r.ue() // seq_parameter_set_id
+	switch info.ProfileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIDC := r.ue()
+		if chromaFormatIDC == 3 {
+			r.bits(1) // separate_colour_plane_flag
+		}
+		r.ue()    // bit_depth_luma_minus8
+		r.ue()    // bit_depth_chroma_minus8
+		r.bits(1) // qpprime_y_zero_transform_bypass_flag
+		// seq_scaling_matrix_present_flag
+		if r.bits(1) == 1 {
+			n := 8
+			if chromaFormatIDC == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if r.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.ue() // log2_max_frame_num_minus4
+	// pic_order_cnt_type
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bits(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		n := r.ue()
+		for i := 0; i < n; i++ {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.bits(1) // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := r.ue() + 1
+	heightInMapUnits := r.ue() + 1
+	frameMbsOnly := r.bits(1)
+	if frameMbsOnly == 0 {
+		r.bits(1) // mb_adaptive_frame_field_flag
+	}
+	r.bits(1) // direct_8x8_inference_flag
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.bits(1) == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.err {
+		return nil, ErrInvalidSPS
+	}
+
+	info.Width = widthInMbs*16 - 2*(cropLeft+cropRight)
+	info.Height = (2-frameMbsOnly)*heightInMapUnits*16 - 2*(2-frameMbsOnly)*(cropTop+cropBottom)
+	return info, nil
+}
+
+// unescape removes emulation prevention bytes.
+func unescape(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros == 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+type bitReader struct {
+	buf []byte
+	pos int
+	err bool
+}
+
+func (r *bitReader) bits(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.buf)*8 {
+			r.err = true
+			return 0
+		}
+		v = v<<1 | int(r.buf[r.pos/8]>>(7-r.pos%8))&1
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) ue() int {
+	zeros := 0
+	for r.bits(1) == 0 && !r.err {
+		zeros++
+		if zeros > 31 {
+			r.err = true
+			return 0
+		}
+	}
+	return (1 << zeros) - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v%2 == 0 {
+		return -v / 2
+	}
+	return (v + 1) / 2
+}
+
+// DecoderConfig returns the AVCDecoderConfigurationRecord for the given parameter sets.
+func DecoderConfig(sps, pps []byte) []byte {
+	buf := []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1, byte(len(sps) >> 8), byte(len(sps))}
+	buf = append(buf, sps...)
+	buf = append(buf, 1, byte(len(pps)>>8), byte(len(pps)))
+	return append(buf, pps...)
+}
@@ -0,0 +1,240 @@
+package hls
+
+import (
+	"encoding/binary"
+
+	"github.com/muxable/cdn/internal/h264"
+)
+
+// box serializes an ISO BMFF box.
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	buf := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	copy(buf[4:], typ)
+	for _, p := range payload {
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+// fullBox serializes an ISO BMFF box with a version and flags header.
+func fullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := u32(flags)
+	header[0] = version
+	return box(typ, append([][]byte{header}, payload...)...)
+}
+
+func u8(v uint8) []byte {
+	return []byte{v}
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+var matrix = concat(u32(0x00010000), u32(0), u32(0), u32(0), u32(0x00010000), u32(0), u32(0), u32(0), u32(0x40000000))
+
+func concat(parts ...[]byte) []byte {
+	var buf []byte
+	for _, p := range parts {
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+// fmp4Track describes a track in the fragmented mp4 output.
+type fmp4Track struct {
+	id        uint32
+	timescale uint32
+
+	// video tracks.
+	sps, pps []byte
+	width    int
+	height   int
+
+	// audio tracks.
+	channels int
+}
+
+func (t *fmp4Track) isVideo() bool {
+	return t.sps != nil
+}
+
+// codec returns the RFC 6381 codec string of the track.
+func (t *fmp4Track) codec() string {
+	if t.isVideo() {
+		return "avc1." + hex(t.sps[1:4])
+	}
+	return "opus"
+}
+
+func hex(b []byte) string {
+	const digits = "0123456789abcdef"
+	s := make([]byte, 0, 2*len(b))
+	for _, c := range b {
+		s = append(s, digits[c>>4], digits[c&0xF])
+	}
+	return string(s)
+}
+
+// newVideoTrack creates an H.264 track from its parameter sets.
+func newVideoTrack(id uint32, sps, pps []byte) *fmp4Track {
+	t := &fmp4Track{id: id, timescale: 90000, sps: sps, pps: pps}
+	if info, err := h264.ParseSPS(sps); err == nil {
+		t.width, t.height = info.Width, info.Height
+	}
+	return t
+}
+
+// newAudioTrack creates an Opus track.
+func newAudioTrack(id uint32, channels int) *fmp4Track {
+	if channels == 0 {
+		channels = 2
+	}
+	return &fmp4Track{id: id, timescale: 48000, channels: channels}
+}
+
+func (t *fmp4Track) sampleEntry() []byte {
+	if t.isVideo() {
+		avcC := box("avcC", h264.DecoderConfig(t.sps, t.pps))
+		return box("avc1",
+			zeros(6), u16(1), // reserved, data_reference_index
+			zeros(16),
+			u16(uint16(t.width)), u16(uint16(t.height)),
+			u32(0x00480000), u32(0x00480000), // resolution
+			zeros(4), u16(1), zeros(32), // reserved, frame_count, compressorname
+			u16(0x0018), u16(0xFFFF), // depth, pre_defined
+			avcC)
+	}
+	dOps := box("dOps",
+		u8(0), u8(uint8(t.channels)), u16(0), u32(48000), u16(0), u8(0))
+	return box("Opus",
+		zeros(6), u16(1), // reserved, data_reference_index
+		zeros(8), u16(uint16(t.channels)), u16(16), zeros(4),
+		u32(48000<<16),
+		dOps)
+}
+
+func (t *fmp4Track) trak() []byte {
+	var volume uint16
+	handler, name := "vide", "VideoHandler"
+	mediaHeader := fullBox("vmhd", 0, 1, zeros(8))
+	if !t.isVideo() {
+		volume = 0x0100
+		handler, name = "soun", "SoundHandler"
+		mediaHeader = fullBox("smhd", 0, 0, zeros(4))
+	}
+
+	return box("trak",
+		fullBox("tkhd", 0, 3,
+			zeros(8), u32(t.id), zeros(4), u32(0), // creation, modification, track_id, reserved, duration
+			zeros(8), u16(0), u16(0), u16(volume), zeros(2),
+			matrix,
+			u32(uint32(t.width)<<16), u32(uint32(t.height)<<16)),
+		box("mdia",
+			fullBox("mdhd", 0, 0, zeros(8), u32(t.timescale), u32(0), u16(0x55C4), u16(0)),
+			fullBox("hdlr", 0, 0, zeros(4), []byte(handler), zeros(12), []byte(name), u8(0)),
+			box("minf",
+				mediaHeader,
+				box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1))),
+				box("stbl",
+					fullBox("stsd", 0, 0, u32(1), t.sampleEntry()),
+					fullBox("stts", 0, 0, u32(0)),
+					fullBox("stsc", 0, 0, u32(0)),
+					fullBox("stsz", 0, 0, u32(0), u32(0)),
+					fullBox("stco", 0, 0, u32(0))))))
+}
+
+// initSegment serializes the initialization segment for the given tracks.
+func initSegment(tracks []*fmp4Track) []byte {
+	traks := [][]byte{
+		fullBox("mvhd", 0, 0,
+			zeros(8), u32(1000), u32(0), // creation, modification, timescale, duration
+			u32(0x00010000), u16(0x0100), zeros(10), // rate, volume, reserved
+			matrix, zeros(24), u32(uint32(len(tracks)+1))),
+	}
+	var trexs [][]byte
+	for _, t := range tracks {
+		traks = append(traks, t.trak())
+		trexs = append(trexs, fullBox("trex", 0, 0, u32(t.id), u32(1), u32(0), u32(0), u32(0)))
+	}
+	traks = append(traks, box("mvex", trexs...))
+
+	return concat(
+		box("ftyp", []byte("iso5"), u32(1), []byte("iso5"), []byte("iso6"), []byte("mp41")),
+		box("moov", traks...))
+}
+
+type sample struct {
+	data     []byte
+	duration uint32
+	keyframe bool
+}
+
+// trackRun is a run of consecutive samples of a single track.
+type trackRun struct {
+	track          *fmp4Track
+	baseDecodeTime uint64
+	samples        []*sample
+}
+
+// fragment serializes a moof and mdat pair holding the given runs.
+func fragment(sequence uint32, runs []*trackRun) []byte {
+	const trunHeaderSize = 8 + 4 + 4 + 4 // box header, version/flags, sample_count, data_offset
+
+	// the data offset position in each traf is patched after the moof size is known.
+	var trafs [][]byte
+	var offsets []int
+	var mdat []byte
+	position := 8 + 8 + 8 // moof header, mfhd
+	for _, run := range runs {
+		entries := make([]byte, 0, 12*len(run.samples))
+		for _, s := range run.samples {
+			flags := uint32(0x01010000)
+			if s.keyframe || !run.track.isVideo() {
+				flags = 0x02000000
+			}
+			entries = append(entries, concat(u32(s.duration), u32(uint32(len(s.data))), u32(flags))...)
+		}
+		tfhd := fullBox("tfhd", 0, 0x020000, u32(run.track.id))
+		tfdt := fullBox("tfdt", 1, 0, u64(run.baseDecodeTime))
+		trun := fullBox("trun", 0, 0x000701, u32(uint32(len(run.samples))), u32(uint32(len(mdat))), entries)
+		offsets = append(offsets, position+8+len(tfhd)+len(tfdt)+trunHeaderSize-4)
+		traf := box("traf", tfhd, tfdt, trun)
+		position += len(traf)
+		trafs = append(trafs, traf)
+		for _, s := range run.samples {
+			mdat = append(mdat, s.data...)
+		}
+	}
+
+	moof := box("moof", append([][]byte{fullBox("mfhd", 0, 0, u32(sequence))}, trafs...)...)
+	for _, offset := range offsets {
+		// convert the offset within mdat to an offset from the start of the moof.
+		dataOffset := binary.BigEndian.Uint32(moof[offset:]) + uint32(len(moof)) + 8
+		binary.BigEndian.PutUint32(moof[offset:], dataOffset)
+	}
+	return concat(moof, box("mdat", mdat))
+}
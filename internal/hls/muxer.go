@@ -0,0 +1,482 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muxable/cdn/internal/h264"
+	"github.com/muxable/cdn/internal/store"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+var ErrMuxerClosed = errors.New("muxer closed")
+
+const (
+	partTarget       = 200 * time.Millisecond
+	segmentTarget    = 2 * time.Second
+	retainedSegments = 6
+
+	// audioOnlyDelay is how long to wait for a video track before packaging audio alone.
+	audioOnlyDelay = 2 * time.Second
+)
+
+type part struct {
+	data        []byte
+	duration    time.Duration
+	independent bool
+}
+
+type segment struct {
+	id       int
+	parts    []*part
+	complete bool
+}
+
+func (s *segment) duration() time.Duration {
+	var d time.Duration
+	for _, p := range s.parts {
+		d += p.duration
+	}
+	return d
+}
+
+// muxerTrack holds the packaging state of a single input track.
+type muxerTrack struct {
+	*fmp4Track
+
+	decodeTime uint64
+	pending    []*sample
+	held       *sample
+	heldTS     uint32
+}
+
+// push adds a sample with the given rtp timestamp, completing the previously held sample.
+func (t *muxerTrack) push(s *sample, ts uint32) *sample {
+	prev := t.held
+	if prev != nil {
+		prev.duration = ts - t.heldTS
+		if prev.duration == 0 || prev.duration > 5*t.timescale {
+			// discontinuity, assume a nominal frame duration.
+			prev.duration = t.timescale / 50
+			if t.isVideo() {
+				prev.duration = t.timescale / 30
+			}
+		}
+	}
+	t.held, t.heldTS = s, ts
+	return prev
+}
+
+func (t *muxerTrack) pendingDuration() time.Duration {
+	var d uint64
+	for _, s := range t.pending {
+		d += uint64(s.duration)
+	}
+	return t.toDuration(d)
+}
+
+func (t *muxerTrack) toDuration(ts uint64) time.Duration {
+	return time.Duration(ts) * time.Second / time.Duration(t.timescale)
+}
+
+// Muxer packages a single stream as low-latency HLS.
+type Muxer struct {
+	sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	video *muxerTrack
+	audio *muxerTrack
+
+	init     []byte
+	segments []*segment
+	current  *segment
+	sequence uint32
+	updated  chan struct{}
+	closed   bool
+
+	created    time.Time
+	lastAccess time.Time
+}
+
+// NewMuxer starts packaging the tracks delivered on the given channel.
+func NewMuxer(ctx context.Context, tracks chan *store.TrackLocal) *Muxer {
+	ctx, cancel := context.WithCancel(ctx)
+	m := &Muxer{
+		ctx:        ctx,
+		cancel:     cancel,
+		updated:    make(chan struct{}),
+		current:    &segment{},
+		created:    time.Now(),
+		lastAccess: time.Now(),
+	}
+
+	go func() {
+		for tl := range tracks {
+			codec := tl.Codec()
+			switch {
+			case strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264):
+				m.Lock()
+				ok := m.video == nil && m.init == nil
+				if ok {
+					m.video = &muxerTrack{}
+				}
+				m.Unlock()
+				if !ok {
+					continue
+				}
+				go func(r *store.TrackReader) {
+					defer r.Close()
+					// unblock the read once the muxer closes.
+					go func() {
+						<-m.ctx.Done()
+						r.Close()
+					}()
+					m.readVideo(r)
+					// the track ended, so the stream has to be packaged from scratch.
+					m.Close()
+				}(tl.NewReader())
+
+			case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+				m.Lock()
+				ok := m.audio == nil && m.init == nil
+				if ok {
+					m.audio = &muxerTrack{fmp4Track: newAudioTrack(2, int(codec.Channels))}
+				}
+				m.Unlock()
+				if !ok {
+					continue
+				}
+				go func(r *store.TrackReader) {
+					defer r.Close()
+					// unblock the read once the muxer closes.
+					go func() {
+						<-m.ctx.Done()
+						r.Close()
+					}()
+					m.readAudio(r)
+					// the track ended, so the stream has to be packaged from scratch.
+					m.Close()
+				}(tl.NewReader())
+
+			default:
+				zap.L().Debug("skipping unsupported hls track", zap.String("mimeType", codec.MimeType))
+			}
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		m.Close()
+	}()
+
+	return m
+}
+
+func (m *Muxer) readVideo(r *store.TrackReader) {
+	d := h264.NewDepacketizer()
+	for {
+		p, err := r.ReadRTP()
+		if err != nil {
+			return
+		}
+		au := d.Push(p)
+		if au == nil {
+			continue
+		}
+
+		m.Lock()
+		if m.video.fmp4Track == nil {
+			if !au.Keyframe || d.SPS == nil || d.PPS == nil {
+				// wait for a decodable starting point.
+				m.Unlock()
+				continue
+			}
+			m.video.fmp4Track = newVideoTrack(1, d.SPS, d.PPS)
+			m.writeInit()
+		}
+		if s := m.video.push(&sample{data: au.AVCC(), keyframe: au.Keyframe}, au.Timestamp); s != nil {
+			m.addVideoSample(s)
+		}
+		m.Unlock()
+	}
+}
+
+func (m *Muxer) readAudio(r *store.TrackReader) {
+	for {
+		p, err := r.ReadRTP()
+		if err != nil {
+			return
+		}
+
+		m.Lock()
+		if m.init == nil && m.video == nil && time.Since(m.created) > audioOnlyDelay {
+			// no video track arrived, so this is an audio only stream.
+			m.writeInit()
+		}
+		if m.init != nil {
+			if s := m.audio.push(&sample{data: p.Payload, keyframe: true}, p.Timestamp); s != nil {
+				if m.video == nil && m.audio.pendingDuration()+m.audio.toDuration(uint64(s.duration)) > partTarget {
+					m.flushPart(m.current.duration()+m.audio.pendingDuration() >= segmentTarget)
+				}
+				m.audio.pending = append(m.audio.pending, s)
+			}
+		}
+		m.Unlock()
+	}
+}
+
+// addVideoSample appends a video sample, cutting parts and segments as needed.
+func (m *Muxer) addVideoSample(s *sample) {
+	if len(m.video.pending) > 0 {
+		elapsed := m.current.duration() + m.video.pendingDuration()
+		switch {
+		case s.keyframe && elapsed >= segmentTarget, elapsed >= 4*segmentTarget:
+			m.flushPart(true)
+		case m.video.pendingDuration()+m.video.toDuration(uint64(s.duration)) > partTarget:
+			m.flushPart(false)
+		}
+	}
+	m.video.pending = append(m.video.pending, s)
+}
+
+// writeInit generates the initialization segment from the currently known tracks.
+func (m *Muxer) writeInit() {
+	var tracks []*fmp4Track
+	if m.video != nil && m.video.fmp4Track != nil {
+		tracks = append(tracks, m.video.fmp4Track)
+	}
+	if m.audio != nil {
+		tracks = append(tracks, m.audio.fmp4Track)
+	}
+	m.init = initSegment(tracks)
+}
+
+// flushPart writes the pending samples as a new part, optionally ending the current segment.
+func (m *Muxer) flushPart(endSegment bool) {
+	if m.closed {
+		return
+	}
+	var runs []*trackRun
+	var duration time.Duration
+	independent := true
+	for _, t := range []*muxerTrack{m.video, m.audio} {
+		if t == nil || t.fmp4Track == nil || len(t.pending) == 0 {
+			continue
+		}
+		if t.isVideo() {
+			// parts are cut on video sample boundaries so the video duration is authoritative.
+			duration = t.pendingDuration()
+			independent = t.pending[0].keyframe
+		} else if m.video == nil {
+			duration = t.pendingDuration()
+		}
+		runs = append(runs, &trackRun{track: t.fmp4Track, baseDecodeTime: t.decodeTime, samples: t.pending})
+		for _, s := range t.pending {
+			t.decodeTime += uint64(s.duration)
+		}
+		t.pending = nil
+	}
+	if len(runs) == 0 {
+		return
+	}
+
+	m.sequence++
+	m.current.parts = append(m.current.parts, &part{
+		data:        fragment(m.sequence, runs),
+		duration:    duration,
+		independent: independent,
+	})
+
+	if endSegment {
+		m.current.complete = true
+		m.segments = append(m.segments, m.current)
+		if len(m.segments) > retainedSegments {
+			m.segments = m.segments[1:]
+		}
+		m.current = &segment{id: m.current.id + 1}
+	}
+
+	close(m.updated)
+	m.updated = make(chan struct{})
+}
+
+// Close stops the muxer.
+func (m *Muxer) Close() {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return
+	}
+	m.closed = true
+	m.cancel()
+	close(m.updated)
+}
+
+// Done returns a channel that's closed when the muxer stops.
+func (m *Muxer) Done() <-chan struct{} {
+	return m.ctx.Done()
+}
+
+// touch records an access to the muxer to keep it alive.
+func (m *Muxer) touch() {
+	m.Lock()
+	defer m.Unlock()
+	m.lastAccess = time.Now()
+}
+
+// idle returns how long it has been since the muxer was last accessed.
+func (m *Muxer) idle() time.Duration {
+	m.Lock()
+	defer m.Unlock()
+	return time.Since(m.lastAccess)
+}
+
+// wait blocks until ready returns true, the muxer closes or the context is cancelled.
+// The muxer is locked when ready is called and when wait returns nil.
+func (m *Muxer) wait(ctx context.Context, ready func() bool) error {
+	m.Lock()
+	for !ready() {
+		if m.closed {
+			m.Unlock()
+			return ErrMuxerClosed
+		}
+		updated := m.updated
+		m.Unlock()
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		m.Lock()
+	}
+	return nil
+}
+
+// hasPart reports whether the given part of the given segment is available.
+func (m *Muxer) hasPart(msn, index int) bool {
+	if msn < m.current.id {
+		return true
+	}
+	return msn == m.current.id && index < len(m.current.parts)
+}
+
+// segment returns the retained segment with the given media sequence number.
+func (m *Muxer) segment(msn int) *segment {
+	if msn == m.current.id {
+		return m.current
+	}
+	for _, s := range m.segments {
+		if s.id == msn {
+			return s
+		}
+	}
+	return nil
+}
+
+// Init returns the initialization segment once it is available.
+func (m *Muxer) Init(ctx context.Context) ([]byte, error) {
+	if err := m.wait(ctx, func() bool { return m.init != nil }); err != nil {
+		return nil, err
+	}
+	defer m.Unlock()
+	return m.init, nil
+}
+
+// Playlist returns the media playlist, blocking until the given part is available if msn is
+// non-negative. A negative index waits for the whole segment. If query is non-empty, it's added
+// to every uri in the playlist.
+func (m *Muxer) Playlist(ctx context.Context, msn, index int, query string) ([]byte, error) {
+	if err := m.wait(ctx, func() bool {
+		if m.init == nil || len(m.segments) == 0 && len(m.current.parts) == 0 {
+			return false
+		}
+		if msn < 0 {
+			return true
+		}
+		if index < 0 {
+			return msn < m.current.id
+		}
+		return m.hasPart(msn, index)
+	}); err != nil {
+		return nil, err
+	}
+	defer m.Unlock()
+
+	targetDuration := segmentTarget
+	for _, s := range m.segments {
+		if d := s.duration(); d > targetDuration {
+			targetDuration = d
+		}
+	}
+
+	first := m.current.id
+	if len(m.segments) > 0 {
+		first = m.segments[0].id
+	}
+
+	if query != "" {
+		query = "?" + query
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration.Seconds())))
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init.mp4%s\"\n", query)
+	for _, s := range append(m.segments, m.current) {
+		for i, p := range s.parts {
+			fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"part%d.%d.mp4%s\"", p.duration.Seconds(), s.id, i, query)
+			if p.independent {
+				b.WriteString(",INDEPENDENT=YES")
+			}
+			b.WriteString("\n")
+		}
+		if s.complete {
+			fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg%d.mp4%s\n", s.duration().Seconds(), s.id, query)
+		}
+	}
+	fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.mp4%s\"\n", m.current.id, len(m.current.parts), query)
+	return []byte(b.String()), nil
+}
+
+// Part returns the given part, blocking until it is available if it's the next one.
+func (m *Muxer) Part(ctx context.Context, msn, index int) ([]byte, error) {
+	if err := m.wait(ctx, func() bool { return m.hasPart(msn, index) || msn > m.current.id+1 }); err != nil {
+		return nil, err
+	}
+	defer m.Unlock()
+	s := m.segment(msn)
+	if s == nil || index >= len(s.parts) {
+		return nil, errors.New("part not found")
+	}
+	return s.parts[index].data, nil
+}
+
+// Segment returns the given complete segment, blocking until it is complete.
+func (m *Muxer) Segment(ctx context.Context, msn int) ([]byte, error) {
+	if err := m.wait(ctx, func() bool { return msn < m.current.id || msn > m.current.id+1 }); err != nil {
+		return nil, err
+	}
+	defer m.Unlock()
+	s := m.segment(msn)
+	if s == nil {
+		return nil, errors.New("segment not found")
+	}
+	var data []byte
+	for _, p := range s.parts {
+		data = append(data, p.data...)
+	}
+	return data, nil
+}
@@ -0,0 +1,229 @@
+package hls
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muxable/cdn/internal/store"
+	"go.uber.org/zap"
+)
+
+const (
+	// idleTimeout is how long a muxer keeps running without any viewer requests.
+	idleTimeout = 30 * time.Second
+
+	// blockTimeout bounds how long a blocking playlist or part request waits.
+	blockTimeout = 10 * time.Second
+)
+
+// SubscribeFunc subscribes to the tracks of a stream until the context is cancelled.
+type SubscribeFunc func(ctx context.Context, streamID string) (chan *store.TrackLocal, error)
+
+// AuthorizeFunc checks that the request may view the stream. token is the request's token query
+// parameter.
+type AuthorizeFunc func(r *http.Request, streamID, token string) error
+
+// Server serves streams as LL-HLS, starting a muxer for a stream on its first request.
+type Server struct {
+	sync.Mutex
+
+	subscribe SubscribeFunc
+	authorize AuthorizeFunc
+	muxers    map[string]*Muxer
+	// starting holds the muxers whose subscription is in progress, which can take a relay.
+	starting map[string]*pendingMuxer
+}
+
+// pendingMuxer is a muxer being started, done is closed once m or err is set.
+type pendingMuxer struct {
+	done chan struct{}
+	m    *Muxer
+	err  error
+}
+
+// NewServer creates an LL-HLS server. If authorize is non-nil, every request is checked so viewers
+// are cut off once their token expires.
+func NewServer(subscribe SubscribeFunc, authorize AuthorizeFunc) *Server {
+	return &Server{
+		subscribe: subscribe,
+		authorize: authorize,
+		muxers:    make(map[string]*Muxer),
+		starting:  make(map[string]*pendingMuxer),
+	}
+}
+
+// muxer returns the running muxer for the stream, starting one if needed. Concurrent requests for
+// a stream that is starting wait for it without holding up other streams.
+func (s *Server) muxer(streamID string) (*Muxer, error) {
+	s.Lock()
+	if m, ok := s.muxers[streamID]; ok {
+		m.touch()
+		s.Unlock()
+		return m, nil
+	}
+	if pending, ok := s.starting[streamID]; ok {
+		s.Unlock()
+		<-pending.done
+		return pending.m, pending.err
+	}
+	pending := &pendingMuxer{done: make(chan struct{})}
+	s.starting[streamID] = pending
+	s.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var tracks chan *store.TrackLocal
+	if tracks, pending.err = s.subscribe(ctx, streamID); pending.err == nil {
+		pending.m = NewMuxer(ctx, tracks)
+	}
+
+	s.Lock()
+	delete(s.starting, streamID)
+	if pending.err == nil {
+		s.muxers[streamID] = pending.m
+	}
+	s.Unlock()
+	close(pending.done)
+
+	if pending.err != nil {
+		cancel()
+		return nil, pending.err
+	}
+	zap.L().Info("starting hls muxer", zap.String("streamId", streamID))
+	go s.reap(streamID, pending.m, cancel)
+	return pending.m, nil
+}
+
+// reap stops the muxer once it's idle or done and removes it.
+func (s *Server) reap(streamID string, m *Muxer, cancel context.CancelFunc) {
+	ticker := time.NewTicker(idleTimeout / 4)
+	defer ticker.Stop()
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+			done = m.idle() >= idleTimeout
+		case <-m.Done():
+			done = true
+		}
+	}
+	m.Close()
+	cancel()
+	s.Lock()
+	if s.muxers[streamID] == m {
+		delete(s.muxers, streamID)
+	}
+	s.Unlock()
+	zap.L().Info("stopped hls muxer", zap.String("streamId", streamID))
+}
+
+// ServeHTTP serves paths of the form {streamId}/{file}.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	streamID, file := path.Split(strings.TrimPrefix(r.URL.Path, "/"))
+	streamID = strings.TrimSuffix(streamID, "/")
+	if streamID == "" || file == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if s.authorize != nil {
+		if err := s.authorize(r, streamID, token); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	m, err := s.muxer(streamID)
+	if err != nil {
+		zap.L().Warn("failed to start hls muxer", zap.String("streamId", streamID), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), blockTimeout)
+	defer cancel()
+
+	var data []byte
+	switch {
+	case file == "index.m3u8":
+		msn, index := -1, -1
+		if v := r.URL.Query().Get("_HLS_msn"); v != "" {
+			if msn, err = strconv.Atoi(v); err != nil {
+				http.Error(w, "invalid _HLS_msn", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := r.URL.Query().Get("_HLS_part"); v != "" {
+			if index, err = strconv.Atoi(v); err != nil {
+				http.Error(w, "invalid _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+		// propagate the token to the uris in the playlist since players don't.
+		query := ""
+		if token != "" {
+			query = url.Values{"token": {token}}.Encode()
+		}
+		data, err = m.Playlist(ctx, msn, index, query)
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+
+	case file == "init.mp4":
+		data, err = m.Init(ctx)
+		w.Header().Set("Content-Type", "video/mp4")
+
+	case strings.HasPrefix(file, "part") && strings.HasSuffix(file, ".mp4"):
+		var msn, index int
+		if msn, index, err = parsePartName(strings.TrimSuffix(strings.TrimPrefix(file, "part"), ".mp4")); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		data, err = m.Part(ctx, msn, index)
+		w.Header().Set("Content-Type", "video/mp4")
+
+	case strings.HasPrefix(file, "seg") && strings.HasSuffix(file, ".mp4"):
+		var msn int
+		if msn, err = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(file, "seg"), ".mp4")); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		data, err = m.Segment(ctx, msn)
+		w.Header().Set("Content-Type", "video/mp4")
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if _, err := w.Write(data); err != nil {
+		zap.L().Debug("failed to write hls response", zap.Error(err))
+	}
+}
+
+// parsePartName parses a part name of the form {msn}.{index}.
+func parsePartName(name string) (int, int, error) {
+	fields := strings.SplitN(name, ".", 2)
+	msn, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(fields) != 2 {
+		return 0, 0, strconv.ErrSyntax
+	}
+	index, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return msn, index, nil
+}
@@ -0,0 +1,62 @@
+package hls
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/muxable/cdn/internal/store"
+)
+
+func TestMuxerDoesNotBlockOtherStreams(t *testing.T) {
+	release := make(chan struct{})
+	subscribed := make(chan string, 2)
+	s := NewServer(func(ctx context.Context, streamID string) (chan *store.TrackLocal, error) {
+		subscribed <- streamID
+		if streamID == "slow" {
+			// a relay to another node.
+			<-release
+		}
+		return make(chan *store.TrackLocal), nil
+	}, nil)
+
+	slow := make(chan *Muxer)
+	for i := 0; i < 2; i++ {
+		go func() {
+			m, err := s.muxer("slow")
+			if err != nil {
+				t.Error(err)
+			}
+			slow <- m
+		}()
+	}
+	if id := <-subscribed; id != "slow" {
+		t.Fatalf("subscribed to %s, want slow", id)
+	}
+
+	started := make(chan struct{})
+	go func() {
+		if _, err := s.muxer("fast"); err != nil {
+			t.Error(err)
+		}
+		close(started)
+	}()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("starting a stream blocked on another stream's subscription")
+	}
+
+	close(release)
+	if a, b := <-slow, <-slow; a != b || a == nil {
+		t.Errorf("concurrent requests got muxers %p and %p, want the same one", a, b)
+	}
+	if id := <-subscribed; id != "fast" {
+		t.Errorf("subscribed to %s, want fast", id)
+	}
+	select {
+	case id := <-subscribed:
+		t.Errorf("subscribed to %s again", id)
+	default:
+	}
+}
@@ -0,0 +1,33 @@
+package media
+
+import (
+	"strings"
+
+	"github.com/muxable/cdn/internal/h264"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// IsKeyframe reports whether the RTP payload starts a keyframe for the given codec. Audio and
+// unknown codecs are always considered keyframes.
+func IsKeyframe(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return h264.IsKeyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		vp8 := &codecs.VP8Packet{}
+		if _, err := vp8.Unmarshal(payload); err != nil || len(vp8.Payload) == 0 {
+			return false
+		}
+		return vp8.S == 1 && vp8.PID == 0 && vp8.Payload[0]&0x01 == 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		vp9 := &codecs.VP9Packet{}
+		if _, err := vp9.Unmarshal(payload); err != nil {
+			return false
+		}
+		return vp9.B && !vp9.P
+	case strings.HasPrefix(strings.ToLower(mimeType), "video/"):
+		return false
+	}
+	return true
+}
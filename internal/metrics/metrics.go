@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	Publishers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cdn_publishers",
+		Help: "Active publishing sessions per stream.",
+	}, []string{"stream_id"})
+
+	Subscribers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cdn_subscribers",
+		Help: "Active subscribing sessions per stream.",
+	}, []string{"stream_id"})
+
+	Relays = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cdn_relays",
+		Help: "Active relays from other nodes per stream.",
+	}, []string{"stream_id"})
+
+	TrackPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_track_packets_total",
+		Help: "RTP packets received from the track's source or sent to subscribers.",
+	}, []string{"stream_id", "track_id", "rid", "direction"})
+
+	TrackBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_track_bytes_total",
+		Help: "RTP bytes received from the track's source or sent to subscribers.",
+	}, []string{"stream_id", "track_id", "rid", "direction"})
+
+	MulticasterWriteErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cdn_multicaster_write_errors_total",
+		Help: "Packets that failed to be forwarded to a multicaster's writer.",
+	})
+
+	MulticasterDrops = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cdn_multicaster_drops_total",
+		Help: "Packets dropped because an in-process reader fell behind.",
+	})
+
+	RelaySetupSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cdn_relay_setup_seconds",
+		Help:    "Time to look up the publisher of a stream and subscribe to it.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	DirectorySeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cdn_directory_operation_seconds",
+		Help:    "Latency of directory operations.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	DirectoryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_directory_errors_total",
+		Help: "Failed directory operations.",
+	}, []string{"operation"})
+
+	PeerConnectionStates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_peer_connection_state_transitions_total",
+		Help: "PeerConnection state transitions by role.",
+	}, []string{"role", "state"})
+)
+
+// Collectors returns every collector of the cdn.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		Publishers,
+		Subscribers,
+		Relays,
+		TrackPackets,
+		TrackBytes,
+		MulticasterWriteErrors,
+		MulticasterDrops,
+		RelaySetupSeconds,
+		DirectorySeconds,
+		DirectoryErrors,
+		PeerConnectionStates,
+	}
+}
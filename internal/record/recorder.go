@@ -0,0 +1,279 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muxable/cdn/internal/media"
+	"github.com/muxable/cdn/internal/store"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrUnsupportedCodec = errors.New("unsupported codec")
+	ErrInvalidStreamID  = errors.New("stream id can't be used as a directory name")
+)
+
+// Options configures file rotation. A zero value disables the corresponding limit.
+type Options struct {
+	MaxFileSize     int64
+	MaxFileDuration time.Duration
+}
+
+// File describes a single file written by a recording.
+type File struct {
+	Path      string
+	TrackID   string
+	MimeType  string
+	Size      int64
+	StartedAt time.Time
+	EndedAt   time.Time
+}
+
+// Recorder writes every track of a stream to disk until stopped, including tracks added
+// after the publisher renegotiates.
+type Recorder struct {
+	sync.Mutex
+
+	ID        string
+	StreamID  string
+	StartedAt time.Time
+	StoppedAt time.Time
+
+	dir     string
+	options Options
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	files   []*File
+	counts  map[string]int
+}
+
+// SubscribeFunc subscribes to the tracks of a stream until the context is cancelled.
+type SubscribeFunc func(ctx context.Context, streamID string) chan *store.TrackLocal
+
+// Start records the tracks of the stream into dir until Stop is called.
+func Start(id, dir, streamID string, subscribe SubscribeFunc, options Options) (*Recorder, error) {
+	// escaping leaves "." and "..", which would write outside dir.
+	name := url.PathEscape(streamID)
+	if name == "" || name == "." || name == ".." {
+		return nil, ErrInvalidStreamID
+	}
+	root := filepath.Clean(dir)
+	dir = filepath.Join(root, name, id)
+	if rel, err := filepath.Rel(root, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, ErrInvalidStreamID
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tracks := subscribe(ctx, streamID)
+	r := &Recorder{
+		ID:        id,
+		StreamID:  streamID,
+		StartedAt: time.Now(),
+		dir:       dir,
+		options:   options,
+		cancel:    cancel,
+		counts:    make(map[string]int),
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for tl := range tracks {
+			r.wg.Add(1)
+			go func(tl *store.TrackLocal) {
+				defer r.wg.Done()
+				if err := r.record(ctx, tl); err != nil {
+					zap.L().Warn("failed to record track", zap.String("streamId", streamID), zap.String("trackId", tl.ID()), zap.Error(err))
+				}
+			}(tl)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		r.wg.Wait()
+		r.Lock()
+		if r.StoppedAt.IsZero() {
+			r.StoppedAt = time.Now()
+		}
+		r.Unlock()
+	}()
+
+	return r, nil
+}
+
+// Stop ends the recording and waits for all files to be closed.
+func (r *Recorder) Stop() {
+	r.cancel()
+	r.wg.Wait()
+
+	r.Lock()
+	defer r.Unlock()
+	if r.StoppedAt.IsZero() {
+		r.StoppedAt = time.Now()
+	}
+}
+
+// Active reports whether the recording is still running.
+func (r *Recorder) Active() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.StoppedAt.IsZero()
+}
+
+// Files returns a snapshot of the files written so far.
+func (r *Recorder) Files() []File {
+	r.Lock()
+	defer r.Unlock()
+
+	files := make([]File, len(r.files))
+	for i, f := range r.files {
+		files[i] = *f
+	}
+	return files
+}
+
+type rtpWriter interface {
+	WriteRTP(*rtp.Packet) error
+	Close() error
+}
+
+// open creates the next file for the track.
+func (r *Recorder) open(tl *store.TrackLocal) (rtpWriter, *File, error) {
+	codec := tl.Codec()
+
+	var ext string
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		ext = "ivf"
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264):
+		ext = "h264"
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		ext = "ogg"
+	default:
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnsupportedCodec, codec.MimeType)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	name := url.PathEscape(tl.ID())
+	if tl.RID() != "" {
+		name += "-" + url.PathEscape(tl.RID())
+	}
+	index := r.counts[name]
+	r.counts[name]++
+	path := filepath.Join(r.dir, fmt.Sprintf("%s-%04d.%s", name, index, ext))
+
+	var w rtpWriter
+	var err error
+	switch ext {
+	case "ivf":
+		w, err = ivfwriter.New(path)
+	case "h264":
+		w, err = h264writer.New(path)
+	case "ogg":
+		channels := codec.Channels
+		if channels == 0 {
+			channels = 2
+		}
+		w, err = oggwriter.New(path, codec.ClockRate, channels)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f := &File{Path: path, TrackID: tl.ID(), MimeType: codec.MimeType, StartedAt: time.Now()}
+	r.files = append(r.files, f)
+	return w, f, nil
+}
+
+// close finalizes a file and records its size.
+func (r *Recorder) close(w rtpWriter, f *File) {
+	if err := w.Close(); err != nil {
+		zap.L().Warn("failed to close recording", zap.String("path", f.Path), zap.Error(err))
+	}
+	r.Lock()
+	defer r.Unlock()
+	f.EndedAt = time.Now()
+	if info, err := os.Stat(f.Path); err == nil {
+		f.Size = info.Size()
+	}
+}
+
+// due reports whether the file should be rotated.
+func (r *Recorder) due(f *File) bool {
+	if r.options.MaxFileDuration > 0 && time.Since(f.StartedAt) >= r.options.MaxFileDuration {
+		return true
+	}
+	if r.options.MaxFileSize > 0 {
+		if info, err := os.Stat(f.Path); err == nil && info.Size() >= r.options.MaxFileSize {
+			return true
+		}
+	}
+	return false
+}
+
+// record writes the track until it ends or the recording stops, rotating files as needed.
+func (r *Recorder) record(ctx context.Context, tl *store.TrackLocal) error {
+	w, f, err := r.open(tl)
+	if err != nil {
+		return err
+	}
+
+	reader := tl.NewReader()
+	defer reader.Close()
+
+	go func() {
+		<-ctx.Done()
+		reader.Close()
+	}()
+
+	// rotation is checked at most once a second to avoid stat calls on every packet.
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	rotate := false
+	for {
+		p, err := reader.ReadRTP()
+		if err != nil {
+			r.close(w, f)
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+			rotate = rotate || r.due(f)
+		default:
+		}
+
+		// video is only rotated on keyframes so each file is independently decodable.
+		if rotate && media.IsKeyframe(tl.Codec().MimeType, p.Payload) {
+			r.close(w, f)
+			if w, f, err = r.open(tl); err != nil {
+				return err
+			}
+			rotate = false
+		}
+
+		if err := w.WriteRTP(p); err != nil {
+			zap.L().Debug("failed to write packet", zap.String("path", f.Path), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package record
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/muxable/cdn/internal/store"
+)
+
+func subscribeNothing(ctx context.Context, streamID string) chan *store.TrackLocal {
+	ch := make(chan *store.TrackLocal)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch
+}
+
+func TestStartRejectsPathElements(t *testing.T) {
+	dir := t.TempDir()
+	for _, streamID := range []string{"", ".", ".."} {
+		if _, err := Start("id", filepath.Join(dir, "recordings"), streamID, subscribeNothing, Options{}); err != ErrInvalidStreamID {
+			t.Errorf("Start(%q) = %v, want %v", streamID, err, ErrInvalidStreamID)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("created %v", entries)
+	}
+}
+
+func TestStartEscapesStreamID(t *testing.T) {
+	dir := t.TempDir()
+	r, err := Start("id", dir, "../a/..", subscribeNothing, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	if _, err := os.Stat(filepath.Join(dir, "..%2Fa%2F..", "id")); err != nil {
+		t.Errorf("recording directory not under %s: %v", dir, err)
+	}
+}
@@ -0,0 +1,166 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0A
+)
+
+var errInvalidAMF = errors.New("invalid amf0 data")
+
+// amfObjectValue is an AMF0 object, encoded with sorted keys for determinism.
+type amfObjectValue map[string]interface{}
+
+// amfEncode serializes values as AMF0. Supported types are float64, int, bool, string, nil and
+// amfObjectValue.
+func amfEncode(values ...interface{}) []byte {
+	var buf []byte
+	for _, v := range values {
+		buf = amfEncodeValue(buf, v)
+	}
+	return buf
+}
+
+func amfEncodeValue(buf []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, amfNull)
+	case bool:
+		if v {
+			return append(buf, amfBoolean, 1)
+		}
+		return append(buf, amfBoolean, 0)
+	case int:
+		return amfEncodeValue(buf, float64(v))
+	case float64:
+		b := make([]byte, 9)
+		b[0] = amfNumber
+		binary.BigEndian.PutUint64(b[1:], math.Float64bits(v))
+		return append(buf, b...)
+	case string:
+		return amfEncodeString(append(buf, amfString), v)
+	case amfObjectValue:
+		buf = append(buf, amfObject)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf = amfEncodeString(buf, k)
+			buf = amfEncodeValue(buf, v[k])
+		}
+		return append(buf, 0, 0, amfObjectEnd)
+	}
+	panic(fmt.Sprintf("unsupported amf0 type %T", v))
+}
+
+func amfEncodeString(buf []byte, s string) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(append(buf, b...), s...)
+}
+
+// amfDecode parses all AMF0 values in buf.
+func amfDecode(buf []byte) ([]interface{}, error) {
+	var values []interface{}
+	for len(buf) > 0 {
+		v, n, err := amfDecodeValue(buf)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+		buf = buf[n:]
+	}
+	return values, nil
+}
+
+func amfDecodeValue(buf []byte) (interface{}, int, error) {
+	if len(buf) == 0 {
+		return nil, 0, errInvalidAMF
+	}
+	switch buf[0] {
+	case amfNumber:
+		if len(buf) < 9 {
+			return nil, 0, errInvalidAMF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(buf[1:])), 9, nil
+	case amfBoolean:
+		if len(buf) < 2 {
+			return nil, 0, errInvalidAMF
+		}
+		return buf[1] != 0, 2, nil
+	case amfString:
+		s, n, err := amfDecodeString(buf[1:])
+		return s, n + 1, err
+	case amfNull, amfUndefined:
+		return nil, 1, nil
+	case amfObject, amfECMAArray:
+		offset := 1
+		if buf[0] == amfECMAArray {
+			offset += 4
+		}
+		obj := amfObjectValue{}
+		for {
+			if len(buf) < offset+3 {
+				return nil, 0, errInvalidAMF
+			}
+			if buf[offset] == 0 && buf[offset+1] == 0 && buf[offset+2] == amfObjectEnd {
+				return obj, offset + 3, nil
+			}
+			k, n, err := amfDecodeString(buf[offset:])
+			if err != nil {
+				return nil, 0, err
+			}
+			offset += n
+			v, n, err := amfDecodeValue(buf[offset:])
+			if err != nil {
+				return nil, 0, err
+			}
+			offset += n
+			obj[k] = v
+		}
+	case amfStrictArray:
+		if len(buf) < 5 {
+			return nil, 0, errInvalidAMF
+		}
+		count := int(binary.BigEndian.Uint32(buf[1:]))
+		offset := 5
+		arr := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			v, n, err := amfDecodeValue(buf[offset:])
+			if err != nil {
+				return nil, 0, err
+			}
+			offset += n
+			arr = append(arr, v)
+		}
+		return arr, offset, nil
+	}
+	return nil, 0, fmt.Errorf("%w: unsupported type %d", errInvalidAMF, buf[0])
+}
+
+func amfDecodeString(buf []byte) (string, int, error) {
+	if len(buf) < 2 {
+		return "", 0, errInvalidAMF
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+n {
+		return "", 0, errInvalidAMF
+	}
+	return string(buf[2 : 2+n]), 2 + n, nil
+}
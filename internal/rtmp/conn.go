@@ -0,0 +1,518 @@
+package rtmp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/muxable/cdn/internal/h264"
+)
+
+const (
+	msgSetChunkSize    = 1
+	msgAbort           = 2
+	msgAcknowledgement = 3
+	msgUserControl     = 4
+	msgWindowAckSize   = 5
+	msgSetPeerBW       = 6
+	msgAudio           = 8
+	msgVideo           = 9
+	msgDataAMF0        = 18
+	msgCommandAMF0     = 20
+)
+
+const (
+	csidControl = 2
+	csidCommand = 3
+	csidData    = 4
+	csidVideo   = 6
+
+	writeChunkSize = 4096
+	handshakeSize  = 1536
+)
+
+var ErrPublishRejected = errors.New("publish rejected")
+
+type message struct {
+	typeID    uint8
+	streamID  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+type chunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typeID    uint8
+	streamID  uint32
+	extended  bool
+	payload   []byte
+}
+
+// countingWriter counts the bytes written to the underlying connection.
+type countingWriter struct {
+	io.Writer
+	n *uint64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	atomic.AddUint64(w.n, uint64(n))
+	return n, err
+}
+
+// Conn is a publishing RTMP client connection.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	writeMu  sync.Mutex
+	w        *bufio.Writer
+	streamID uint32
+
+	readChunkSize uint32
+	inbound       map[uint32]*chunkStream
+	transactionID int
+
+	bytesSent uint64
+	done      chan struct{}
+	err       error
+}
+
+// Dial connects to an rtmp://host[:port]/app/streamKey url and starts publishing. The connection is
+// made with dialer, if non-nil, for example to restrict the addresses it may reach.
+func Dial(ctx context.Context, rawURL string, dialer *net.Dialer) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtmp" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	path := strings.TrimPrefix(u.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	if slash <= 0 || slash == len(path)-1 {
+		return nil, fmt.Errorf("url must be of the form rtmp://host/app/key")
+	}
+	app, key := path[:slash], path[slash+1:]
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "1935")
+	}
+
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	nc, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		conn:          nc,
+		r:             bufio.NewReader(nc),
+		readChunkSize: 128,
+		inbound:       make(map[uint32]*chunkStream),
+		done:          make(chan struct{}),
+	}
+	c.w = bufio.NewWriter(countingWriter{Writer: nc, n: &c.bytesSent})
+
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			nc.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	if err := c.handshake(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if err := c.publish(fmt.Sprintf("rtmp://%s/%s", u.Host, app), app, key); err != nil {
+		nc.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+
+	go c.readLoop()
+
+	return c, nil
+}
+
+func (c *Conn) handshake() error {
+	c0c1 := make([]byte, 1+handshakeSize)
+	c0c1[0] = 3
+	if _, err := rand.Read(c0c1[9:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(c0c1); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	s0s1s2 := make([]byte, 1+2*handshakeSize)
+	if _, err := io.ReadFull(c.r, s0s1s2); err != nil {
+		return err
+	}
+	if s0s1s2[0] != 3 {
+		return fmt.Errorf("unsupported rtmp version %d", s0s1s2[0])
+	}
+	// c2 echoes s1.
+	if _, err := c.w.Write(s0s1s2[1 : 1+handshakeSize]); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// publish runs the connect, createStream and publish command sequence.
+func (c *Conn) publish(tcURL, app, key string) error {
+	chunkSize := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunkSize, writeChunkSize)
+	if err := c.writeMessage(csidControl, &message{typeID: msgSetChunkSize, payload: chunkSize}); err != nil {
+		return err
+	}
+
+	if _, err := c.call("connect", amfObjectValue{
+		"app":      app,
+		"type":     "nonprivate",
+		"flashVer": "FMLE/3.0 (compatible; muxable)",
+		"tcUrl":    tcURL,
+	}); err != nil {
+		return err
+	}
+
+	// releaseStream and FCPublish are not answered by every server so their responses are not awaited.
+	for _, name := range []string{"releaseStream", "FCPublish"} {
+		c.transactionID++
+		if err := c.writeMessage(csidCommand, &message{typeID: msgCommandAMF0, payload: amfEncode(name, c.transactionID, nil, key)}); err != nil {
+			return err
+		}
+	}
+
+	result, err := c.call("createStream", nil)
+	if err != nil {
+		return err
+	}
+	if len(result) < 4 {
+		return fmt.Errorf("invalid createStream response")
+	}
+	streamID, ok := result[3].(float64)
+	if !ok {
+		return fmt.Errorf("invalid createStream response")
+	}
+	c.streamID = uint32(streamID)
+
+	if err := c.writeMessage(csidCommand, &message{typeID: msgCommandAMF0, streamID: c.streamID, payload: amfEncode("publish", 0, nil, key, "live")}); err != nil {
+		return err
+	}
+	for {
+		values, err := c.readCommand()
+		if err != nil {
+			return err
+		}
+		if name, _ := values[0].(string); name != "onStatus" || len(values) < 4 {
+			continue
+		}
+		info, _ := values[3].(amfObjectValue)
+		code, _ := info["code"].(string)
+		if code == "NetStream.Publish.Start" {
+			return nil
+		}
+		if level, _ := info["level"].(string); level == "error" {
+			return fmt.Errorf("%w: %s", ErrPublishRejected, code)
+		}
+	}
+}
+
+// call sends a command and waits for its _result.
+func (c *Conn) call(name string, args ...interface{}) ([]interface{}, error) {
+	c.transactionID++
+	id := c.transactionID
+	if err := c.writeMessage(csidCommand, &message{typeID: msgCommandAMF0, payload: amfEncode(append([]interface{}{name, id}, args...)...)}); err != nil {
+		return nil, err
+	}
+	for {
+		values, err := c.readCommand()
+		if err != nil {
+			return nil, err
+		}
+		if len(values) < 2 {
+			continue
+		}
+		if tid, _ := values[1].(float64); int(tid) != id {
+			continue
+		}
+		switch values[0] {
+		case "_result":
+			return values, nil
+		case "_error":
+			return nil, fmt.Errorf("%s failed: %v", name, values[len(values)-1])
+		}
+	}
+}
+
+// readCommand returns the next AMF0 command sent by the server.
+func (c *Conn) readCommand() ([]interface{}, error) {
+	for {
+		m, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if m.typeID != msgCommandAMF0 {
+			continue
+		}
+		values, err := amfDecode(m.payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) > 0 {
+			return values, nil
+		}
+	}
+}
+
+// readMessage reassembles the next complete message from the chunk stream.
+func (c *Conn) readMessage() (*message, error) {
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		format := b >> 6
+		csid := uint32(b & 0x3F)
+		switch csid {
+		case 0:
+			b1, err := c.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(b1)
+		case 1:
+			var b2 [2]byte
+			if _, err := io.ReadFull(c.r, b2[:]); err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(b2[0]) + uint32(b2[1])<<8
+		}
+
+		cs, ok := c.inbound[csid]
+		if !ok {
+			cs = &chunkStream{}
+			c.inbound[csid] = cs
+		}
+
+		var header [11]byte
+		size := [4]int{11, 7, 3, 0}[format]
+		if _, err := io.ReadFull(c.r, header[:size]); err != nil {
+			return nil, err
+		}
+		if format < 3 {
+			ts := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+			cs.extended = ts == 0xFFFFFF
+			if cs.extended {
+				var ext [4]byte
+				if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+					return nil, err
+				}
+				ts = binary.BigEndian.Uint32(ext[:])
+			}
+			if format == 0 {
+				cs.timestamp, cs.delta = ts, 0
+			} else {
+				cs.delta = ts
+				cs.timestamp += ts
+			}
+			if format < 2 {
+				cs.length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+				cs.typeID = header[6]
+			}
+			if format == 0 {
+				cs.streamID = binary.LittleEndian.Uint32(header[7:11])
+			}
+		} else {
+			if cs.extended {
+				var ext [4]byte
+				if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+					return nil, err
+				}
+			}
+			if len(cs.payload) == 0 {
+				// a new message on the chunk stream reuses the previous delta.
+				cs.timestamp += cs.delta
+			}
+		}
+
+		n := cs.length - uint32(len(cs.payload))
+		if n > c.readChunkSize {
+			n = c.readChunkSize
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(c.r, chunk); err != nil {
+			return nil, err
+		}
+		cs.payload = append(cs.payload, chunk...)
+		if uint32(len(cs.payload)) < cs.length {
+			continue
+		}
+
+		m := &message{typeID: cs.typeID, streamID: cs.streamID, timestamp: cs.timestamp, payload: cs.payload}
+		cs.payload = nil
+		if m.typeID == msgSetChunkSize && len(m.payload) >= 4 {
+			c.readChunkSize = binary.BigEndian.Uint32(m.payload) & 0x7FFFFFFF
+		}
+		return m, nil
+	}
+}
+
+// readLoop drains server messages after publishing so the connection is not blocked and closure is
+// detected.
+func (c *Conn) readLoop() {
+	var err error
+	for {
+		var m *message
+		if m, err = c.readMessage(); err != nil {
+			break
+		}
+		if m.typeID != msgCommandAMF0 {
+			continue
+		}
+		values, derr := amfDecode(m.payload)
+		if derr != nil || len(values) < 4 {
+			continue
+		}
+		if name, _ := values[0].(string); name != "onStatus" {
+			continue
+		}
+		info, _ := values[3].(amfObjectValue)
+		if level, _ := info["level"].(string); level == "error" {
+			code, _ := info["code"].(string)
+			err = fmt.Errorf("%w: %s", ErrPublishRejected, code)
+			break
+		}
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+// writeMessage splits a message into chunks.
+func (c *Conn) writeMessage(csid byte, m *message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	ts := m.timestamp
+	extended := ts >= 0xFFFFFF
+	if extended {
+		ts = 0xFFFFFF
+	}
+	header := make([]byte, 12, 16)
+	header[0] = csid
+	header[1], header[2], header[3] = byte(ts>>16), byte(ts>>8), byte(ts)
+	length := len(m.payload)
+	header[4], header[5], header[6] = byte(length>>16), byte(length>>8), byte(length)
+	header[7] = m.typeID
+	binary.LittleEndian.PutUint32(header[8:], m.streamID)
+	var ext []byte
+	if extended {
+		ext = make([]byte, 4)
+		binary.BigEndian.PutUint32(ext, m.timestamp)
+		header = append(header, ext...)
+	}
+	if _, err := c.w.Write(header); err != nil {
+		return err
+	}
+
+	payload := m.payload
+	for first := true; first || len(payload) > 0; first = false {
+		if !first {
+			// continuation chunks use a type 3 header.
+			if err := c.w.WriteByte(0xC0 | csid); err != nil {
+				return err
+			}
+			if _, err := c.w.Write(ext); err != nil {
+				return err
+			}
+		}
+		n := len(payload)
+		if n > writeChunkSize {
+			n = writeChunkSize
+		}
+		if _, err := c.w.Write(payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	return c.w.Flush()
+}
+
+// WriteMetadata sends the onMetaData for an H.264 stream.
+func (c *Conn) WriteMetadata(width, height int) error {
+	return c.writeMessage(csidData, &message{typeID: msgDataAMF0, streamID: c.streamID, payload: amfEncode("@setDataFrame", "onMetaData", amfObjectValue{
+		"videocodecid": 7,
+		"width":        width,
+		"height":       height,
+	})})
+}
+
+// WriteSequenceHeader sends the AVC decoder configuration, which must precede the first access unit
+// and be resent when the parameter sets change.
+func (c *Conn) WriteSequenceHeader(timestamp uint32, sps, pps []byte) error {
+	payload := append([]byte{0x17, 0, 0, 0, 0}, h264.DecoderConfig(sps, pps)...)
+	return c.writeMessage(csidVideo, &message{typeID: msgVideo, streamID: c.streamID, timestamp: timestamp, payload: payload})
+}
+
+// WriteAccessUnit sends an H.264 access unit with a millisecond timestamp.
+func (c *Conn) WriteAccessUnit(timestamp uint32, au *h264.AccessUnit) error {
+	frameType := byte(0x27)
+	if au.Keyframe {
+		frameType = 0x17
+	}
+	// composition time is zero since WebRTC streams do not carry B-frames.
+	payload := append([]byte{frameType, 1, 0, 0, 0}, au.AVCC()...)
+	return c.writeMessage(csidVideo, &message{typeID: msgVideo, streamID: c.streamID, timestamp: timestamp, payload: payload})
+}
+
+// BytesSent returns the number of bytes written to the connection.
+func (c *Conn) BytesSent() uint64 {
+	return atomic.LoadUint64(&c.bytesSent)
+}
+
+// Done is closed when the server closes the connection or rejects the stream.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the connection ended once Done is closed.
+func (c *Conn) Err() error {
+	return c.err
+}
+
+// Close sends deleteStream and closes the connection.
+func (c *Conn) Close() error {
+	c.writeMessage(csidCommand, &message{typeID: msgCommandAMF0, payload: amfEncode("deleteStream", 0, nil, int(c.streamID))})
+	return c.conn.Close()
+}
@@ -0,0 +1,188 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/muxable/cdn/internal/h264"
+)
+
+// serveOne accepts a single publisher on l, answering its commands as a minimal ingest server,
+// and sends every message it publishes to messages.
+func serveOne(t *testing.T, l net.Listener, commands chan<- []interface{}, messages chan<- *message) {
+	nc, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer nc.Close()
+	defer close(messages)
+
+	// the server side speaks the same chunk stream so reuse the connection's framing.
+	s := &Conn{
+		conn:          nc,
+		r:             bufio.NewReader(nc),
+		readChunkSize: 128,
+		inbound:       make(map[uint32]*chunkStream),
+	}
+	s.w = bufio.NewWriter(nc)
+
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(s.r, c0c1); err != nil {
+		t.Errorf("failed to read c0c1: %v", err)
+		return
+	}
+	s0s1s2 := append(append([]byte{3}, make([]byte, handshakeSize)...), c0c1[1:]...)
+	if _, err := nc.Write(s0s1s2); err != nil {
+		t.Errorf("failed to write s0s1s2: %v", err)
+		return
+	}
+	if _, err := io.ReadFull(s.r, make([]byte, handshakeSize)); err != nil {
+		t.Errorf("failed to read c2: %v", err)
+		return
+	}
+
+	chunkSize := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunkSize, writeChunkSize)
+	if err := s.writeMessage(csidControl, &message{typeID: msgSetChunkSize, payload: chunkSize}); err != nil {
+		t.Errorf("failed to write chunk size: %v", err)
+		return
+	}
+
+	for {
+		m, err := s.readMessage()
+		if err != nil {
+			return
+		}
+		switch m.typeID {
+		case msgDataAMF0, msgAudio, msgVideo:
+			messages <- m
+			continue
+		case msgCommandAMF0:
+		default:
+			continue
+		}
+		values, err := amfDecode(m.payload)
+		if err != nil || len(values) < 2 {
+			t.Errorf("invalid command: %v", err)
+			return
+		}
+		commands <- values
+		var reply []interface{}
+		switch values[0] {
+		case "connect":
+			reply = []interface{}{"_result", values[1], nil, amfObjectValue{"code": "NetConnection.Connect.Success"}}
+		case "createStream":
+			reply = []interface{}{"_result", values[1], nil, 1}
+		case "publish":
+			reply = []interface{}{"onStatus", 0, nil, amfObjectValue{"level": "status", "code": "NetStream.Publish.Start"}}
+		default:
+			continue
+		}
+		if err := s.writeMessage(csidCommand, &message{typeID: msgCommandAMF0, streamID: m.streamID, payload: amfEncode(reply...)}); err != nil {
+			t.Errorf("failed to write reply: %v", err)
+			return
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	commands := make(chan []interface{}, 16)
+	messages := make(chan *message, 16)
+	go serveOne(t, l, commands, messages)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := Dial(ctx, "rtmp://"+l.Addr().String()+"/live/key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var names []string
+	for len(commands) > 0 {
+		values := <-commands
+		names = append(names, values[0].(string))
+		switch values[0] {
+		case "connect":
+			if app := values[2].(amfObjectValue)["app"]; app != "live" {
+				t.Errorf("connect app = %v, want live", app)
+			}
+		case "publish":
+			if key := values[3]; key != "key" {
+				t.Errorf("publish key = %v, want key", key)
+			}
+		}
+	}
+	if want := []string{"connect", "releaseStream", "FCPublish", "createStream", "publish"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("commands = %v, want %v", names, want)
+	}
+
+	sps := []byte{0x67, 0x42, 0xC0, 0x1E, 0xD9, 0x00}
+	pps := []byte{0x68, 0xCE, 0x3C, 0x80}
+	idr := []byte{0x65, 0x88, 0x84, 0x00}
+	if err := conn.WriteMetadata(640, 360); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteSequenceHeader(0, sps, pps); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteAccessUnit(33, &h264.AccessUnit{NALUs: [][]byte{sps, pps, idr}, Keyframe: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := receive(t, messages)
+	if metadata.typeID != msgDataAMF0 {
+		t.Fatalf("got message type %d, want metadata", metadata.typeID)
+	}
+	if values, err := amfDecode(metadata.payload); err != nil || len(values) < 3 || values[1] != "onMetaData" {
+		t.Errorf("metadata = %v, %v", values, err)
+	}
+
+	header := receive(t, messages)
+	if header.typeID != msgVideo || header.streamID != 1 {
+		t.Fatalf("got message type %d on stream %d, want video on stream 1", header.typeID, header.streamID)
+	}
+	if !bytes.Equal(header.payload[:5], []byte{0x17, 0, 0, 0, 0}) {
+		t.Errorf("sequence header tag = %x, want an avc keyframe sequence header", header.payload[:5])
+	}
+	if !bytes.Equal(header.payload[5:], h264.DecoderConfig(sps, pps)) {
+		t.Errorf("decoder config = %x, want %x", header.payload[5:], h264.DecoderConfig(sps, pps))
+	}
+
+	frame := receive(t, messages)
+	if frame.typeID != msgVideo || frame.timestamp != 33 {
+		t.Fatalf("got message type %d at %d, want video at 33", frame.typeID, frame.timestamp)
+	}
+	if !bytes.Equal(frame.payload[:5], []byte{0x17, 1, 0, 0, 0}) {
+		t.Errorf("frame tag = %x, want an avc keyframe nalu", frame.payload[:5])
+	}
+	if want := append([]byte{0, 0, 0, byte(len(idr))}, idr...); !bytes.Equal(frame.payload[5:], want) {
+		t.Errorf("frame = %x, want %x", frame.payload[5:], want)
+	}
+}
+
+func receive(t *testing.T, messages <-chan *message) *message {
+	select {
+	case m, ok := <-messages:
+		if !ok {
+			t.Fatal("server closed the connection")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return nil
+}
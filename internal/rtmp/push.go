@@ -0,0 +1,265 @@
+package rtmp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muxable/cdn/internal/h264"
+	"github.com/muxable/cdn/internal/store"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+var ErrNoVideoTrack = errors.New("stream has no h264 track")
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+
+	// trackTimeout bounds how long an attempt waits for an H.264 track to appear.
+	trackTimeout = 10 * time.Second
+)
+
+// State is the state of a push.
+type State int
+
+const (
+	StateConnecting State = iota
+	StateLive
+	StateRetrying
+	StateStopped
+)
+
+// SubscribeFunc subscribes to the tracks of a stream until the context is cancelled.
+type SubscribeFunc func(ctx context.Context, streamID string) (chan *store.TrackLocal, error)
+
+// Status is a snapshot of a push.
+type Status struct {
+	State       State
+	LastError   string
+	Attempts    int
+	BytesSent   uint64
+	ConnectedAt time.Time
+}
+
+// Pusher remuxes the H.264 track of a stream to FLV and publishes it to an RTMP server,
+// reconnecting with exponential backoff until stopped.
+type Pusher struct {
+	sync.Mutex
+
+	ID        string
+	StreamID  string
+	URL       string
+	StartedAt time.Time
+	StoppedAt time.Time
+
+	status Status
+	dialer *net.Dialer
+	// sent accumulates the bytes of previous connections.
+	sent   uint64
+	conn   *Conn
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartPush pushes the stream to url until Stop is called. Connections are made with dialer, if
+// non-nil.
+func StartPush(id, streamID, url string, dialer *net.Dialer, subscribe SubscribeFunc) *Pusher {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pusher{
+		ID:        id,
+		StreamID:  streamID,
+		URL:       url,
+		StartedAt: time.Now(),
+		dialer:    dialer,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	go p.run(ctx, subscribe)
+	return p
+}
+
+func (p *Pusher) run(ctx context.Context, subscribe SubscribeFunc) {
+	defer close(p.done)
+
+	backoff := minBackoff
+	for {
+		p.Lock()
+		p.status.State = StateConnecting
+		p.status.Attempts++
+		p.Unlock()
+
+		live, err := p.attempt(ctx, subscribe)
+		if ctx.Err() != nil {
+			break
+		}
+		if live {
+			// the connection was established so the next failure starts a fresh backoff.
+			backoff = minBackoff
+		}
+		zap.L().Warn("rtmp push failed", zap.String("streamId", p.StreamID), zap.String("pushId", p.ID), zap.Error(err), zap.Duration("backoff", backoff))
+
+		p.Lock()
+		p.status.State = StateRetrying
+		p.status.LastError = err.Error()
+		p.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	p.Lock()
+	p.status.State = StateStopped
+	if p.StoppedAt.IsZero() {
+		p.StoppedAt = time.Now()
+	}
+	p.Unlock()
+}
+
+// attempt runs a single connection until it fails. live reports whether media was sent.
+func (p *Pusher) attempt(ctx context.Context, subscribe SubscribeFunc) (live bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tracks, err := subscribe(ctx, p.StreamID)
+	if err != nil {
+		return false, err
+	}
+
+	var track *store.TrackLocal
+	timeout := time.After(trackTimeout)
+	for track == nil {
+		select {
+		case tl, ok := <-tracks:
+			if !ok {
+				return false, ctx.Err()
+			}
+			if strings.EqualFold(tl.Codec().MimeType, webrtc.MimeTypeH264) {
+				track = tl
+			}
+		case <-timeout:
+			return false, ErrNoVideoTrack
+		}
+	}
+	go func() {
+		// drain the remaining tracks so the subscription isn't blocked.
+		for range tracks {
+		}
+	}()
+
+	reader := track.NewReader()
+	defer reader.Close()
+	go func() {
+		<-ctx.Done()
+		reader.Close()
+	}()
+
+	conn, err := Dial(ctx, p.URL, p.dialer)
+	if err != nil {
+		return false, err
+	}
+	p.Lock()
+	p.conn = conn
+	p.Unlock()
+	defer func() {
+		conn.Close()
+		p.Lock()
+		p.sent += conn.BytesSent()
+		p.conn = nil
+		p.Unlock()
+	}()
+	go func() {
+		select {
+		case <-conn.Done():
+			reader.Close()
+		case <-ctx.Done():
+		}
+	}()
+
+	depacketizer := h264.NewDepacketizer()
+	var sps, pps []byte
+	var base uint32
+	started := false
+	for {
+		pkt, err := reader.ReadRTP()
+		if err != nil {
+			if cerr := conn.Err(); cerr != nil {
+				return live, cerr
+			}
+			select {
+			case <-conn.Done():
+				return live, errors.New("connection closed by server")
+			default:
+			}
+			return live, errors.New("track ended")
+		}
+		au := depacketizer.Push(pkt)
+		if au == nil {
+			continue
+		}
+		if !started {
+			// the first tag must be a keyframe preceded by the decoder configuration.
+			if !au.Keyframe || depacketizer.SPS == nil || depacketizer.PPS == nil {
+				continue
+			}
+			base, started = au.Timestamp, true
+		}
+		timestamp := (au.Timestamp - base) / 90
+
+		if au.Keyframe && (string(sps) != string(depacketizer.SPS) || string(pps) != string(depacketizer.PPS)) {
+			sps, pps = depacketizer.SPS, depacketizer.PPS
+			if info, err := h264.ParseSPS(sps); err == nil {
+				if err := conn.WriteMetadata(info.Width, info.Height); err != nil {
+					return live, err
+				}
+			}
+			if err := conn.WriteSequenceHeader(timestamp, sps, pps); err != nil {
+				return live, err
+			}
+		}
+		if err := conn.WriteAccessUnit(timestamp, au); err != nil {
+			return live, err
+		}
+
+		if !live {
+			live = true
+			p.Lock()
+			p.status.State = StateLive
+			p.status.ConnectedAt = time.Now()
+			p.status.LastError = ""
+			p.Unlock()
+			zap.L().Info("rtmp push live", zap.String("streamId", p.StreamID), zap.String("pushId", p.ID))
+		}
+	}
+}
+
+// Stop ends the push and waits for the connection to close.
+func (p *Pusher) Stop() {
+	p.cancel()
+	<-p.done
+}
+
+// Status returns a snapshot of the push status.
+func (p *Pusher) Status() Status {
+	p.Lock()
+	defer p.Unlock()
+
+	status := p.status
+	status.BytesSent = p.sent
+	if p.conn != nil {
+		status.BytesSent += p.conn.BytesSent()
+	}
+	return status
+}
@@ -0,0 +1,466 @@
+package rtsp
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+var ErrUnsupportedTransport = errors.New("unsupported transport")
+
+// Client is a minimal RTSP client that pulls media over TCP interleaved transport.
+type Client struct {
+	sync.Mutex
+
+	conn    net.Conn
+	reader  *bufio.Reader
+	url     *url.URL
+	cseq    int
+	session string
+	auth    string
+
+	Tracks []*Track
+
+	done chan struct{}
+	err  error
+}
+
+// Track is a single media stream negotiated in an RTSP session.
+type Track struct {
+	id      string
+	kind    webrtc.RTPCodecType
+	codec   webrtc.RTPCodecParameters
+	control string
+	packets chan *rtp.Packet
+	done    chan struct{}
+}
+
+// ID returns the track id, derived from the media control attribute.
+func (t *Track) ID() string {
+	return t.id
+}
+
+// Kind returns the media kind of the track.
+func (t *Track) Kind() webrtc.RTPCodecType {
+	return t.kind
+}
+
+// Codec returns the codec advertised for the track in the session description.
+func (t *Track) Codec() webrtc.RTPCodecParameters {
+	return t.codec
+}
+
+// ReadRTP reads the next RTP packet received for the track.
+func (t *Track) ReadRTP() (*rtp.Packet, error) {
+	select {
+	case p := <-t.packets:
+		return p, nil
+	case <-t.done:
+		return nil, io.EOF
+	}
+}
+
+type response struct {
+	status int
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// Dial connects to the RTSP server at rawURL, describes the session and sets up every track. The
+// connection is made with dialer, if non-nil, for example to restrict the addresses it may reach.
+func Dial(ctx context.Context, rawURL string, dialer *net.Dialer) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtsp" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "554")
+	}
+
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		url:    u,
+		done:   make(chan struct{}),
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := c.setup(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return c, nil
+}
+
+func (c *Client) setup() error {
+	res, err := c.do("DESCRIBE", c.baseURL(), map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return err
+	}
+
+	base := c.baseURL()
+	if cb := res.header.Get("Content-Base"); cb != "" {
+		base = cb
+	}
+
+	desc := &sdp.SessionDescription{}
+	if err := desc.Unmarshal(res.body); err != nil {
+		return err
+	}
+
+	for i, media := range desc.MediaDescriptions {
+		track, err := newTrack(i, media)
+		if err != nil {
+			zap.L().Warn("skipping rtsp media", zap.String("media", media.MediaName.Media), zap.Error(err))
+			continue
+		}
+
+		res, err := c.do("SETUP", resolveControl(base, track.control), map[string]string{
+			"Transport": fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", 2*len(c.Tracks), 2*len(c.Tracks)+1),
+		})
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(res.header.Get("Transport"), "interleaved") {
+			return ErrUnsupportedTransport
+		}
+		if session := res.header.Get("Session"); session != "" {
+			c.session = strings.SplitN(session, ";", 2)[0]
+		}
+
+		c.Tracks = append(c.Tracks, track)
+	}
+
+	if len(c.Tracks) == 0 {
+		return errors.New("no supported tracks")
+	}
+	return nil
+}
+
+// Play starts the session. Packets are delivered to the tracks until the session ends.
+func (c *Client) Play() error {
+	if _, err := c.do("PLAY", c.baseURL(), nil); err != nil {
+		return err
+	}
+
+	go c.keepalive()
+	go func() {
+		err := c.readLoop()
+		c.Lock()
+		if c.err == nil {
+			c.err = err
+		}
+		c.Unlock()
+		close(c.done)
+		for _, track := range c.Tracks {
+			close(track.done)
+		}
+	}()
+	return nil
+}
+
+// Wait blocks until the session ends and returns the error that ended it.
+func (c *Client) Wait() error {
+	<-c.done
+	c.Lock()
+	defer c.Unlock()
+	return c.err
+}
+
+// Close tears down the session.
+func (c *Client) Close() error {
+	c.Lock()
+	if c.err == nil {
+		c.err = io.EOF
+	}
+	c.Unlock()
+	c.send("TEARDOWN", c.baseURL(), nil)
+	return c.conn.Close()
+}
+
+func (c *Client) keepalive() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.send("GET_PARAMETER", c.baseURL(), nil); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Client) readLoop() error {
+	header := make([]byte, 4)
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return err
+		}
+		if b[0] != '$' {
+			// an out-of-band response, eg to a keepalive.
+			if _, err := c.readResponse(); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return err
+		}
+		channel := int(header[1])
+		buf := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return err
+		}
+		if channel%2 == 1 || channel/2 >= len(c.Tracks) {
+			// rtcp or unknown channel.
+			continue
+		}
+		p := &rtp.Packet{}
+		if err := p.Unmarshal(buf); err != nil {
+			continue
+		}
+		select {
+		case c.Tracks[channel/2].packets <- p:
+		default:
+			// drop the packet if the reader falls behind.
+		}
+	}
+}
+
+func (c *Client) baseURL() string {
+	u := *c.url
+	u.User = nil
+	return u.String()
+}
+
+func (c *Client) send(method, uri string, headers map[string]string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\n", method, uri)
+	fmt.Fprintf(&b, "CSeq: %d\r\n", c.cseq)
+	b.WriteString("User-Agent: muxable-cdn\r\n")
+	if c.session != "" {
+		fmt.Fprintf(&b, "Session: %s\r\n", c.session)
+	}
+	if c.auth != "" {
+		fmt.Fprintf(&b, "Authorization: %s\r\n", c.authorization(method, uri))
+	}
+	for k, v := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	b.WriteString("\r\n")
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+func (c *Client) do(method, uri string, headers map[string]string) (*response, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if err := c.send(method, uri, headers); err != nil {
+			return nil, err
+		}
+		res, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if res.status == 401 && attempt == 0 && c.url.User != nil {
+			c.auth = res.header.Get("WWW-Authenticate")
+			continue
+		}
+		if res.status != 200 {
+			return nil, fmt.Errorf("%s returned status %d", method, res.status)
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("%s unauthorized", method)
+}
+
+func (c *Client) readResponse() (*response, error) {
+	tp := textproto.NewReader(c.reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "RTSP/") {
+		return nil, fmt.Errorf("malformed status line %q", line)
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	res := &response{status: status, header: header}
+	if cl := header.Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil {
+			return nil, err
+		}
+		res.body = make([]byte, n)
+		if _, err := io.ReadFull(c.reader, res.body); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// authorization computes the Authorization header from the last challenge.
+func (c *Client) authorization(method, uri string) string {
+	username := c.url.User.Username()
+	password, _ := c.url.User.Password()
+
+	if !strings.HasPrefix(c.auth, "Digest") {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+
+	params := map[string]string{}
+	for _, kv := range strings.Split(strings.TrimPrefix(c.auth, "Digest"), ",") {
+		if k, v, ok := cut(strings.TrimSpace(kv), "="); ok {
+			params[k] = strings.Trim(v, `"`)
+		}
+	}
+	ha1 := md5hex(username + ":" + params["realm"] + ":" + password)
+	ha2 := md5hex(method + ":" + uri)
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		username, params["realm"], params["nonce"], uri, md5hex(ha1+":"+params["nonce"]+":"+ha2))
+}
+
+func newTrack(index int, media *sdp.MediaDescription) (*Track, error) {
+	var kind webrtc.RTPCodecType
+	switch media.MediaName.Media {
+	case "video":
+		kind = webrtc.RTPCodecTypeVideo
+	case "audio":
+		kind = webrtc.RTPCodecTypeAudio
+	default:
+		return nil, fmt.Errorf("unsupported media %q", media.MediaName.Media)
+	}
+	if len(media.MediaName.Formats) == 0 {
+		return nil, errors.New("no formats")
+	}
+	format := media.MediaName.Formats[0]
+	pt, err := strconv.Atoi(format)
+	if err != nil {
+		return nil, err
+	}
+
+	codec := webrtc.RTPCodecParameters{PayloadType: webrtc.PayloadType(pt)}
+	// static payload types don't require an rtpmap.
+	switch pt {
+	case 0:
+		codec.RTPCodecCapability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}
+	case 8:
+		codec.RTPCodecCapability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}
+	}
+
+	track := &Track{
+		id:      fmt.Sprintf("%s%d", media.MediaName.Media, index),
+		kind:    kind,
+		packets: make(chan *rtp.Packet, 256),
+		done:    make(chan struct{}),
+	}
+
+	for _, attr := range media.Attributes {
+		switch attr.Key {
+		case "rtpmap":
+			if p, v, ok := cut(attr.Value, " "); ok && p == format {
+				fields := strings.Split(v, "/")
+				codec.MimeType = media.MediaName.Media + "/" + fields[0]
+				if len(fields) > 1 {
+					rate, err := strconv.Atoi(fields[1])
+					if err != nil {
+						return nil, err
+					}
+					codec.ClockRate = uint32(rate)
+				}
+				if len(fields) > 2 {
+					channels, err := strconv.Atoi(fields[2])
+					if err != nil {
+						return nil, err
+					}
+					codec.Channels = uint16(channels)
+				}
+			}
+		case "fmtp":
+			if p, v, ok := cut(attr.Value, " "); ok && p == format {
+				codec.SDPFmtpLine = v
+			}
+		case "control":
+			track.control = attr.Value
+		}
+	}
+	if codec.MimeType == "" {
+		return nil, fmt.Errorf("unknown payload type %d", pt)
+	}
+	track.codec = codec
+	return track, nil
+}
+
+// resolveControl resolves a media control attribute against the session base url.
+func resolveControl(base, control string) string {
+	if control == "" || control == "*" {
+		return base
+	}
+	if strings.HasPrefix(control, "rtsp://") {
+		return control
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + control
+}
+
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+func md5hex(s string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
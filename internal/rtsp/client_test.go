@@ -0,0 +1,62 @@
+package rtsp_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/muxable/cdn/internal/rtsp"
+	"github.com/muxable/cdn/internal/rtsp/rtsptest"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestClient(t *testing.T) {
+	server, err := rtsptest.NewServer("../../test/input.ivf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := rtsp.Dial(ctx, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if len(client.Tracks) != 1 {
+		t.Fatalf("got %d tracks, want 1", len(client.Tracks))
+	}
+	track := client.Tracks[0]
+	if track.Kind() != webrtc.RTPCodecTypeVideo || track.Codec().MimeType != "video/VP8" || track.Codec().ClockRate != 90000 {
+		t.Fatalf("got %s track with codec %+v", track.Kind(), track.Codec())
+	}
+
+	if err := client.Play(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range server.Packets[:32] {
+		p, err := track.ReadRTP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.SequenceNumber != want.SequenceNumber || p.Timestamp != want.Timestamp || string(p.Payload) != string(want.Payload) {
+			t.Fatalf("packet %d: got seq %d ts %d, want seq %d ts %d", i, p.SequenceNumber, p.Timestamp, want.SequenceNumber, want.Timestamp)
+		}
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Wait(); err == nil {
+		t.Fatal("expected the session to end with an error")
+	}
+	// packets may still be buffered, but the track must end.
+	for {
+		if _, err := track.ReadRTP(); err != nil {
+			break
+		}
+	}
+}
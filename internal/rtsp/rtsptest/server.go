@@ -0,0 +1,208 @@
+// Package rtsptest provides an RTSP server for tests.
+package rtsptest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+// Server plays the VP8 frames of an IVF file over TCP interleaved transport, in a loop, to every
+// client that sends PLAY.
+type Server struct {
+	// URL is the rtsp url of the stream.
+	URL string
+	// Packets are the packets sent in order on every loop.
+	Packets []*rtp.Packet
+
+	listener net.Listener
+	wg       sync.WaitGroup
+	done     chan struct{}
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+// NewServer listens on loopback and serves the IVF file at path.
+func NewServer(path string) (*Server, error) {
+	packets, err := packetize(path)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		URL:      fmt.Sprintf("rtsp://%s/stream", listener.Addr()),
+		Packets:  packets,
+		listener: listener,
+		done:     make(chan struct{}),
+		conns:    make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Close stops the server and closes every connection.
+func (s *Server) Close() error {
+	close(s.done)
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serve(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// serve answers requests until the connection closes, streaming once the client plays.
+func (s *Server) serve(conn net.Conn) {
+	var writeMutex sync.Mutex
+	write := func(b []byte) error {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		_, err := conn.Write(b)
+		return err
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	playing := make(chan struct{})
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			return
+		}
+		if line == "" {
+			continue
+		}
+		header, err := reader.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		method := strings.SplitN(line, " ", 2)[0]
+
+		var extra, body string
+		switch method {
+		case "DESCRIBE":
+			body = "v=0\r\n" +
+				"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+				"s=rtsptest\r\n" +
+				"t=0 0\r\n" +
+				"m=video 0 RTP/AVP 96\r\n" +
+				"a=rtpmap:96 VP8/90000\r\n" +
+				"a=control:track0\r\n"
+			extra = "Content-Type: application/sdp\r\n"
+		case "SETUP":
+			extra = "Transport: RTP/AVP/TCP;unicast;interleaved=0-1\r\nSession: 1\r\n"
+		case "TEARDOWN":
+			return
+		}
+		response := fmt.Sprintf("RTSP/1.0 200 OK\r\nCSeq: %s\r\n%sContent-Length: %d\r\n\r\n%s", header.Get("CSeq"), extra, len(body), body)
+		if err := write([]byte(response)); err != nil {
+			return
+		}
+
+		if method == "PLAY" {
+			select {
+			case <-playing:
+			default:
+				close(playing)
+				go s.stream(write)
+			}
+		}
+	}
+}
+
+// stream writes the packets on channel 0, one frame interval apart, until a write fails or the
+// server closes.
+func (s *Server) stream(write func([]byte) error) {
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		for _, p := range s.Packets {
+			buf, err := p.Marshal()
+			if err != nil {
+				return
+			}
+			frame := make([]byte, 4, 4+len(buf))
+			frame[0] = '$'
+			binary.BigEndian.PutUint16(frame[2:], uint16(len(buf)))
+			if err := write(append(frame, buf...)); err != nil {
+				return
+			}
+			if p.Marker {
+				select {
+				case <-ticker.C:
+				case <-s.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// packetize reads the VP8 frames of the IVF file at path into RTP packets.
+func packetize(path string) ([]*rtp.Packet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader, header, err := ivfreader.NewWith(f)
+	if err != nil {
+		return nil, err
+	}
+	if header.FourCC != "VP80" {
+		return nil, fmt.Errorf("unsupported codec %s", header.FourCC)
+	}
+	packetizer := rtp.NewPacketizer(1200, 96, 0x1234, &codecs.VP8Payloader{}, rtp.NewFixedSequencer(1), 90000)
+
+	var packets []*rtp.Packet
+	for {
+		frame, _, err := reader.ParseNextFrame()
+		if err == io.EOF {
+			return packets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, packetizer.Packetize(frame, 3000)...)
+	}
+}
@@ -0,0 +1,259 @@
+package stats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/muxable/cdn/internal/media"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// interval is the period over which rates and the fraction lost are measured.
+const interval = time.Second
+
+// Track is a snapshot of the quality of a received track.
+type Track struct {
+	// Bitrate is in bits per second.
+	Bitrate    uint64
+	PacketRate float64
+	FrameRate  float64
+
+	// FractionLost, PacketsLost and Jitter are computed as they are reported in RTCP receiver
+	// reports (RFC 3550 section 6.4.1).
+	FractionLost float64
+	PacketsLost  int64
+	Jitter       time.Duration
+
+	// KeyframeInterval is the time between the two most recent keyframes, zero if fewer than two
+	// keyframes were received.
+	KeyframeInterval time.Duration
+
+	Packets uint64
+	Bytes   uint64
+}
+
+// Receiver accumulates the quality statistics of a received track.
+type Receiver struct {
+	sync.Mutex
+
+	mimeType  string
+	clockRate uint32
+
+	packets, bytes uint64
+
+	// the current measurement interval.
+	intervalStart                  time.Time
+	intervalPackets, intervalBytes uint64
+	intervalFrames                 uint64
+	bitrate                        uint64
+	packetRate, frameRate          float64
+	lastTimestamp                  uint32
+	started                        bool
+
+	// sequence number tracking as in RFC 3550 appendix A.1.
+	baseSeq, maxSeq uint16
+	cycles          uint32
+	received        uint32
+	expectedPrior   uint32
+	receivedPrior   uint32
+	fractionLost    float64
+
+	// jitter is in timestamp units, as in RFC 3550 appendix A.8.
+	jitter  float64
+	transit int64
+	// start is the arrival time of the first packet, arrivals are measured from it.
+	start time.Time
+
+	lastKeyframe          time.Time
+	lastKeyframeTimestamp uint32
+	keyframeInterval      time.Duration
+}
+
+func NewReceiver(mimeType string, clockRate uint32) *Receiver {
+	return &Receiver{mimeType: mimeType, clockRate: clockRate}
+}
+
+// WriteRTP updates the statistics with a received packet.
+func (r *Receiver) WriteRTP(p *rtp.Packet) error {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	size := uint64(p.MarshalSize())
+	r.packets++
+	r.bytes += size
+
+	if !r.started {
+		r.started = true
+		r.start, r.intervalStart = now, now
+		r.baseSeq, r.maxSeq = p.SequenceNumber, p.SequenceNumber
+		r.lastTimestamp = p.Timestamp
+		r.intervalFrames++
+	} else {
+		if delta := p.SequenceNumber - r.maxSeq; delta > 0 && delta < 1<<15 {
+			if p.SequenceNumber < r.maxSeq {
+				r.cycles += 1 << 16
+			}
+			r.maxSeq = p.SequenceNumber
+		}
+		if p.Timestamp != r.lastTimestamp {
+			r.lastTimestamp = p.Timestamp
+			r.intervalFrames++
+		}
+	}
+	r.received++
+	r.intervalPackets++
+	r.intervalBytes += size
+
+	if r.clockRate > 0 {
+		arrival := int64(now.Sub(r.start).Seconds() * float64(r.clockRate))
+		transit := arrival - int64(p.Timestamp)
+		if r.received > 1 {
+			d := transit - r.transit
+			if d < 0 {
+				d = -d
+			}
+			r.jitter += (float64(d) - r.jitter) / 16
+		}
+		r.transit = transit
+	}
+
+	if media.IsKeyframe(r.mimeType, p.Payload) && (r.lastKeyframe.IsZero() || p.Timestamp != r.lastKeyframeTimestamp) {
+		if !r.lastKeyframe.IsZero() {
+			r.keyframeInterval = now.Sub(r.lastKeyframe)
+		}
+		r.lastKeyframe, r.lastKeyframeTimestamp = now, p.Timestamp
+	}
+
+	if elapsed := now.Sub(r.intervalStart); elapsed >= interval {
+		r.bitrate = uint64(float64(r.intervalBytes*8) / elapsed.Seconds())
+		r.packetRate = float64(r.intervalPackets) / elapsed.Seconds()
+		r.frameRate = float64(r.intervalFrames) / elapsed.Seconds()
+
+		expected := r.expected()
+		expectedInterval := expected - r.expectedPrior
+		receivedInterval := r.received - r.receivedPrior
+		r.expectedPrior, r.receivedPrior = expected, r.received
+		if expectedInterval > 0 && expectedInterval > receivedInterval {
+			r.fractionLost = float64(expectedInterval-receivedInterval) / float64(expectedInterval)
+		} else {
+			r.fractionLost = 0
+		}
+
+		r.intervalStart = now
+		r.intervalPackets, r.intervalBytes, r.intervalFrames = 0, 0, 0
+	}
+	return nil
+}
+
+// expected returns the number of packets expected since the first packet.
+func (r *Receiver) expected() uint32 {
+	return r.cycles + uint32(r.maxSeq) - uint32(r.baseSeq) + 1
+}
+
+// Stats returns a snapshot of the statistics. Rates are zero if the track has stalled.
+func (r *Receiver) Stats() Track {
+	r.Lock()
+	defer r.Unlock()
+
+	stats := Track{
+		Packets:          r.packets,
+		Bytes:            r.bytes,
+		KeyframeInterval: r.keyframeInterval,
+	}
+	if !r.started {
+		return stats
+	}
+	if time.Since(r.intervalStart) < 2*interval {
+		stats.Bitrate, stats.PacketRate, stats.FrameRate = r.bitrate, r.packetRate, r.frameRate
+	}
+	stats.FractionLost = r.fractionLost
+	if lost := int64(r.expected()) - int64(r.received); lost > 0 {
+		stats.PacketsLost = lost
+	}
+	if r.clockRate > 0 {
+		stats.Jitter = time.Duration(r.jitter / float64(r.clockRate) * float64(time.Second))
+	}
+	return stats
+}
+
+// Subscriber is a snapshot of the quality of a track as reported by a subscriber.
+type Subscriber struct {
+	Address string
+
+	RoundTripTime time.Duration
+	FractionLost  float64
+	PacketsLost   int64
+	Jitter        time.Duration
+
+	// UpdatedAt is when the last receiver report arrived, zero if none has.
+	UpdatedAt time.Time
+}
+
+// Sender accumulates the receiver reports sent by a subscriber for a forwarded track.
+type Sender struct {
+	sync.Mutex
+
+	clockRate uint32
+	stats     Subscriber
+}
+
+func NewSender(clockRate uint32) *Sender {
+	return &Sender{clockRate: clockRate}
+}
+
+// SetAddress sets the address of the subscriber.
+func (s *Sender) SetAddress(address string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.stats.Address = address
+}
+
+// WriteRTCP updates the statistics with the RTCP packets read from the subscriber.
+func (s *Sender) WriteRTCP(packets []rtcp.Packet) error {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for _, packet := range packets {
+		rr, ok := packet.(*rtcp.ReceiverReport)
+		if !ok {
+			continue
+		}
+		for _, report := range rr.Reports {
+			s.stats.FractionLost = float64(report.FractionLost) / 256
+			s.stats.PacketsLost = int64(report.TotalLost)
+			if s.clockRate > 0 {
+				s.stats.Jitter = time.Duration(float64(report.Jitter) / float64(s.clockRate) * float64(time.Second))
+			}
+			if report.LastSenderReport != 0 {
+				// the round trip time is the time since our sender report less the subscriber's
+				// delay, in units of 1/65536 seconds (RFC 3550 section 6.4.1).
+				rtt := ntpMiddle(now) - report.LastSenderReport - report.Delay
+				if int32(rtt) >= 0 {
+					s.stats.RoundTripTime = time.Duration(uint64(rtt) * uint64(time.Second) >> 16)
+				}
+			}
+			s.stats.UpdatedAt = now
+		}
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the statistics.
+func (s *Sender) Stats() Subscriber {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.stats
+}
+
+// ntpMiddle returns the middle 32 bits of the NTP timestamp of t.
+func ntpMiddle(t time.Time) uint32 {
+	// the ntp epoch is 1900, 70 years and 17 leap days before the unix epoch.
+	seconds := uint64(t.Unix()) + 2208988800
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return uint32(seconds<<16 | fraction>>16)
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/muxable/cdn/internal/media"
+	"github.com/pion/rtp"
+	"github.com/pion/rtpio/pkg/rtpio"
+)
+
+type bufferedPacket struct {
+	*rtp.Packet
+
+	arrival  time.Time
+	keyframe bool
+}
+
+// Buffer is a rolling, time-bounded buffer of a track's recent packets used to serve
+// subscriptions that start in the past.
+type Buffer struct {
+	sync.Mutex
+
+	window    time.Duration
+	mimeType  string
+	clockRate uint32
+
+	packets []bufferedPacket
+	// first is the absolute index of packets[0] so cursors survive trimming.
+	first uint64
+}
+
+func NewBuffer(window time.Duration, mimeType string, clockRate uint32) *Buffer {
+	return &Buffer{window: window, mimeType: mimeType, clockRate: clockRate}
+}
+
+// WriteRTP appends a packet and drops packets that fell out of the window.
+func (b *Buffer) WriteRTP(p *rtp.Packet) error {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	b.packets = append(b.packets, bufferedPacket{Packet: p, arrival: now, keyframe: media.IsKeyframe(b.mimeType, p.Payload)})
+
+	trim := 0
+	for trim < len(b.packets) && now.Sub(b.packets[trim].arrival) > b.window {
+		trim++
+	}
+	if trim > 0 {
+		// reslicing is amortized, the trimmed prefix is released when append reallocates.
+		b.packets = b.packets[trim:]
+		b.first += uint64(trim)
+	}
+	return nil
+}
+
+// end returns the absolute index one past the newest packet.
+func (b *Buffer) end() uint64 {
+	return b.first + uint64(len(b.packets))
+}
+
+// seek returns the absolute index of the nearest keyframe at or before offset behind the newest
+// packet, falling back to the oldest keyframe. If there is no keyframe, the live edge is returned.
+func (b *Buffer) seek(offset time.Duration) uint64 {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.packets) == 0 {
+		return b.end()
+	}
+	target := b.packets[len(b.packets)-1].Timestamp - uint32(offset.Seconds()*float64(b.clockRate))
+	oldest := -1
+	for i := len(b.packets) - 1; i >= 0; i-- {
+		if !b.packets[i].keyframe {
+			continue
+		}
+		if int32(b.packets[i].Timestamp-target) <= 0 {
+			return b.first + uint64(i)
+		}
+		oldest = i
+	}
+	if oldest >= 0 {
+		return b.first + uint64(oldest)
+	}
+	return b.end()
+}
+
+// at returns the packet at the absolute index, skipping ahead if it was trimmed. ok is false if
+// the index is at the live edge.
+func (b *Buffer) at(i uint64) (bufferedPacket, uint64, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if i < b.first {
+		i = b.first
+	}
+	if i >= b.end() {
+		return bufferedPacket{}, i, false
+	}
+	return b.packets[i-b.first], i, true
+}
+
+// replay writes the buffered packets starting offset behind live to w, paced at rate times real
+// time, and attaches w to the multicaster once it catches up to the live edge.
+func (b *Buffer) replay(ctx context.Context, m *Multicaster, w rtpio.RTPWriter, offset time.Duration, rate float64) {
+	if rate <= 1 {
+		// replaying at or below real time would never catch up.
+		rate = 2
+	}
+	cursor := b.seek(offset)
+	var start time.Time
+	var startTimestamp uint32
+	started := false
+
+	for {
+		p, i, ok := b.at(cursor)
+		if !ok {
+			// attach atomically with respect to new packets, which are buffered under the
+			// multicaster's lock.
+			m.Lock()
+			b.Lock()
+			caughtUp := i >= b.end()
+			if caughtUp {
+				m.sources = append(m.sources, w)
+			}
+			b.Unlock()
+			m.Unlock()
+			if caughtUp {
+				return
+			}
+			continue
+		}
+
+		if !started || int32(p.Timestamp-startTimestamp) < 0 {
+			// re-anchor the pacing on the first packet or a timestamp discontinuity.
+			start, startTimestamp, started = time.Now(), p.Timestamp, true
+		}
+		elapsed := time.Duration(float64(p.Timestamp-startTimestamp) / float64(b.clockRate) / rate * float64(time.Second))
+		if wait := time.Until(start.Add(elapsed)); wait > 0 {
+			if wait > time.Second {
+				// a forward discontinuity, don't stall the subscriber.
+				start, startTimestamp = time.Now(), p.Timestamp
+				wait = 0
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err := w.WriteRTP(p.Packet); err != nil {
+			return
+		}
+		cursor = i + 1
+	}
+}
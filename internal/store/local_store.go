@@ -2,11 +2,17 @@ package store
 
 import (
 	"context"
+	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/muxable/cdn/internal/metrics"
+	"github.com/muxable/cdn/internal/stats"
 	"github.com/pion/rtp"
 	"github.com/pion/rtpio/pkg/rtpio"
 	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
@@ -20,7 +26,50 @@ func (r *TrackRemoteReader) ReadRTP() (*rtp.Packet, error) {
 	return p, err
 }
 
-var _ rtpio.RTPReader = (*TrackRemoteReader)(nil)
+var _ TrackSource = (*TrackRemoteReader)(nil)
+
+// meteredReader counts the packets read from a track's source and measures their quality.
+type meteredReader struct {
+	*TrackRemote
+	packets prometheus.Counter
+	bytes   prometheus.Counter
+}
+
+func newMeteredReader(track *TrackRemote) *meteredReader {
+	return &meteredReader{
+		TrackRemote: track,
+		packets:     metrics.TrackPackets.WithLabelValues(track.StreamID(), track.ID(), track.RID(), "in"),
+		bytes:       metrics.TrackBytes.WithLabelValues(track.StreamID(), track.ID(), track.RID(), "in"),
+	}
+}
+
+func (r *meteredReader) ReadRTP() (*rtp.Packet, error) {
+	p, err := r.TrackSource.ReadRTP()
+	if err != nil {
+		// the track is gone so stop exporting its series.
+		for _, direction := range []string{"in", "out"} {
+			metrics.TrackPackets.DeleteLabelValues(r.StreamID(), r.ID(), r.RID(), direction)
+			metrics.TrackBytes.DeleteLabelValues(r.StreamID(), r.ID(), r.RID(), direction)
+		}
+		atomic.StoreInt32(&r.ended, 1)
+		return nil, err
+	}
+	r.packets.Inc()
+	r.bytes.Add(float64(p.MarshalSize()))
+	r.receiver.WriteRTP(p)
+	return p, nil
+}
+
+// TrackSource is a source of RTP packets for a single track that can be added to the store.
+type TrackSource interface {
+	rtpio.RTPReader
+
+	ID() string
+	StreamID() string
+	RID() string
+	Kind() webrtc.RTPCodecType
+	Codec() webrtc.RTPCodecParameters
+}
 
 type Multicaster struct {
 	sync.Mutex
@@ -36,15 +85,28 @@ func NewMulticaster(sink rtpio.RTPReader) *Multicaster {
 		for {
 			p, err := sink.ReadRTP()
 			if err != nil {
+				m.Lock()
+				for _, source := range m.sources {
+					if closer, ok := source.(io.Closer); ok {
+						closer.Close()
+					}
+				}
+				m.Unlock()
 				return
 			}
 
 			m.Lock()
+			sources := m.sources[:0]
 			for _, source := range m.sources {
-				if err := source.WriteRTP(p); err != nil {
+				if err := source.WriteRTP(p); err == io.ErrClosedPipe {
+					// the writer is gone, stop forwarding to it.
 					continue
+				} else if err != nil {
+					metrics.MulticasterWriteErrors.Inc()
 				}
+				sources = append(sources, source)
 			}
+			m.sources = sources
 			m.Unlock()
 		}
 	}()
@@ -59,93 +121,415 @@ func (m *Multicaster) WriteTo(w rtpio.RTPWriter) {
 	m.sources = append(m.sources, w)
 }
 
+// TrackReader is an in-process reader of a track's packets. It buffers a bounded number of
+// packets and drops new ones if the reader falls behind. Packets are shared between readers
+// and must not be modified.
+type TrackReader struct {
+	packets chan *rtp.Packet
+	done    chan struct{}
+	once    sync.Once
+}
+
+func NewTrackReader() *TrackReader {
+	return &TrackReader{
+		packets: make(chan *rtp.Packet, 512),
+		done:    make(chan struct{}),
+	}
+}
+
+// WriteRTP buffers a packet for the reader.
+func (r *TrackReader) WriteRTP(p *rtp.Packet) error {
+	select {
+	case <-r.done:
+		return io.ErrClosedPipe
+	default:
+	}
+	select {
+	case r.packets <- p:
+	default:
+		// drop the packet if the reader falls behind.
+		metrics.MulticasterDrops.Inc()
+	}
+	return nil
+}
+
+// ReadRTP reads the next buffered packet, returning io.EOF once the reader is closed.
+func (r *TrackReader) ReadRTP() (*rtp.Packet, error) {
+	select {
+	case p := <-r.packets:
+		return p, nil
+	case <-r.done:
+		return nil, io.EOF
+	}
+}
+
+// Close detaches the reader from the track.
+func (r *TrackReader) Close() error {
+	r.once.Do(func() { close(r.done) })
+	return nil
+}
+
+var _ rtpio.RTPReadWriteCloser = (*TrackReader)(nil)
+
 type TrackRemote struct {
-	*webrtc.TrackRemote
+	TrackSource
 	multicaster *Multicaster
+	buffer      *Buffer
 
-	Trace   []string
+	// receiver measures the quality of the track, ended is set once the source is exhausted.
+	receiver *stats.Receiver
+	ended    int32
+
+	// locals are the tracks forwarding this track to subscribers.
+	locals     map[*TrackLocal]bool
+	localMutex sync.Mutex
+
+	Trace []string
+}
+
+// TrackStats is a snapshot of the quality of a track and of its subscribers.
+type TrackStats struct {
+	ID    string
+	RID   string
+	Kind  webrtc.RTPCodecType
+	Codec webrtc.RTPCodecParameters
+
+	stats.Track
+	Subscribers []stats.Subscriber
+}
+
+// stats returns a snapshot of the track's statistics. Only subscribers with a bound
+// PeerConnection are included.
+func (tr *TrackRemote) stats() TrackStats {
+	ts := TrackStats{
+		ID:    tr.ID(),
+		RID:   tr.RID(),
+		Kind:  tr.Kind(),
+		Codec: tr.Codec(),
+		Track: tr.receiver.Stats(),
+	}
+	tr.localMutex.Lock()
+	defer tr.localMutex.Unlock()
+	for local := range tr.locals {
+		if atomic.LoadInt32(&local.bindings) > 0 {
+			ts.Subscribers = append(ts.Subscribers, local.Stats.Stats())
+		}
+	}
+	return ts
 }
 
 type TrackLocal struct {
 	*webrtc.TrackLocalStaticRTP
+	multicaster *Multicaster
+
+	// bindings counts the PeerConnections the track is bound to, egress counts the bytes sent to
+	// them.
+	bindings   int32
+	egress     *uint64
+	packetsOut prometheus.Counter
+	bytesOut   prometheus.Counter
+
+	// replay, if set, starts forwarding from the buffer once the track is bound.
+	replay     func()
+	replayOnce sync.Once
+
+	// closed is set once the track is detached from its remote track.
+	closed int32
+
+	// Stats accumulates the receiver reports of the subscriber.
+	Stats *stats.Sender
 
-	Trace   []string
+	Trace []string
 }
 
+// Bind is called by the PeerConnection when the track is negotiated. Time-shifted tracks start
+// replaying here since packets written before binding are discarded.
+func (t *TrackLocal) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := t.TrackLocalStaticRTP.Bind(ctx)
+	if err != nil {
+		return codec, err
+	}
+	atomic.AddInt32(&t.bindings, 1)
+	if t.replay != nil {
+		t.replayOnce.Do(func() { go t.replay() })
+	}
+	return codec, nil
+}
+
+func (t *TrackLocal) Unbind(ctx webrtc.TrackLocalContext) error {
+	if err := t.TrackLocalStaticRTP.Unbind(ctx); err != nil {
+		return err
+	}
+	atomic.AddInt32(&t.bindings, -1)
+	return nil
+}
+
+// WriteRTP forwards a packet to the bound PeerConnections.
+func (t *TrackLocal) WriteRTP(p *rtp.Packet) error {
+	if t.Closed() {
+		return io.ErrClosedPipe
+	}
+	if bindings := atomic.LoadInt32(&t.bindings); bindings > 0 {
+		size := uint64(p.MarshalSize()) * uint64(bindings)
+		if t.egress != nil {
+			atomic.AddUint64(t.egress, size)
+		}
+		if t.packetsOut != nil {
+			t.packetsOut.Add(float64(bindings))
+			t.bytesOut.Add(float64(size))
+		}
+	}
+	return t.TrackLocalStaticRTP.WriteRTP(p)
+}
+
+// Closed reports whether the track was detached from its remote track, for example because it no
+// longer matches its subscription's filter.
+func (t *TrackLocal) Closed() bool {
+	return atomic.LoadInt32(&t.closed) == 1
+}
+
+// NewReader returns an in-process reader of the packets forwarded to this track.
+func (t *TrackLocal) NewReader() *TrackReader {
+	r := NewTrackReader()
+	t.multicaster.WriteTo(r)
+	return r
+}
+
+// TrackFilter reports whether a subscription wants the track, a nil filter matches every track.
+type TrackFilter func(TrackSource) bool
+
 type Subscription struct {
-	ch chan *TrackLocal
+	ctx      context.Context
+	ch       chan *TrackLocal
+	pending  sync.WaitGroup
 	StreamID string
+
+	// filter and delivered are guarded by the store's lock.
+	filter    TrackFilter
+	delivered map[*TrackRemote]*TrackLocal
+
+	// Offset is how far behind live tracks that existed at subscription time start.
+	Offset      time.Duration
+	catchUpRate float64
+	egress      *uint64
+}
+
+// matches reports whether the subscription wants the track.
+func (sub *Subscription) matches(tr *TrackRemote) bool {
+	return tr.StreamID() == sub.StreamID && (sub.filter == nil || sub.filter(tr))
+}
+
+// Tracks returns the channel the subscription's tracks are delivered on. It's closed once the
+// subscription's context is cancelled.
+func (sub *Subscription) Tracks() <-chan *TrackLocal {
+	return sub.ch
+}
+
+// deliver attaches a new local track to the remote track and sends it to the subscriber without
+// blocking the store.
+func (sub *Subscription) deliver(tr *TrackRemote) error {
+	tl, err := webrtc.NewTrackLocalStaticRTP(tr.Codec().RTPCodecCapability, tr.ID(), tr.StreamID(), webrtc.WithRTPStreamID(tr.RID()))
+	if err != nil {
+		return err
+	}
+	local := &TrackLocal{
+		TrackLocalStaticRTP: tl,
+		multicaster:         tr.multicaster,
+		egress:              sub.egress,
+		packetsOut:          metrics.TrackPackets.WithLabelValues(tr.StreamID(), tr.ID(), tr.RID(), "out"),
+		bytesOut:            metrics.TrackBytes.WithLabelValues(tr.StreamID(), tr.ID(), tr.RID(), "out"),
+		Stats:               stats.NewSender(tr.Codec().ClockRate),
+		Trace:               tr.Trace,
+	}
+	tr.localMutex.Lock()
+	tr.locals[local] = true
+	tr.localMutex.Unlock()
+	sub.delivered[tr] = local
+	go func() {
+		<-sub.ctx.Done()
+		// the multicaster stops forwarding to closed tracks.
+		atomic.StoreInt32(&local.closed, 1)
+		tr.localMutex.Lock()
+		delete(tr.locals, local)
+		tr.localMutex.Unlock()
+	}()
+	if offset := sub.Offset; offset > 0 && tr.buffer != nil {
+		local.replay = func() {
+			tr.buffer.replay(sub.ctx, tr.multicaster, local, offset, sub.catchUpRate)
+		}
+	} else {
+		tr.multicaster.WriteTo(local)
+	}
+	sub.pending.Add(1)
+	go func() {
+		defer sub.pending.Done()
+		select {
+		case sub.ch <- local:
+		case <-sub.ctx.Done():
+		}
+	}()
+	return nil
 }
 
 // LocalTrackStore is a track store that stores tracks in memory.
 type LocalTrackStore struct {
+	// egressBytes is first for 64-bit alignment of atomic operations.
+	egressBytes uint64
+
 	sync.RWMutex
 
 	tracks        []*TrackRemote
 	subscriptions []*Subscription
+
+	// BufferWindow is how much of each track's history is kept for time-shifted subscriptions,
+	// zero disables buffering.
+	BufferWindow time.Duration
+	// CatchUpRate is how much faster than real time time-shifted subscriptions are replayed
+	// until they reach the live edge.
+	CatchUpRate float64
 }
 
 func NewLocalTrackStore() *LocalTrackStore {
-	return &LocalTrackStore{}
+	return &LocalTrackStore{CatchUpRate: 2}
+}
+
+// EgressBytes returns the number of bytes forwarded to subscribed PeerConnections.
+func (s *LocalTrackStore) EgressBytes() uint64 {
+	return atomic.LoadUint64(&s.egressBytes)
 }
 
+// Subscribe returns a channel of local tracks for every current and future track of the stream.
+// The channel is closed when the context is cancelled.
 func (s *LocalTrackStore) Subscribe(ctx context.Context, streamID string) chan *TrackLocal {
-	s.RLock()
-	defer s.RUnlock()
+	return s.SubscribeAt(ctx, streamID, 0)
+}
+
+// SubscribeAt is like Subscribe but tracks that already exist start from the nearest keyframe
+// offset behind live and catch up to live. Tracks added later start live.
+func (s *LocalTrackStore) SubscribeAt(ctx context.Context, streamID string, offset time.Duration) chan *TrackLocal {
+	return s.SubscribeFiltered(ctx, streamID, offset, nil).ch
+}
+
+// SubscribeFiltered is like SubscribeAt but only delivers the tracks matching filter, which can be
+// replaced with SetFilter.
+func (s *LocalTrackStore) SubscribeFiltered(ctx context.Context, streamID string, offset time.Duration, filter TrackFilter) *Subscription {
+	s.Lock()
+	defer s.Unlock()
 
-	ch := make(chan *TrackLocal)
+	sub := &Subscription{
+		ctx:         ctx,
+		ch:          make(chan *TrackLocal),
+		StreamID:    streamID,
+		filter:      filter,
+		delivered:   make(map[*TrackRemote]*TrackLocal),
+		Offset:      offset,
+		catchUpRate: s.CatchUpRate,
+		egress:      &s.egressBytes,
+	}
 
 	for _, tr := range s.tracks {
-		if tr.StreamID() == streamID {
-			tl, err := webrtc.NewTrackLocalStaticRTP(tr.Codec().RTPCodecCapability, tr.ID(), tr.StreamID(), webrtc.WithRTPStreamID(tr.RID()))
-			if err != nil {
+		if sub.matches(tr) {
+			if err := sub.deliver(tr); err != nil {
 				continue
 			}
-			tr.multicaster.WriteTo(tl)
-			go func ()  {
-				ch <- &TrackLocal{TrackLocalStaticRTP: tl, Trace: tr.Trace}
-			}()
 		}
 	}
-	s.subscriptions = append(s.subscriptions, &Subscription{ch: ch, StreamID: streamID})
+	// future tracks have no history to replay.
+	sub.Offset = 0
+	s.subscriptions = append(s.subscriptions, sub)
 	go func() {
 		<-ctx.Done()
 		s.Lock()
-		defer s.Unlock()
-		for i, sub := range s.subscriptions {
-			if sub.ch == ch {
+		for i, candidate := range s.subscriptions {
+			if candidate == sub {
 				s.subscriptions = append(s.subscriptions[:i], s.subscriptions[i+1:]...)
+				break
 			}
 		}
-		close(ch)
+		s.Unlock()
+		// no more deliveries can start once the subscription is removed.
+		sub.pending.Wait()
+		close(sub.ch)
 	}()
-	return ch
+	return sub
+}
+
+// SetFilter replaces the subscription's filter. Tracks that now match are delivered live and the
+// tracks that no longer match are closed and returned so the subscriber can remove them.
+func (s *LocalTrackStore) SetFilter(sub *Subscription, filter TrackFilter) []*TrackLocal {
+	s.Lock()
+	defer s.Unlock()
+
+	if sub.ctx.Err() != nil {
+		return nil
+	}
+	sub.filter = filter
+
+	var removed []*TrackLocal
+	for tr, local := range sub.delivered {
+		if sub.matches(tr) {
+			continue
+		}
+		delete(sub.delivered, tr)
+		// the multicaster stops forwarding to closed tracks.
+		atomic.StoreInt32(&local.closed, 1)
+		tr.localMutex.Lock()
+		delete(tr.locals, local)
+		tr.localMutex.Unlock()
+		removed = append(removed, local)
+	}
+	for _, tr := range s.tracks {
+		if _, ok := sub.delivered[tr]; ok || !sub.matches(tr) || atomic.LoadInt32(&tr.ended) == 1 {
+			continue
+		}
+		if err := sub.deliver(tr); err != nil {
+			zap.L().Error("failed to deliver track", zap.Error(err))
+		}
+	}
+	return removed
 }
 
 func (s *LocalTrackStore) AddTrack(track *TrackRemote) error {
 	s.Lock()
 	defer s.Unlock()
 
-	track.multicaster = NewMulticaster(&TrackRemoteReader{TrackRemote: track.TrackRemote})
+	track.receiver = stats.NewReceiver(track.Codec().MimeType, track.Codec().ClockRate)
+	track.locals = make(map[*TrackLocal]bool)
+	track.multicaster = NewMulticaster(newMeteredReader(track))
+	if s.BufferWindow > 0 {
+		track.buffer = NewBuffer(s.BufferWindow, track.Codec().MimeType, track.Codec().ClockRate)
+		track.multicaster.WriteTo(track.buffer)
+	}
 	for _, sub := range s.subscriptions {
-		if sub.StreamID == track.StreamID() {
-			tl, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, track.ID(), track.StreamID(), webrtc.WithRTPStreamID(track.RID()))
-			if err != nil {
+		if sub.matches(track) {
+			if err := sub.deliver(track); err != nil {
 				return err
 			}
-			track.multicaster.WriteTo(tl)
-			sub.ch <- &TrackLocal{TrackLocalStaticRTP: tl, Trace: track.Trace}
 		}
 	}
 	s.tracks = append(s.tracks, track)
 	return nil
 }
 
+// Stats returns a snapshot of the quality of the live tracks of the stream.
+func (s *LocalTrackStore) Stats(streamID string) []TrackStats {
+	s.RLock()
+	defer s.RUnlock()
+
+	var result []TrackStats
+	for _, tr := range s.tracks {
+		if tr.StreamID() == streamID && atomic.LoadInt32(&tr.ended) == 0 {
+			result = append(result, tr.stats())
+		}
+	}
+	return result
+}
+
 func (s *LocalTrackStore) AddPublisher(pc *webrtc.PeerConnection) {
 	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		if err := s.AddTrack(&TrackRemote{TrackRemote: track}); err != nil {
+		if err := s.AddTrack(&TrackRemote{TrackSource: &TrackRemoteReader{TrackRemote: track}}); err != nil {
 			zap.L().Error("failed to add track", zap.Error(err))
 			return
 		}
 	})
-}
\ No newline at end of file
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidPlaybackToken = errors.New("invalid playback token")
+	ErrPlaybackTokenExpired = errors.New("playback token expired")
+)
+
+// PlaybackSigner issues and verifies short-lived playback tokens scoped to a single stream. Tokens
+// are of the form {expiry}.{signature} where the signature is an HMAC-SHA256 of the stream id and
+// expiry, so nodes sharing the secret can verify each other's tokens.
+type PlaybackSigner struct {
+	secret []byte
+}
+
+func NewPlaybackSigner(secret []byte) *PlaybackSigner {
+	return &PlaybackSigner{secret: secret}
+}
+
+func (s *PlaybackSigner) signature(streamID string, expiry int64) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(streamID))
+	mac.Write([]byte{0})
+	mac.Write([]byte(strconv.FormatInt(expiry, 10)))
+	return mac.Sum(nil)
+}
+
+// Sign issues a token for the stream that expires at the given time.
+func (s *PlaybackSigner) Sign(streamID string, expiry time.Time) string {
+	unix := expiry.Unix()
+	return strconv.FormatInt(unix, 10) + "." + base64.RawURLEncoding.EncodeToString(s.signature(streamID, unix))
+}
+
+// Verify checks the token against the stream and returns its expiry.
+func (s *PlaybackSigner) Verify(streamID, token string) (time.Time, error) {
+	dot := strings.IndexByte(token, '.')
+	if dot < 0 {
+		return time.Time{}, ErrInvalidPlaybackToken
+	}
+	unix, err := strconv.ParseInt(token[:dot], 10, 64)
+	if err != nil {
+		return time.Time{}, ErrInvalidPlaybackToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(token[dot+1:])
+	if err != nil || !hmac.Equal(signature, s.signature(streamID, unix)) {
+		return time.Time{}, ErrInvalidPlaybackToken
+	}
+	expiry := time.Unix(unix, 0)
+	if !time.Now().Before(expiry) {
+		return expiry, ErrPlaybackTokenExpired
+	}
+	return expiry, nil
+}
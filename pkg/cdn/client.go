@@ -2,43 +2,250 @@ package cdn
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/muxable/cdn/api"
 	"github.com/muxable/signal/pkg/signal"
 	"github.com/pion/webrtc/v3"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
+// AlternateNode returns the node suggested by a server that rejected a session for being over
+// capacity or draining.
+func AlternateNode(err error) (string, bool) {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && (info.Reason == "OVER_CAPACITY" || info.Reason == "DRAINING") {
+			if alternate := info.Metadata["alternate"]; alternate != "" {
+				return alternate, true
+			}
+		}
+	}
+	return "", false
+}
+
 type Client struct {
-	grpcClient api.CDNClient
+	grpcClient  api.CDNClient
+	callOptions []grpc.CallOption
+	onReconnect func(alternate string)
+	api         *webrtc.API
+	iceServers  []webrtc.ICEServer
 }
 
-func NewClient(conn *grpc.ClientConn) (*Client, error) {
-	return &Client{grpcClient: api.NewCDNClient(conn)}, nil
+type ClientOption func(*Client)
+
+// WithCredentials attaches per-RPC credentials, such as an auth.Token, to every call.
+func WithCredentials(creds credentials.PerRPCCredentials) ClientOption {
+	return func(c *Client) {
+		c.callOptions = append(c.callOptions, grpc.PerRPCCredentials(creds))
+	}
 }
 
-func (c *Client) Publish() (*webrtc.PeerConnection, error) {
-	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-		},
-	})
+// WithAPI creates PeerConnections with the given API, for example to apply a SettingEngine.
+func WithAPI(api *webrtc.API) ClientOption {
+	return func(c *Client) {
+		c.api = api
+	}
+}
+
+// WithICEServers uses the given ICE servers instead of the ones advertised by the server, and
+// doesn't wait for the server to advertise them.
+func WithICEServers(iceServers ...webrtc.ICEServer) ClientOption {
+	return func(c *Client) {
+		c.iceServers = iceServers
+	}
+}
+
+// WithReconnectHandler is called when the server is draining and asks the session to reconnect,
+// with an alternate node if one is known. The session keeps running until the server shuts down.
+func WithReconnectHandler(handler func(alternate string)) ClientOption {
+	return func(c *Client) {
+		c.onReconnect = handler
+	}
+}
+
+// reconnect notifies the reconnect handler.
+func (c *Client) reconnect(message *api.Reconnect) {
+	zap.L().Info("server asked to reconnect", zap.String("alternate", message.Alternate))
+	if c.onReconnect != nil {
+		c.onReconnect(message.Alternate)
+	}
+}
+
+// newPeerConnection creates a PeerConnection with the client's API, if any.
+func (c *Client) newPeerConnection(configuration webrtc.Configuration) (*webrtc.PeerConnection, error) {
+	if c.api == nil {
+		return webrtc.NewPeerConnection(configuration)
+	}
+	return c.api.NewPeerConnection(configuration)
+}
+
+// configurationTimeout is how long a session waits for the server to advertise its ICE servers.
+// Servers send them as soon as the session opens, so this only needs to cover a round trip. Servers
+// that predate advertising them don't send a first response until negotiation starts, so every
+// session with them is delayed by the timeout, pass WithICEServers to skip the wait. pion builds the
+// ICE gatherer with the PeerConnection, so the servers can't be applied after negotiation starts.
+const configurationTimeout = 500 * time.Millisecond
+
+// defaultICEServers are used with servers that don't advertise ICE servers.
+var defaultICEServers = []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
+
+// firstResponse is the first response of a session, received in the background so that a server
+// that doesn't advertise ICE servers doesn't block the session. done is closed once it's received.
+type firstResponse struct {
+	done       chan struct{}
+	iceServers []*api.IceServer
+	err        error
+}
+
+// configuration returns the PeerConnection configuration for a session, using the ICE servers in
+// the server's first response unless they're overridden. If the server doesn't respond within
+// configurationTimeout, the default ICE servers are used.
+func (c *Client) configuration(first *firstResponse) (webrtc.Configuration, error) {
+	if c.iceServers != nil {
+		return webrtc.Configuration{ICEServers: c.iceServers}, nil
+	}
+	select {
+	case <-first.done:
+	case <-time.After(configurationTimeout):
+		zap.L().Warn("server did not advertise ice servers, using the defaults")
+		return webrtc.Configuration{ICEServers: defaultICEServers}, nil
+	}
+	if first.err != nil {
+		return webrtc.Configuration{}, first.err
+	}
+	iceServers := make([]webrtc.ICEServer, 0, len(first.iceServers))
+	for _, iceServer := range first.iceServers {
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs:       iceServer.Urls,
+			Username:   iceServer.Username,
+			Credential: iceServer.Credential,
+		})
+	}
+	return webrtc.Configuration{ICEServers: iceServers}, nil
+}
+
+func NewClient(conn *grpc.ClientConn, options ...ClientOption) (*Client, error) {
+	c := &Client{grpcClient: api.NewCDNClient(conn)}
+	for _, option := range options {
+		option(c)
+	}
+	return c, nil
+}
+
+type PublisherConfiguration func(*api.PublishRequest)
+
+// WithVisibility sets whether published streams are listed and whether viewers need a token.
+func WithVisibility(visibility api.StreamPolicy_Visibility) PublisherConfiguration {
+	return func(p *api.PublishRequest) {
+		if p.Policy == nil {
+			p.Policy = &api.StreamPolicy{}
+		}
+		p.Policy.Visibility = visibility
+	}
+}
+
+// WithAllowedRegions restricts published streams to nodes with the given tags.
+func WithAllowedRegions(regions ...string) PublisherConfiguration {
+	return func(p *api.PublishRequest) {
+		if p.Policy == nil {
+			p.Policy = &api.StreamPolicy{}
+		}
+		p.Policy.AllowedRegions = append(p.Policy.AllowedRegions, regions...)
+	}
+}
+
+// WithStreamID announces the stream the session publishes, the server rejects tracks of any other
+// stream.
+func WithStreamID(streamID string) PublisherConfiguration {
+	return func(p *api.PublishRequest) {
+		announce(p).StreamId = streamID
+	}
+}
+
+// WithMetadata attaches metadata, such as a title, to the announced stream.
+func WithMetadata(key, value string) PublisherConfiguration {
+	return func(p *api.PublishRequest) {
+		a := announce(p)
+		if a.Metadata == nil {
+			a.Metadata = make(map[string]string)
+		}
+		a.Metadata[key] = value
+	}
+}
+
+// WithTrackLabel labels a track of the announced stream.
+func WithTrackLabel(trackID, label string) PublisherConfiguration {
+	return func(p *api.PublishRequest) {
+		a := announce(p)
+		if a.TrackLabels == nil {
+			a.TrackLabels = make(map[string]string)
+		}
+		a.TrackLabels[trackID] = label
+	}
+}
+
+// announce returns the request's announce, creating it if necessary.
+func announce(p *api.PublishRequest) *api.Announce {
+	if p.Announce == nil {
+		p.Announce = &api.Announce{}
+	}
+	return p.Announce
+}
+
+// Publish starts a publishing session, tracks added to its PeerConnection are published. The
+// session ends when ctx is cancelled.
+func (c *Client) Publish(ctx context.Context, options ...PublisherConfiguration) (*Session, error) {
+	session, ctx := newSession(ctx)
+
+	publish, err := c.grpcClient.Publish(ctx, c.callOptions...)
 	if err != nil {
+		session.end(err)
 		return nil, err
 	}
 
-	signaller := signal.NewSignaller(peerConnection)
-
-	peerConnection.OnNegotiationNeeded(signaller.Renegotiate)
+	first := &firstResponse{done: make(chan struct{})}
+	var firstIn *api.PublishResponse
+	go func() {
+		defer close(first.done)
+		if firstIn, first.err = publish.Recv(); first.err == nil {
+			first.iceServers = firstIn.IceServers
+		}
+	}()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	configuration, err := c.configuration(first)
+	if err != nil {
+		session.end(err)
+		return nil, err
+	}
 
-	publish, err := c.grpcClient.Publish(ctx)
+	peerConnection, err := c.newPeerConnection(configuration)
 	if err != nil {
-		cancel()
+		session.end(err)
 		return nil, err
 	}
+	session.setPeerConnection(peerConnection)
+
+	signaller := signal.NewSignaller(peerConnection)
+
+	peerConnection.OnNegotiationNeeded(signaller.Renegotiate)
+
+	if len(options) > 0 {
+		request := &api.PublishRequest{}
+		for _, option := range options {
+			option(request)
+		}
+		// the policy and announce must arrive before any tracks are negotiated.
+		if err := publish.Send(request); err != nil {
+			session.end(err)
+			return nil, err
+		}
+	}
 
 	go func() {
 		for {
@@ -60,51 +267,107 @@ func (c *Client) Publish() (*webrtc.PeerConnection, error) {
 
 	peerConnection.OnICEConnectionStateChange(func(c webrtc.ICEConnectionState) {
 		zap.L().Debug("ice connection state change", zap.String("state", c.String()))
-		if c == webrtc.ICEConnectionStateClosed {
-			cancel()
-		}
 	})
 
+	peerConnection.OnConnectionStateChange(session.connectionStateChange)
+
 	go func() {
-		for {
-			in, err := publish.Recv()
+		// the first response may still be in flight if the configuration timed out.
+		<-first.done
+		for in, err := firstIn, first.err; ; in, err = publish.Recv() {
 			if err != nil {
+				session.end(err)
 				return
 			}
 
+			if in.Reconnect != nil {
+				c.reconnect(in.Reconnect)
+			}
+			if in.Signal == nil {
+				continue
+			}
 			if err := signaller.WriteSignal(in.Signal); err != nil {
 				zap.L().Error("failed to write signal", zap.Error(err))
+				session.end(err)
 				return
 			}
 		}
 	}()
 
-	return peerConnection, nil
+	return session, nil
 }
 
 type SubscriberConfiguration func(*api.SubscribeRequest_Subscription)
 
-func (c *Client) Subscribe(key string, options ...SubscriberConfiguration) (*webrtc.PeerConnection, error) {
-	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-		},
-	})
+// WithStartOffset starts the subscription the given duration behind live. The server replays from
+// the nearest keyframe and catches up to live, offsets beyond its buffer window are rejected.
+func WithStartOffset(offset time.Duration) SubscriberConfiguration {
+	return func(s *api.SubscribeRequest_Subscription) {
+		s.StartOffset = durationpb.New(offset)
+	}
+}
+
+// WithPlaybackToken subscribes with a signed playback token. The server ends the session when the
+// token expires.
+func WithPlaybackToken(token string) SubscriberConfiguration {
+	return func(s *api.SubscribeRequest_Subscription) {
+		s.PlaybackToken = token
+	}
+}
+
+// WithTrackFilter only subscribes to the tracks matching the filter, for example audio only with
+// &api.TrackFilter{Kinds: []string{"audio"}}.
+func WithTrackFilter(filter *api.TrackFilter) SubscriberConfiguration {
+	return func(s *api.SubscribeRequest_Subscription) {
+		s.Filter = filter
+	}
+}
+
+// Subscribe starts a session subscribing to the stream, its tracks arrive on the PeerConnection's
+// OnTrack. The session ends when ctx is cancelled.
+func (c *Client) Subscribe(ctx context.Context, key string, options ...SubscriberConfiguration) (*Session, error) {
+	session, ctx := newSession(ctx)
+
+	subscribe, err := c.grpcClient.Subscribe(ctx, c.callOptions...)
 	if err != nil {
+		session.end(err)
 		return nil, err
 	}
 
-	signaller := signal.NewSignaller(peerConnection)
-
-	peerConnection.OnNegotiationNeeded(signaller.Renegotiate)
+	first := &firstResponse{done: make(chan struct{})}
+	var firstIn *api.SubscribeResponse
+	go func() {
+		defer close(first.done)
+		if firstIn, first.err = subscribe.Recv(); first.err == nil {
+			first.iceServers = firstIn.IceServers
+		}
+	}()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	configuration, err := c.configuration(first)
+	if err != nil {
+		session.end(err)
+		return nil, err
+	}
 
-	subscribe, err := c.grpcClient.Subscribe(ctx)
+	peerConnection, err := c.newPeerConnection(configuration)
 	if err != nil {
-		cancel()
+		session.end(err)
 		return nil, err
 	}
+	session.setPeerConnection(peerConnection)
+
+	signaller := signal.NewSignaller(peerConnection)
+
+	peerConnection.OnNegotiationNeeded(signaller.Renegotiate)
+
+	// the session sends subscription updates alongside the signals.
+	var sendMutex sync.Mutex
+	send := func(request *api.SubscribeRequest) error {
+		sendMutex.Lock()
+		defer sendMutex.Unlock()
+		return subscribe.Send(request)
+	}
+	session.subscribe = send
 
 	go func() {
 		for {
@@ -113,7 +376,7 @@ func (c *Client) Subscribe(key string, options ...SubscriberConfiguration) (*web
 				zap.L().Error("failed to read signal", zap.Error(err))
 				return
 			}
-			if err := subscribe.Send(&api.SubscribeRequest{
+			if err := send(&api.SubscribeRequest{
 				Operation: &api.SubscribeRequest_Signal{Signal: signal},
 			}); err != nil {
 				zap.L().Error("failed to send signal", zap.Error(err))
@@ -122,44 +385,61 @@ func (c *Client) Subscribe(key string, options ...SubscriberConfiguration) (*web
 		}
 	}()
 
-	subscription := &api.SubscribeRequest_Subscription{
-		StreamId: key,
-	}
-
-	for _, option := range options {
-		option(subscription)
-	}
-
-	request := &api.SubscribeRequest{
-		Operation: &api.SubscribeRequest_Subscription_{
-			Subscription: subscription,
-		},
-	}
+	request := subscriptionRequest(key, options)
 
 	peerConnection.OnICEConnectionStateChange(func(c webrtc.ICEConnectionState) {
 		zap.L().Debug("ice connection state change", zap.String("state", c.String()))
-		if c == webrtc.ICEConnectionStateClosed {
-			cancel()
-		}
 	})
 
-	if err := subscribe.Send(request); err != nil {
+	peerConnection.OnConnectionStateChange(session.connectionStateChange)
+
+	if err := send(request); err != nil {
+		session.end(err)
 		return nil, err
 	}
 
 	go func() {
-		for {
-			in, err := subscribe.Recv()
+		// the first response may still be in flight if the configuration timed out.
+		<-first.done
+		for in, err := firstIn, first.err; ; in, err = subscribe.Recv() {
 			if err != nil {
 				zap.L().Error("failed to receive", zap.Error(err))
+				session.end(err)
 				return
 			}
 
+			if in.Reconnect != nil {
+				c.reconnect(in.Reconnect)
+			}
+			if in.TrackMap != nil {
+				session.trackMap(in.TrackMap)
+			}
+			if in.Signal == nil {
+				continue
+			}
 			if err := signaller.WriteSignal(in.Signal); err != nil {
+				session.end(err)
 				return
 			}
 		}
 	}()
 
-	return peerConnection, nil
+	return session, nil
+}
+
+// subscriptionRequest returns the request subscribing to the stream with the given options.
+func subscriptionRequest(streamID string, options []SubscriberConfiguration) *api.SubscribeRequest {
+	subscription := &api.SubscribeRequest_Subscription{
+		StreamId: streamID,
+	}
+
+	for _, option := range options {
+		option(subscription)
+	}
+
+	return &api.SubscribeRequest{
+		Operation: &api.SubscribeRequest_Subscription_{
+			Subscription: subscription,
+		},
+	}
 }
@@ -0,0 +1,437 @@
+package cdn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"go.uber.org/zap"
+)
+
+var ErrUnsupportedCodec = errors.New("unsupported codec")
+
+// MediaSource produces the samples of a track.
+type MediaSource interface {
+	// Codec is the codec of the samples.
+	Codec() webrtc.RTPCodecCapability
+	// NextSample returns the next sample, whose duration is the time until the one after it, or
+	// io.EOF once the media ends.
+	NextSample() (media.Sample, error)
+}
+
+type ivfSource struct {
+	reader *ivfreader.IVFReader
+	codec  webrtc.RTPCodecCapability
+	tick   time.Duration
+
+	// the frame is read ahead to know its duration.
+	frame     []byte
+	timestamp uint64
+	err       error
+}
+
+// NewIVFSource reads VP8 or VP9 frames from an IVF file.
+func NewIVFSource(r io.Reader) (MediaSource, error) {
+	reader, header, err := ivfreader.NewWith(r)
+	if err != nil {
+		return nil, err
+	}
+	s := &ivfSource{reader: reader}
+	switch header.FourCC {
+	case "VP80":
+		s.codec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	case "VP90":
+		s.codec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedCodec, header.FourCC)
+	}
+	if header.TimebaseDenominator == 0 {
+		return nil, errors.New("ivf timebase is zero")
+	}
+	s.tick = time.Duration(float64(time.Second) * float64(header.TimebaseNumerator) / float64(header.TimebaseDenominator))
+
+	frame, frameHeader, err := reader.ParseNextFrame()
+	if err != nil {
+		s.err = err
+	} else {
+		s.frame, s.timestamp = frame, frameHeader.Timestamp
+	}
+	return s, nil
+}
+
+func (s *ivfSource) Codec() webrtc.RTPCodecCapability {
+	return s.codec
+}
+
+func (s *ivfSource) NextSample() (media.Sample, error) {
+	if s.frame == nil {
+		return media.Sample{}, s.err
+	}
+	frame, timestamp := s.frame, s.timestamp
+
+	duration := s.tick
+	next, header, err := s.reader.ParseNextFrame()
+	if err != nil {
+		s.frame, s.err = nil, err
+	} else {
+		if header.Timestamp > timestamp {
+			duration = time.Duration(header.Timestamp-timestamp) * s.tick
+		}
+		s.frame, s.timestamp = next, header.Timestamp
+	}
+	return media.Sample{Data: frame, Duration: duration}, nil
+}
+
+type oggSource struct {
+	r io.Reader
+
+	// packets are the complete packets of the pages read so far, partial is the start of a
+	// packet that continues on the next page.
+	packets [][]byte
+	partial []byte
+}
+
+// NewOggOpusSource reads Opus packets from an Ogg file.
+func NewOggOpusSource(r io.Reader) (MediaSource, error) {
+	s := &oggSource{r: r}
+	head, err := s.nextPacket()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(head, []byte("OpusHead")) {
+		return nil, fmt.Errorf("%w: ogg stream isn't opus", ErrUnsupportedCodec)
+	}
+	return s, nil
+}
+
+func (s *oggSource) Codec() webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+}
+
+func (s *oggSource) NextSample() (media.Sample, error) {
+	for {
+		packet, err := s.nextPacket()
+		if err != nil {
+			return media.Sample{}, err
+		}
+		if len(packet) == 0 || bytes.HasPrefix(packet, []byte("OpusTags")) {
+			// the comment header isn't audio.
+			continue
+		}
+		return media.Sample{Data: packet, Duration: opusPacketDuration(packet)}, nil
+	}
+}
+
+// nextPacket returns the next packet, reading pages as needed.
+func (s *oggSource) nextPacket() ([]byte, error) {
+	for len(s.packets) == 0 {
+		if err := s.readPage(); err != nil {
+			return nil, err
+		}
+	}
+	packet := s.packets[0]
+	s.packets = s.packets[1:]
+	return packet, nil
+}
+
+// readPage splits the next page into packets with its segment table, where a packet ends at the
+// first segment shorter than 255 bytes.
+func (s *oggSource) readPage() error {
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(s.r, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:4], []byte("OggS")) {
+		return errors.New("invalid ogg page")
+	}
+	segments := make([]byte, header[26])
+	if _, err := io.ReadFull(s.r, segments); err != nil {
+		return truncated(err)
+	}
+	size := 0
+	for _, segment := range segments {
+		size += int(segment)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(s.r, payload); err != nil {
+		return truncated(err)
+	}
+	for _, segment := range segments {
+		s.partial = append(s.partial, payload[:segment]...)
+		payload = payload[segment:]
+		if segment < 255 {
+			s.packets = append(s.packets, s.partial)
+			s.partial = nil
+		}
+	}
+	return nil
+}
+
+// truncated reports a page that ends early as such rather than as the end of the file.
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// opusPacketDuration returns the duration of an Opus packet from its TOC byte, see RFC 6716
+// section 3.1.
+func opusPacketDuration(packet []byte) time.Duration {
+	config := packet[0] >> 3
+	var frame time.Duration
+	switch {
+	case config < 12:
+		// silk
+		frame = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16:
+		// hybrid
+		frame = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default:
+		// celt
+		frame = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+	frames := 1
+	switch packet[0] & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) > 1 {
+			frames = int(packet[1] & 0x3F)
+		}
+	}
+	return time.Duration(frames) * frame
+}
+
+type h264Source struct {
+	reader        *h264reader.H264Reader
+	frameDuration time.Duration
+
+	// the nal is read ahead to know whether it ends an access unit.
+	nal *h264reader.NAL
+	err error
+}
+
+// NewH264Source reads NAL units from an H.264 Annex-B stream at the given frame rate, since the
+// stream carries no timing.
+func NewH264Source(r io.Reader, frameRate float64) (MediaSource, error) {
+	if frameRate <= 0 {
+		return nil, errors.New("frame rate must be positive")
+	}
+	reader, err := h264reader.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	s := &h264Source{reader: reader, frameDuration: time.Duration(float64(time.Second) / frameRate)}
+	s.nal, s.err = reader.NextNAL()
+	return s, nil
+}
+
+func (s *h264Source) Codec() webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}
+}
+
+func (s *h264Source) NextSample() (media.Sample, error) {
+	if s.nal == nil {
+		return media.Sample{}, s.err
+	}
+	nal := s.nal
+	s.nal, s.err = s.reader.NextNAL()
+
+	// every unit of an access unit shares its timestamp, which advances after its last slice.
+	var duration time.Duration
+	if isSlice(nal) && (s.nal == nil || startsAccessUnit(s.nal)) {
+		duration = s.frameDuration
+	}
+	return media.Sample{Data: nal.Data, Duration: duration}, nil
+}
+
+// isSlice reports whether the nal is a coded slice of the primary picture.
+func isSlice(nal *h264reader.NAL) bool {
+	return nal.UnitType >= h264reader.NalUnitTypeCodedSliceNonIdr && nal.UnitType <= h264reader.NalUnitTypeCodedSliceIdr
+}
+
+// startsAccessUnit reports whether the nal begins a new access unit when it follows a slice, see
+// H.264 section 7.4.1.2.3.
+func startsAccessUnit(nal *h264reader.NAL) bool {
+	switch {
+	case isSlice(nal):
+		// the first slice of a picture has first_mb_in_slice 0, which is coded as a single set bit.
+		return len(nal.Data) > 1 && nal.Data[1]&0x80 != 0
+	case nal.UnitType >= h264reader.NalUnitTypeSEI && nal.UnitType <= h264reader.NalUnitTypeAUD:
+		return true
+	case nal.UnitType >= 14 && nal.UnitType <= 18:
+		// prefix nal, subset sps and reserved types.
+		return true
+	}
+	return false
+}
+
+type sampleSource struct {
+	codec   webrtc.RTPCodecCapability
+	samples <-chan media.Sample
+}
+
+// NewSampleSource reads samples of the codec from a channel until it's closed.
+func NewSampleSource(codec webrtc.RTPCodecCapability, samples <-chan media.Sample) MediaSource {
+	return &sampleSource{codec: codec, samples: samples}
+}
+
+func (s *sampleSource) Codec() webrtc.RTPCodecCapability {
+	return s.codec
+}
+
+func (s *sampleSource) NextSample() (media.Sample, error) {
+	sample, ok := <-s.samples
+	if !ok {
+		return media.Sample{}, io.EOF
+	}
+	return sample, nil
+}
+
+type loopSource struct {
+	MediaSource
+	r    io.ReadSeeker
+	open func(io.Reader) (MediaSource, error)
+}
+
+// Loop opens the source from r and reopens it from the start of r whenever it ends, for example
+// Loop(f, NewIVFSource).
+func Loop(r io.ReadSeeker, open func(io.Reader) (MediaSource, error)) (MediaSource, error) {
+	source, err := open(r)
+	if err != nil {
+		return nil, err
+	}
+	return &loopSource{MediaSource: source, r: r, open: open}, nil
+}
+
+func (s *loopSource) NextSample() (media.Sample, error) {
+	sample, err := s.MediaSource.NextSample()
+	if err != io.EOF {
+		return sample, err
+	}
+	if _, err := s.r.Seek(0, io.SeekStart); err != nil {
+		return media.Sample{}, err
+	}
+	if s.MediaSource, err = s.open(s.r); err != nil {
+		return media.Sample{}, err
+	}
+	return s.MediaSource.NextSample()
+}
+
+// PublishMedia publishes the sources as tracks of the stream, paced in real time by the durations
+// of their samples. It returns once every source has ended or ctx is cancelled.
+func (c *Client) PublishMedia(ctx context.Context, streamID string, sources []MediaSource, options ...PublisherConfiguration) error {
+	session, err := c.Publish(ctx, append([]PublisherConfiguration{WithStreamID(streamID)}, options...)...)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	connected := make(chan struct{})
+	session.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		if pcs == webrtc.PeerConnectionStateConnected {
+			select {
+			case <-connected:
+			default:
+				close(connected)
+			}
+		}
+	})
+
+	tracks := make([]*webrtc.TrackLocalStaticSample, len(sources))
+	for i, source := range sources {
+		codec := source.Codec()
+		id := fmt.Sprintf("%s-%d", codecKind(codec), i)
+		track, err := webrtc.NewTrackLocalStaticSample(codec, id, streamID)
+		if err != nil {
+			return err
+		}
+		rtpSender, err := session.AddTrack(track)
+		if err != nil {
+			return err
+		}
+		// read rtcp so interceptors process it.
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := rtpSender.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+		tracks[i] = track
+	}
+
+	// samples written before the connection is up are dropped, including the first keyframe.
+	select {
+	case <-connected:
+	case <-session.Done():
+		return session.Err()
+	}
+
+	errs := make(chan error, len(sources))
+	for i, source := range sources {
+		go func(track *webrtc.TrackLocalStaticSample, source MediaSource) {
+			errs <- pace(session, track, source)
+		}(tracks[i], source)
+	}
+	for range sources {
+		// a channel source may block after the session ends.
+		select {
+		case err := <-errs:
+			if err != nil {
+				return err
+			}
+		case <-session.Done():
+			return session.Err()
+		}
+	}
+	return nil
+}
+
+// pace writes the source's samples to the track as they become due until the source ends or the
+// session does. Samples are due at the sum of the preceding durations so the pace doesn't drift.
+func pace(session *Session, track *webrtc.TrackLocalStaticSample, source MediaSource) error {
+	due := time.Now()
+	for {
+		sample, err := source.NextSample()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := track.WriteSample(sample); err != nil {
+			return err
+		}
+		due = due.Add(sample.Duration)
+		if wait := time.Until(due); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-session.Done():
+				return session.Err()
+			}
+		} else if wait < -time.Second {
+			// the source stalled, don't burst to catch up.
+			zap.L().Debug("media source behind schedule", zap.String("track", track.ID()), zap.Duration("behind", -wait))
+			due = time.Now()
+		}
+	}
+}
+
+// codecKind returns "audio" or "video" for the codec.
+func codecKind(codec webrtc.RTPCodecCapability) string {
+	if strings.HasPrefix(strings.ToLower(codec.MimeType), "audio/") {
+		return "audio"
+	}
+	return "video"
+}
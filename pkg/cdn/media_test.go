@@ -0,0 +1,92 @@
+package cdn
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// oggPage builds an Ogg page holding the segments, without a checksum since it isn't verified.
+func oggPage(segments ...[]byte) []byte {
+	page := append([]byte("OggS"), make([]byte, 23)...)
+	page[26] = byte(len(segments))
+	for _, segment := range segments {
+		page = append(page, byte(len(segment)))
+	}
+	for _, segment := range segments {
+		page = append(page, segment...)
+	}
+	return page
+}
+
+func TestOggOpusSource(t *testing.T) {
+	// 20ms celt frames, one of them a packet of two frames.
+	single := append([]byte{0xF8}, bytes.Repeat([]byte{1}, 99)...)
+	double := append([]byte{0xF9}, bytes.Repeat([]byte{2}, 299)...)
+
+	var file []byte
+	file = append(file, oggPage(append([]byte("OpusHead"), make([]byte, 11)...))...)
+	file = append(file, oggPage([]byte("OpusTags"))...)
+	// the second packet continues on the next page.
+	file = append(file, oggPage(single, double[:255])...)
+	file = append(file, oggPage(double[255:], single)...)
+
+	source, err := NewOggOpusSource(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		data     []byte
+		duration time.Duration
+	}{
+		{single, 20 * time.Millisecond},
+		{double, 40 * time.Millisecond},
+		{single, 20 * time.Millisecond},
+	} {
+		sample, err := source.NextSample()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sample.Data, want.data) || sample.Duration != want.duration {
+			t.Errorf("got %d bytes lasting %s, want %d bytes lasting %s", len(sample.Data), sample.Duration, len(want.data), want.duration)
+		}
+	}
+	if _, err := source.NextSample(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestH264SourceAdvancesPerAccessUnit(t *testing.T) {
+	nals := [][]byte{
+		{0x67, 0x42},       // sps
+		{0x68, 0xCE},       // pps
+		{0x65, 0x88, 0x84}, // idr, first slice
+		{0x65, 0x40, 0x84}, // idr, second slice
+		{0x41, 0x9A, 0x02}, // non-idr, first slice
+		{0x41, 0x40, 0x02}, // non-idr, second slice
+		{0x41, 0x9A, 0x03}, // non-idr, first slice
+	}
+	var stream []byte
+	for _, nal := range nals {
+		stream = append(append(stream, 0, 0, 0, 1), nal...)
+	}
+
+	source, err := NewH264Source(bytes.NewReader(stream), 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := 40 * time.Millisecond
+	for i, want := range []time.Duration{0, 0, 0, frame, 0, frame, frame} {
+		sample, err := source.NextSample()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sample.Data, nals[i]) || sample.Duration != want {
+			t.Errorf("nal %d: got %x lasting %s, want %x lasting %s", i, sample.Data, sample.Duration, nals[i], want)
+		}
+	}
+	if _, err := source.NextSample(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
@@ -0,0 +1,180 @@
+package cdn
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/muxable/cdn/api"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrSessionClosed    = errors.New("session closed")
+	ErrConnectionFailed = errors.New("peer connection failed")
+	ErrNotSubscribing   = errors.New("not a subscribe session")
+)
+
+// Session is a publish or subscribe session. Its gRPC stream and PeerConnection end together, when
+// either fails, the caller's context is cancelled or Close is called.
+type Session struct {
+	*webrtc.PeerConnection
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// subscribe sends a request on a subscribe session's stream, nil for publish sessions.
+	subscribe func(*api.SubscribeRequest) error
+
+	mu                      sync.Mutex
+	err                     error
+	onConnectionStateChange func(webrtc.PeerConnectionState)
+	onTrackMap              func(*api.TrackMap)
+}
+
+// newSession returns a session ending when ctx is done. The stream must be opened with the
+// returned context.
+func newSession(ctx context.Context) (*Session, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Session{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		<-ctx.Done()
+		s.end(ctx.Err())
+	}()
+	return s, ctx
+}
+
+// setPeerConnection attaches the session's PeerConnection, closing it if the session already ended.
+func (s *Session) setPeerConnection(peerConnection *webrtc.PeerConnection) {
+	s.mu.Lock()
+	s.PeerConnection = peerConnection
+	ended := s.err != nil
+	s.mu.Unlock()
+	if ended {
+		peerConnection.Close()
+	}
+}
+
+// end records why the session ended and tears it down, only the first call has an effect.
+func (s *Session) end(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	peerConnection := s.PeerConnection
+	s.mu.Unlock()
+
+	s.cancel()
+	if peerConnection != nil {
+		if err := peerConnection.Close(); err != nil {
+			zap.L().Error("failed to close peer connection", zap.Error(err))
+		}
+	}
+	close(s.done)
+}
+
+// OnConnectionStateChange sets a handler called when the PeerConnection's state changes. It
+// replaces the PeerConnection's method, which the session uses to end when the connection fails.
+func (s *Session) OnConnectionStateChange(f func(webrtc.PeerConnectionState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onConnectionStateChange = f
+}
+
+// connectionStateChange ends the session once the PeerConnection fails or is closed.
+func (s *Session) connectionStateChange(pcs webrtc.PeerConnectionState) {
+	s.mu.Lock()
+	handler := s.onConnectionStateChange
+	s.mu.Unlock()
+	if handler != nil {
+		handler(pcs)
+	}
+
+	switch pcs {
+	case webrtc.PeerConnectionStateFailed:
+		// closing from within the callback would deadlock.
+		go s.end(ErrConnectionFailed)
+	case webrtc.PeerConnectionStateClosed:
+		go s.end(ErrSessionClosed)
+	}
+}
+
+// Subscribe adds a subscription to another stream to the session, its tracks are added to the same
+// PeerConnection.
+func (s *Session) Subscribe(streamID string, options ...SubscriberConfiguration) error {
+	if s.subscribe == nil {
+		return ErrNotSubscribing
+	}
+	return s.subscribe(subscriptionRequest(streamID, options))
+}
+
+// Unsubscribe ends the session's subscription to the stream, its tracks are removed.
+func (s *Session) Unsubscribe(streamID string) error {
+	if s.subscribe == nil {
+		return ErrNotSubscribing
+	}
+	return s.subscribe(&api.SubscribeRequest{
+		Operation: &api.SubscribeRequest_Unsubscription_{
+			Unsubscription: &api.SubscribeRequest_Unsubscription{StreamId: streamID},
+		},
+	})
+}
+
+// UpdateSubscription replaces the track filter of the session's subscription to the stream. The
+// server adds and removes tracks to match and renegotiates, a nil filter matches every track.
+func (s *Session) UpdateSubscription(streamID string, filter *api.TrackFilter) error {
+	if s.subscribe == nil {
+		return ErrNotSubscribing
+	}
+	return s.subscribe(&api.SubscribeRequest{
+		Operation: &api.SubscribeRequest_UpdateSubscription_{
+			UpdateSubscription: &api.SubscribeRequest_UpdateSubscription{StreamId: streamID, Filter: filter},
+		},
+	})
+}
+
+// OnTrackMap sets a handler called with the stream each transceiver carries whenever a negotiation
+// changes the subscribed tracks.
+func (s *Session) OnTrackMap(f func(*api.TrackMap)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onTrackMap = f
+}
+
+// trackMap calls the track map handler.
+func (s *Session) trackMap(trackMap *api.TrackMap) {
+	s.mu.Lock()
+	handler := s.onTrackMap
+	s.mu.Unlock()
+	if handler != nil {
+		handler(trackMap)
+	}
+}
+
+// Close ends the session, closing the stream and the PeerConnection.
+func (s *Session) Close() error {
+	s.end(ErrSessionClosed)
+	<-s.done
+	return nil
+}
+
+// Done returns a channel that's closed when the session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns nil while the session is running and why it ended afterwards: ErrSessionClosed if it
+// was closed, the context's error if it was cancelled, ErrConnectionFailed or the stream's error.
+func (s *Session) Err() error {
+	select {
+	case <-s.done:
+	default:
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
@@ -0,0 +1,308 @@
+package cdn
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// Resolver returns the nodes a Subscriber may connect to, in order of preference.
+type Resolver func(ctx context.Context) ([]string, error)
+
+// Nodes resolves to a fixed list of nodes.
+func Nodes(addrs ...string) Resolver {
+	return func(context.Context) ([]string, error) {
+		return addrs, nil
+	}
+}
+
+// Subscriber subscribes to a stream and resubscribes, with backoff, whenever the session ends. The
+// tracks it presents persist across sessions.
+type Subscriber struct {
+	resolver            Resolver
+	streamID            string
+	dialOptions         []grpc.DialOption
+	clientOptions       []ClientOption
+	subscriptionOptions []SubscriberConfiguration
+	minBackoff          time.Duration
+	maxBackoff          time.Duration
+
+	onTrack   func(*Track)
+	onConnect func(node string)
+
+	tracks     map[string]*Track
+	trackMutex sync.Mutex
+	done       chan struct{}
+}
+
+type SubscriberOption func(*Subscriber)
+
+// WithDialOptions dials nodes with the given options, defaults to insecure credentials.
+func WithDialOptions(options ...grpc.DialOption) SubscriberOption {
+	return func(s *Subscriber) {
+		s.dialOptions = append(s.dialOptions, options...)
+	}
+}
+
+// WithClientOptions creates the client of each session with the given options.
+func WithClientOptions(options ...ClientOption) SubscriberOption {
+	return func(s *Subscriber) {
+		s.clientOptions = append(s.clientOptions, options...)
+	}
+}
+
+// WithSubscription subscribes with the given configuration on every session.
+func WithSubscription(options ...SubscriberConfiguration) SubscriberOption {
+	return func(s *Subscriber) {
+		s.subscriptionOptions = append(s.subscriptionOptions, options...)
+	}
+}
+
+// WithBackoff sets the delay before retrying after every node failed. It doubles on every retry
+// from min up to max and resets once a session connects.
+func WithBackoff(min, max time.Duration) SubscriberOption {
+	return func(s *Subscriber) {
+		s.minBackoff, s.maxBackoff = min, max
+	}
+}
+
+// WithConnectHandler is called whenever a session to a node connects.
+func WithConnectHandler(handler func(node string)) SubscriberOption {
+	return func(s *Subscriber) {
+		s.onConnect = handler
+	}
+}
+
+// NewSubscriber returns a subscriber to the stream on the nodes returned by resolver.
+func NewSubscriber(resolver Resolver, streamID string, options ...SubscriberOption) *Subscriber {
+	s := &Subscriber{
+		resolver:   resolver,
+		streamID:   streamID,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+		tracks:     make(map[string]*Track),
+		done:       make(chan struct{}),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	if len(s.dialOptions) == 0 {
+		s.dialOptions = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	return s
+}
+
+// OnTrack sets a handler called once for every track of the stream. Tracks received again after a
+// reconnect continue the existing Track instead.
+func (s *Subscriber) OnTrack(f func(*Track)) {
+	s.trackMutex.Lock()
+	defer s.trackMutex.Unlock()
+	s.onTrack = f
+}
+
+// Run subscribes until ctx is cancelled, then ends the tracks and returns the context's error. It
+// may only be called once.
+func (s *Subscriber) Run(ctx context.Context) error {
+	defer close(s.done)
+
+	backoff := s.minBackoff
+	var preferred string
+	for {
+		resolved, err := s.resolver(ctx)
+		if err != nil {
+			zap.L().Warn("failed to resolve nodes", zap.Error(err))
+		}
+		var nodes []string
+		if preferred != "" {
+			nodes = append(nodes, preferred)
+			preferred = ""
+		}
+		nodes = append(nodes, resolved...)
+
+		for i := 0; i < len(nodes) && ctx.Err() == nil; i++ {
+			node := nodes[i]
+			alternate := make(chan string, 1)
+			connected := make(chan struct{})
+			session, err := s.subscribe(ctx, node, alternate, connected)
+			if err != nil {
+				zap.L().Warn("failed to subscribe", zap.String("node", node), zap.Error(err))
+				if alternate, ok := AlternateNode(err); ok {
+					// try the node the server suggested next.
+					nodes = append(nodes[:i+1], append([]string{alternate}, nodes[i+1:]...)...)
+				}
+				continue
+			}
+
+			select {
+			case <-session.Done():
+			case preferred = <-alternate:
+				// the node is draining, move to the suggested node.
+				session.Close()
+			}
+			zap.L().Info("subscription ended", zap.String("node", node), zap.Error(session.Err()))
+
+			// only back off from scratch if the session got anywhere.
+			select {
+			case <-connected:
+				backoff = s.minBackoff
+			default:
+			}
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if preferred != "" {
+			continue
+		}
+
+		// wait up to the backoff, jittered so subscribers don't return in lockstep.
+		select {
+		case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+// subscribe starts a session on node. alternate receives the node suggested if the node asks the
+// session to reconnect and connected is closed once the PeerConnection connects.
+func (s *Subscriber) subscribe(ctx context.Context, node string, alternate chan<- string, connected chan struct{}) (*Session, error) {
+	conn, err := grpc.Dial(node, s.dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	options := append(s.clientOptions[:len(s.clientOptions):len(s.clientOptions)], WithReconnectHandler(func(node string) {
+		select {
+		case alternate <- node:
+		default:
+		}
+	}))
+	client, err := NewClient(conn, options...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	session, err := client.Subscribe(ctx, s.streamID, s.subscriptionOptions...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go func() {
+		<-session.Done()
+		conn.Close()
+	}()
+
+	var once sync.Once
+	session.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		if pcs != webrtc.PeerConnectionStateConnected {
+			return
+		}
+		once.Do(func() {
+			close(connected)
+			if s.onConnect != nil {
+				s.onConnect(node)
+			}
+		})
+	})
+	session.OnTrack(func(tr *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		go s.forward(tr)
+	})
+	return session, nil
+}
+
+// forward reads the remote track into the Track with the same id until the session ends.
+func (s *Subscriber) forward(tr *webrtc.TrackRemote) {
+	key := tr.ID() + "/" + tr.RID()
+
+	s.trackMutex.Lock()
+	track, ok := s.tracks[key]
+	if !ok {
+		track = &Track{
+			id:       tr.ID(),
+			streamID: tr.StreamID(),
+			rid:      tr.RID(),
+			kind:     tr.Kind(),
+			packets:  make(chan *rtp.Packet, 256),
+			done:     s.done,
+		}
+		s.tracks[key] = track
+	}
+	onTrack := s.onTrack
+	s.trackMutex.Unlock()
+
+	track.setCodec(tr.Codec())
+	if !ok && onTrack != nil {
+		onTrack(track)
+	}
+
+	for {
+		p, _, err := tr.ReadRTP()
+		if err != nil {
+			return
+		}
+		select {
+		case track.packets <- p:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Track is a track of a Subscriber's stream. It keeps delivering packets after the subscriber
+// reconnects, sequence numbers and timestamps may jump when it does.
+type Track struct {
+	id, streamID, rid string
+	kind              webrtc.RTPCodecType
+
+	codec      webrtc.RTPCodecParameters
+	codecMutex sync.Mutex
+
+	packets chan *rtp.Packet
+	done    <-chan struct{}
+}
+
+func (t *Track) ID() string                { return t.id }
+func (t *Track) StreamID() string          { return t.streamID }
+func (t *Track) RID() string               { return t.rid }
+func (t *Track) Kind() webrtc.RTPCodecType { return t.kind }
+
+// Codec returns the codec negotiated for the track in the current session.
+func (t *Track) Codec() webrtc.RTPCodecParameters {
+	t.codecMutex.Lock()
+	defer t.codecMutex.Unlock()
+	return t.codec
+}
+
+func (t *Track) setCodec(codec webrtc.RTPCodecParameters) {
+	t.codecMutex.Lock()
+	defer t.codecMutex.Unlock()
+	t.codec = codec
+}
+
+// ReadRTP returns the next packet, blocking while the subscriber reconnects. It returns io.EOF once
+// the subscriber stops running.
+func (t *Track) ReadRTP() (*rtp.Packet, error) {
+	select {
+	case p := <-t.packets:
+		return p, nil
+	case <-t.done:
+		return nil, io.EOF
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"net"
+
+	"github.com/muxable/cdn/internal/admission"
+	"github.com/muxable/cdn/pkg/auth"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// clientAddress returns the ip address of the caller.
+func clientAddress(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// admit admits a new session. Sessions over capacity are rejected with RESOURCE_EXHAUSTED and, if
+// one is available, an alternate node in the error details. Relay peers are always admitted so the
+// distribution tree isn't cut off. A draining node admits no sessions.
+func (s *CDNServer) admit(ctx context.Context, publisher bool) (release func(), err error) {
+	if s.isDraining() {
+		return nil, s.drainingError(ctx)
+	}
+	if auth.IsRelayPeer(ctx) {
+		return func() {}, nil
+	}
+
+	addr := clientAddress(ctx)
+	if publisher {
+		release, err = s.admission.AdmitPublisher(addr)
+	} else {
+		release, err = s.admission.AdmitSubscriber(addr)
+	}
+	if err == nil {
+		return release, nil
+	}
+
+	zap.L().Warn("rejected session", zap.String("addr", addr), zap.Bool("publisher", publisher), zap.Error(err))
+
+	st := status.New(codes.ResourceExhausted, err.Error())
+	if err == admission.ErrRateLimited {
+		// another node won't help a client that is starting sessions too quickly.
+		return nil, st.Err()
+	}
+	alternate, aerr := s.alternateNode(ctx)
+	if aerr != nil {
+		zap.L().Warn("failed to find alternate node", zap.Error(aerr))
+	}
+	if alternate != "" {
+		if detailed, derr := st.WithDetails(&errdetails.ErrorInfo{
+			Reason:   "OVER_CAPACITY",
+			Domain:   "api.CDN",
+			Metadata: map[string]string{"alternate": alternate},
+		}); derr == nil {
+			st = detailed
+		}
+	}
+	return nil, st.Err()
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+	"github.com/muxable/cdn/internal/admission"
+	"github.com/muxable/cdn/internal/store"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// clientContext returns a context whose caller connects from the address.
+func clientContext(ctx context.Context, ip string) context.Context {
+	return peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}})
+}
+
+func TestAdmitRateLimited(t *testing.T) {
+	s := NewCDNServer(Configuration{LocalStore: store.NewLocalTrackStore(), Limits: admission.Limits{SessionsPerMinute: 1}})
+	ctx := clientContext(context.Background(), "192.0.2.1")
+
+	if _, err := s.admit(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.admit(ctx, false)
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted", err)
+	}
+	// another node won't help, so none is suggested.
+	if len(st.Details()) != 0 {
+		t.Errorf("got details %v, want none", st.Details())
+	}
+
+	// the limit is per address.
+	if _, err := s.admit(clientContext(context.Background(), "192.0.2.2"), false); err != nil {
+		t.Errorf("got %v from another address", err)
+	}
+}
+
+// TestAdmitAlternateNode looks up the alternate node in the directory, so it needs the Firestore
+// emulator.
+func TestAdmitAlternateNode(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// a project of its own so other tests' nodes aren't candidates.
+	client, err := firestore.NewClient(ctx, uuid.NewString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for address, node := range map[string]map[string]interface{}{
+		"10.0.0.2:50051": {"full": false, "subscribers": 5},
+		"10.0.0.3:50051": {"full": false, "subscribers": 1},
+		"10.0.0.4:50051": {"full": true, "subscribers": 0},
+	} {
+		node["address"] = address
+		node["tag"] = store.GetTag()
+		node["updatedAt"] = time.Now()
+		if _, err := client.Collection("nodes").NewDoc().Set(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewCDNServer(Configuration{
+		LocalStore:     store.NewLocalTrackStore(),
+		Firestore:      client,
+		InboundAddress: "10.0.0.1:50051",
+		Limits:         admission.Limits{MaxSubscribers: 1},
+	})
+	viewer := clientContext(ctx, "192.0.2.1")
+	if _, err := s.admit(viewer, false); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.admit(viewer, false)
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted", err)
+	}
+	if len(st.Details()) != 1 {
+		t.Fatalf("got details %v, want an ErrorInfo", st.Details())
+	}
+	info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+	if !ok {
+		t.Fatalf("got %T, want an ErrorInfo", st.Details()[0])
+	}
+	// the least loaded node that isn't full.
+	if info.Reason != "OVER_CAPACITY" || info.Metadata["alternate"] != "10.0.0.3:50051" {
+		t.Errorf("got %s with alternate %q, want OVER_CAPACITY with 10.0.0.3:50051", info.Reason, info.Metadata["alternate"])
+	}
+}
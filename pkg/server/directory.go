@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/muxable/cdn/api"
+	"github.com/muxable/cdn/internal/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ErrStreamNotFound = errors.New("stream does not exist")
+
+// observe records the latency of a directory operation and whether it failed. Missing streams
+// aren't failures.
+func observe(operation string, start time.Time, err error) {
+	metrics.DirectorySeconds.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, ErrStreamNotFound) {
+		metrics.DirectoryErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// startOperation starts a span for a directory operation on the stream. The returned function ends
+// the span and observes the operation.
+func startOperation(ctx context.Context, operation, streamID string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "directory."+operation, trace.WithSpanKind(trace.SpanKindClient))
+	if streamID != "" {
+		span.SetAttributes(streamAttribute(streamID))
+	}
+	return ctx, func(err error) {
+		observe(operation, start, err)
+		if errors.Is(err, ErrStreamNotFound) {
+			// not a failure of the directory.
+			span.SetAttributes(attribute.Bool("cdn.not_found", true))
+			err = nil
+		}
+		endSpan(span, err)
+	}
+}
+
+// lookupStream returns the directory record of the stream.
+func (s *CDNServer) lookupStream(ctx context.Context, streamID string) (_ map[string]interface{}, err error) {
+	ctx, end := startOperation(ctx, "lookupStream", streamID)
+	defer func() { end(err) }()
+
+	snapshot, err := s.config.Firestore.Collection("streams").Doc(streamID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrStreamNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.Data()["publisher"] == nil {
+		return nil, ErrStreamNotFound
+	}
+	return snapshot.Data(), nil
+}
+
+// lookupPublisher returns the inbound address of the node publishing the stream.
+func (s *CDNServer) lookupPublisher(ctx context.Context, streamID string) (string, error) {
+	record, err := s.lookupStream(ctx, streamID)
+	if err != nil {
+		return "", err
+	}
+	return record["publisher"].(string), nil
+}
+
+// listStreams returns the directory records of public streams keyed by stream id.
+func (s *CDNServer) listStreams(ctx context.Context) (_ map[string]map[string]interface{}, err error) {
+	ctx, end := startOperation(ctx, "listStreams", "")
+	defer func() { end(err) }()
+
+	// records written before policies have no visibility and firestore can't query for a missing
+	// field, so filter here.
+	snapshots, err := s.config.Firestore.Collection("streams").Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]map[string]interface{})
+	for _, snapshot := range snapshots {
+		record := snapshot.Data()
+		if policyFromRecord(record).Visibility != api.StreamPolicy_PUBLIC {
+			continue
+		}
+		records[snapshot.Ref.ID] = record
+	}
+	return records, nil
+}
+
+// setPolicy updates the policy in the stream's directory record.
+func (s *CDNServer) setPolicy(ctx context.Context, streamID string, policy *api.StreamPolicy) (err error) {
+	ctx, end := startOperation(ctx, "setPolicy", streamID)
+	defer func() { end(err) }()
+
+	record := policyToRecord(policy)
+	record["updatedAt"] = firestore.ServerTimestamp
+	if _, err = s.config.Firestore.Collection("streams").Doc(streamID).Set(ctx, record, firestore.MergeAll); err != nil {
+		return err
+	}
+	s.policyMutex.Lock()
+	delete(s.policies, streamID)
+	s.policyMutex.Unlock()
+	return nil
+}
+
+// claimTrack declares this node as the publisher of the stream, registers the track id and stores
+// the stream's policy, if non-nil, and announced metadata.
+func (s *CDNServer) claimTrack(ctx context.Context, streamID, trackID string, policy *api.StreamPolicy, announce *api.Announce) (err error) {
+	ctx, end := startOperation(ctx, "claimTrack", streamID)
+	defer func() { end(err) }()
+
+	ref := s.config.Firestore.Collection("streams").Doc(streamID)
+
+	return s.config.Firestore.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil && doc == nil {
+			return err
+		}
+		if doc.Exists() && doc.Data()["publisher"] != s.config.InboundAddress {
+			return errors.New("stream already published")
+		}
+		// keep the stored policy if the publisher didn't set one.
+		record := map[string]interface{}{}
+		if policy != nil {
+			record = policyToRecord(policy)
+		}
+		if announce != nil || !doc.Exists() || doc.Data()["publisher"] != s.config.InboundAddress {
+			// a new publisher doesn't inherit the previous one's metadata.
+			for key, value := range announceToRecord(announce) {
+				record[key] = value
+			}
+		}
+		record["publisher"] = s.config.InboundAddress
+		record["trackIds"] = firestore.ArrayUnion(trackID)
+		record["updatedAt"] = firestore.ServerTimestamp
+		return tx.Set(ref, record, mergeFields(record))
+	})
+}
+
+// setAnnounce replaces the metadata in the stream's directory record, unless the stream has since
+// been claimed by another node.
+func (s *CDNServer) setAnnounce(ctx context.Context, streamID string, announce *api.Announce) (err error) {
+	ctx, end := startOperation(ctx, "setAnnounce", streamID)
+	defer func() { end(err) }()
+
+	ref := s.config.Firestore.Collection("streams").Doc(streamID)
+
+	return s.config.Firestore.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if doc.Data()["publisher"] != s.config.InboundAddress {
+			return nil
+		}
+		record := announceToRecord(announce)
+		record["updatedAt"] = firestore.ServerTimestamp
+		return tx.Set(ref, record, mergeFields(record))
+	})
+}
+
+// announceToRecord returns the metadata fields of a directory record.
+func announceToRecord(announce *api.Announce) map[string]interface{} {
+	metadata := announce.GetMetadata()
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	trackLabels := announce.GetTrackLabels()
+	if trackLabels == nil {
+		trackLabels = map[string]string{}
+	}
+	return map[string]interface{}{
+		"metadata":    metadata,
+		"trackLabels": trackLabels,
+	}
+}
+
+// mergeFields merges the record's top-level fields, unlike MergeAll it replaces maps rather than
+// merging their keys.
+func mergeFields(record map[string]interface{}) firestore.SetOption {
+	fields := make([]firestore.FieldPath, 0, len(record))
+	for key := range record {
+		fields = append(fields, firestore.FieldPath{key})
+	}
+	return firestore.Merge(fields...)
+}
+
+// releaseTrack removes the track id from the stream's directory record, unless the stream has
+// since been claimed by another node.
+func (s *CDNServer) releaseTrack(streamID, trackID string) {
+	// use bg context to avoid cancellation.
+	ctx, end := startOperation(context.Background(), "releaseTrack", streamID)
+	ref := s.config.Firestore.Collection("streams").Doc(streamID)
+	err := s.config.Firestore.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if doc.Data()["publisher"] != s.config.InboundAddress {
+			return nil
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "trackIds", Value: firestore.ArrayRemove(trackID)},
+			{Path: "updatedAt", Value: firestore.ServerTimestamp},
+		})
+	})
+	end(err)
+	if err != nil {
+		zap.L().Error("failed to release track", zap.Error(err))
+	}
+}
+
+// releaseStreams removes this node as the publisher of its streams so they can be claimed by
+// another node.
+func (s *CDNServer) releaseStreams(ctx context.Context) (err error) {
+	ctx, end := startOperation(ctx, "releaseStreams", "")
+	defer func() { end(err) }()
+
+	snapshots, err := s.config.Firestore.Collection("streams").Where("publisher", "==", s.config.InboundAddress).Documents(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		if _, err := snapshot.Ref.Update(ctx, []firestore.Update{
+			{Path: "publisher", Value: firestore.Delete},
+			{Path: "trackIds", Value: firestore.Delete},
+			{Path: "updatedAt", Value: firestore.ServerTimestamp},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
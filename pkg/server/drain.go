@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/muxable/cdn/api"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ErrDraining = errors.New("node is draining")
+
+const (
+	// defaultDrainPeriod is how long a draining node waits for sessions to move before shutting
+	// down if no period is configured.
+	defaultDrainPeriod = 20 * time.Second
+
+	// relinkTimeout bounds how long a relay waits for a drained stream to be published again.
+	relinkTimeout = 30 * time.Second
+)
+
+// Drain stops the node from accepting sessions, releases the streams published on it in the
+// directory so they can be published on another node, and asks connected publishers and
+// subscribers to reconnect elsewhere.
+func (s *CDNServer) Drain(ctx context.Context) {
+	s.drainOnce.Do(func() {
+		zap.L().Info("draining node")
+		close(s.draining)
+
+		alternate, err := s.alternateNode(ctx)
+		if err != nil {
+			zap.L().Warn("failed to find alternate node", zap.Error(err))
+		}
+		s.alternate = alternate
+
+		if err := s.releaseStreams(ctx); err != nil {
+			zap.L().Error("failed to release streams", zap.Error(err))
+		}
+		s.stopIngests()
+		close(s.reconnect)
+	})
+}
+
+// isDraining returns true once Drain was called.
+func (s *CDNServer) isDraining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// drainingError returns the error new sessions are rejected with while draining, suggesting an
+// alternate node if one is known.
+func (s *CDNServer) drainingError(ctx context.Context) error {
+	st := status.New(codes.Unavailable, ErrDraining.Error())
+	alternate, err := s.alternateNode(ctx)
+	if err != nil {
+		zap.L().Warn("failed to find alternate node", zap.Error(err))
+	}
+	if alternate != "" {
+		if detailed, derr := st.WithDetails(&errdetails.ErrorInfo{
+			Reason:   "DRAINING",
+			Domain:   "api.CDN",
+			Metadata: map[string]string{"alternate": alternate},
+		}); derr == nil {
+			st = detailed
+		}
+	}
+	return st.Err()
+}
+
+// reconnectMessage returns the message asking a session to reconnect to another node.
+func (s *CDNServer) reconnectMessage() *api.Reconnect {
+	return &api.Reconnect{Alternate: s.alternate}
+}
+
+// relink relays the stream again once its publisher has moved to another node. Subscribers of the
+// stream on this node receive the new tracks.
+func (s *CDNServer) relink(streamID string) {
+	s.streamMutex.Lock()
+	delete(s.linkedStreamIDs, streamID)
+	s.streamMutex.Unlock()
+
+	for deadline := time.Now().Add(relinkTimeout); time.Now().Before(deadline) && !s.isDraining(); time.Sleep(time.Second) {
+		if err := s.link(context.Background(), streamID); err == nil {
+			zap.L().Info("relinked stream", zap.String("streamId", streamID))
+			return
+		}
+	}
+	zap.L().Warn("failed to relink stream", zap.String("streamId", streamID))
+}
+
+// waitDrained waits until no sessions remain or the period elapses.
+func (s *CDNServer) waitDrained(period time.Duration) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	deadline := time.After(period)
+	for {
+		if load := s.admission.Load(); load.Publishers == 0 && load.Subscribers == 0 {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return
+		}
+	}
+}
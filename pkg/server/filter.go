@@ -0,0 +1,35 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/muxable/cdn/api"
+	"github.com/muxable/cdn/internal/store"
+)
+
+// trackFilter returns the store filter matching the tracks selected by filter, or nil if it selects
+// every track.
+func trackFilter(filter *api.TrackFilter) store.TrackFilter {
+	if len(filter.GetKinds()) == 0 && len(filter.GetTrackIds()) == 0 && len(filter.GetRids()) == 0 && len(filter.GetMimeTypes()) == 0 {
+		return nil
+	}
+	return func(tr store.TrackSource) bool {
+		return matchesAny(filter.Kinds, tr.Kind().String()) &&
+			matchesAny(filter.TrackIds, tr.ID()) &&
+			matchesAny(filter.Rids, tr.RID()) &&
+			matchesAny(filter.MimeTypes, tr.Codec().MimeType)
+	}
+}
+
+// matchesAny reports whether value case-insensitively equals one of values, or values is empty.
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
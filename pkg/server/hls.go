@@ -0,0 +1,37 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/muxable/cdn/internal/hls"
+	"github.com/muxable/cdn/internal/store"
+	"github.com/muxable/cdn/pkg/auth"
+	"google.golang.org/grpc/status"
+)
+
+// HLSHandler returns an http handler that serves streams as LL-HLS for non-WebRTC viewers.
+// A stream is only packaged while it has HLS viewers. Viewers authenticate with a token query
+// parameter or an Authorization header, and are checked on every request.
+func (s *CDNServer) HLSHandler() http.Handler {
+	return hls.NewServer(func(ctx context.Context, streamID string) (chan *store.TrackLocal, error) {
+		if err := s.link(context.Background(), streamID); err != nil {
+			return nil, err
+		}
+		return s.config.LocalStore.Subscribe(ctx, streamID), nil
+	}, func(r *http.Request, streamID, token string) error {
+		ctx := r.Context()
+		if s.config.Authorizer != nil {
+			var err error
+			if ctx, err = auth.RequestContext(r, s.config.Authorizer); err != nil {
+				return errors.New(status.Convert(err).Message())
+			}
+		}
+		if _, err := s.authorizeViewer(ctx, streamID, token); err != nil {
+			// strip the grpc status for http viewers.
+			return errors.New(status.Convert(err).Message())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"net"
+
+	"github.com/muxable/cdn/api"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// ICEOptions configures how the node's PeerConnections gather ICE candidates.
+type ICEOptions struct {
+	// PortMin and PortMax restrict the UDP ports of host candidates, zero allows any port.
+	PortMin, PortMax uint16
+
+	// NAT1To1IPs are the public IPs of the node when it is behind a 1:1 NAT, such as a container.
+	// They replace the addresses of candidates of NAT1To1CandidateType, defaults to host.
+	NAT1To1IPs           []string
+	NAT1To1CandidateType webrtc.ICECandidateType
+
+	// NetworkTypes restricts candidates to the given network types, empty allows all.
+	NetworkTypes []webrtc.NetworkType
+	// Interfaces restricts host candidates to the named network interfaces, empty allows all.
+	Interfaces []string
+	// RelayOnly only gathers relay candidates for publishers and subscribers.
+	RelayOnly bool
+
+	// UDPMuxAddress, if set, serves the host candidates of every PeerConnection from a single UDP
+	// port bound to this address instead of a port per connection. PortMin and PortMax then only
+	// apply to srflx candidates.
+	UDPMuxAddress string
+	// TCPMuxAddress, if set, also accepts ICE-TCP on a single port bound to this address.
+	TCPMuxAddress string
+}
+
+// SettingEngine returns the setting engine applying the options.
+func (o *ICEOptions) SettingEngine() (webrtc.SettingEngine, error) {
+	settingEngine := webrtc.SettingEngine{}
+	if o.PortMin != 0 || o.PortMax != 0 {
+		if err := settingEngine.SetEphemeralUDPPortRange(o.PortMin, o.PortMax); err != nil {
+			return settingEngine, err
+		}
+	}
+	if len(o.NAT1To1IPs) > 0 {
+		candidateType := o.NAT1To1CandidateType
+		if candidateType == 0 {
+			candidateType = webrtc.ICECandidateTypeHost
+		}
+		settingEngine.SetNAT1To1IPs(o.NAT1To1IPs, candidateType)
+	}
+	if len(o.NetworkTypes) > 0 {
+		settingEngine.SetNetworkTypes(o.NetworkTypes)
+	}
+	if len(o.Interfaces) > 0 {
+		interfaces := make(map[string]bool)
+		for _, name := range o.Interfaces {
+			interfaces[name] = true
+		}
+		settingEngine.SetInterfaceFilter(func(name string) bool {
+			return interfaces[name]
+		})
+	}
+	return settingEngine, nil
+}
+
+// ListenMux binds the UDP and TCP mux ports, if configured, and sets them on the setting engine so
+// all PeerConnections share them. The returned function closes the ports.
+func (o *ICEOptions) ListenMux(settingEngine *webrtc.SettingEngine) (func(), error) {
+	var closers []func() error
+	closeAll := func() {
+		for _, close := range closers {
+			close()
+		}
+	}
+	if o.UDPMuxAddress != "" {
+		addr, err := net.ResolveUDPAddr("udp", o.UDPMuxAddress)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		// the udp mux doesn't own the socket so close both.
+		mux := webrtc.NewICEUDPMux(nil, conn)
+		closers = append(closers, mux.Close, conn.Close)
+		settingEngine.SetICEUDPMux(mux)
+	}
+	if o.TCPMuxAddress != "" {
+		listener, err := net.Listen("tcp", o.TCPMuxAddress)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		mux := webrtc.NewICETCPMux(nil, listener, 8)
+		closers = append(closers, mux.Close)
+		settingEngine.SetICETCPMux(mux)
+	}
+	return closeAll, nil
+}
+
+// newAPI returns a webrtc API with the default codecs and interceptors, as used by
+// webrtc.NewPeerConnection, and the given settings.
+func newAPI(settingEngine webrtc.SettingEngine) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry), webrtc.WithSettingEngine(settingEngine)), nil
+}
+
+// iceServers returns the ICE servers advertised to a new session: the node's own ICE servers and
+// its TURN server, if any, with credentials for the session.
+func (s *CDNServer) iceServers() ([]*api.IceServer, error) {
+	iceServers := s.config.WebRTCConfiguration.ICEServers
+	if s.config.TURNServer != nil {
+		turnServer, err := s.config.TURNServer.ICEServer()
+		if err != nil {
+			return nil, err
+		}
+		iceServers = append(iceServers[:len(iceServers):len(iceServers)], turnServer)
+	}
+	advertised := make([]*api.IceServer, 0, len(iceServers))
+	for _, iceServer := range iceServers {
+		// oauth credentials can't be advertised.
+		credential, _ := iceServer.Credential.(string)
+		advertised = append(advertised, &api.IceServer{
+			Urls:       iceServer.URLs,
+			Username:   iceServer.Username,
+			Credential: credential,
+		})
+	}
+	return advertised, nil
+}
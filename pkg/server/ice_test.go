@@ -0,0 +1,352 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/stun"
+	"github.com/pion/webrtc/v3"
+)
+
+// muxSessions is how many PeerConnections are connected through each mux.
+const muxSessions = 10
+
+// loopbackICEOptions advertises host candidates on loopback, pion doesn't gather loopback addresses
+// itself.
+func loopbackICEOptions(networkType webrtc.NetworkType) ICEOptions {
+	return ICEOptions{
+		NAT1To1IPs:   []string{"127.0.0.1"},
+		NetworkTypes: []webrtc.NetworkType{networkType},
+	}
+}
+
+// listenMux returns an API whose PeerConnections share the mux ports of the options.
+func listenMux(t *testing.T, options ICEOptions) *webrtc.API {
+	settingEngine, err := options.SettingEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeMux, err := options.ListenMux(&settingEngine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeMux)
+	api, err := newAPI(settingEngine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api
+}
+
+// connectSessions connects muxSessions sessions concurrently and checks that the node used a single
+// local port for all of them.
+func connectSessions(t *testing.T, connect func() (uint16, error)) {
+	var wg sync.WaitGroup
+	ports := make(chan uint16, muxSessions)
+	for i := 0; i < muxSessions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			port, err := connect()
+			if err != nil {
+				t.Errorf("failed to connect session: %v", err)
+				return
+			}
+			ports <- port
+		}()
+	}
+	wg.Wait()
+	close(ports)
+
+	count := make(map[uint16]int)
+	for port := range ports {
+		count[port]++
+	}
+	if len(count) != 1 {
+		t.Errorf("sessions connected on ports %v, want a single port", count)
+	}
+}
+
+func TestListenMuxUDP(t *testing.T) {
+	nodeOptions := loopbackICEOptions(webrtc.NetworkTypeUDP4)
+	nodeOptions.UDPMuxAddress = "127.0.0.1:0"
+	node := listenMux(t, nodeOptions)
+
+	// the udp mux tells sessions apart by remote address so peers can't share one too.
+	peer := listenMux(t, loopbackICEOptions(webrtc.NetworkTypeUDP4))
+
+	connectSessions(t, func() (uint16, error) { return connectUDP(node, peer) })
+}
+
+func TestListenMuxTCP(t *testing.T) {
+	nodeOptions := loopbackICEOptions(webrtc.NetworkTypeTCP4)
+	nodeOptions.TCPMuxAddress = "127.0.0.1:0"
+	node := listenMux(t, nodeOptions)
+
+	connectSessions(t, func() (uint16, error) { return connectTCP(node) })
+}
+
+// connectUDP connects a peer to the node and returns the node's local port of the selected pair.
+func connectUDP(node, peer *webrtc.API) (uint16, error) {
+	pair, err := connectPeers(node, peer, webrtc.Configuration{})
+	if err != nil {
+		return 0, err
+	}
+	return pair.Local.Port, nil
+}
+
+// connectPeers connects a peer with the given configuration to the node and returns the node's
+// selected candidate pair.
+func connectPeers(node, peer *webrtc.API, configuration webrtc.Configuration) (*webrtc.ICECandidatePair, error) {
+	nodePeerConnection, err := node.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	defer nodePeerConnection.Close()
+
+	peerConnection, err := peer.NewPeerConnection(configuration)
+	if err != nil {
+		return nil, err
+	}
+	defer peerConnection.Close()
+
+	opened := make(chan struct{})
+	nodePeerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnOpen(func() { close(opened) })
+	})
+	if _, err := peerConnection.CreateDataChannel("mux", nil); err != nil {
+		return nil, err
+	}
+
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	gathered := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(offer); err != nil {
+		return nil, err
+	}
+	<-gathered
+	if err := nodePeerConnection.SetRemoteDescription(*peerConnection.LocalDescription()); err != nil {
+		return nil, err
+	}
+	answer, err := nodePeerConnection.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+	gathered = webrtc.GatheringCompletePromise(nodePeerConnection)
+	if err := nodePeerConnection.SetLocalDescription(answer); err != nil {
+		return nil, err
+	}
+	<-gathered
+	if err := peerConnection.SetRemoteDescription(*nodePeerConnection.LocalDescription()); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-opened:
+	case <-time.After(10 * time.Second):
+		return nil, errors.New("timed out connecting")
+	}
+	return selectedPair(nodePeerConnection)
+}
+
+// connectTCP connects to the node's passive tcp candidate and returns the node's local port of the
+// selected pair. pion doesn't gather active tcp candidates, so the test plays the controlling agent
+// over the tcp connection itself.
+func connectTCP(node *webrtc.API) (uint16, error) {
+	nodePeerConnection, err := node.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return 0, err
+	}
+	defer nodePeerConnection.Close()
+
+	// the peer only provides the offer and its ice credentials.
+	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return 0, err
+	}
+	defer peerConnection.Close()
+	if _, err := peerConnection.CreateDataChannel("mux", nil); err != nil {
+		return 0, err
+	}
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	connected := make(chan struct{})
+	var connectedOnce sync.Once
+	nodePeerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateConnected {
+			connectedOnce.Do(func() { close(connected) })
+		}
+	})
+
+	if err := nodePeerConnection.SetRemoteDescription(offer); err != nil {
+		return 0, err
+	}
+	answer, err := nodePeerConnection.CreateAnswer(nil)
+	if err != nil {
+		return 0, err
+	}
+	gathered := webrtc.GatheringCompletePromise(nodePeerConnection)
+	if err := nodePeerConnection.SetLocalDescription(answer); err != nil {
+		return 0, err
+	}
+	<-gathered
+
+	peerUfrag, peerPwd, _, err := iceParameters(offer)
+	if err != nil {
+		return 0, err
+	}
+	nodeUfrag, nodePwd, candidates, err := iceParameters(*nodePeerConnection.LocalDescription())
+	if err != nil {
+		return 0, err
+	}
+	var address string
+	for _, candidate := range candidates {
+		if candidate.NetworkType() == ice.NetworkTypeTCP4 && candidate.TCPType() == ice.TCPTypePassive {
+			address = net.JoinHostPort(candidate.Address(), strconv.Itoa(candidate.Port()))
+		}
+	}
+	if address == "" {
+		return 0, errors.New("node did not gather a passive tcp candidate")
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// answer the node's connectivity checks.
+	go func() {
+		for {
+			req, err := readSTUN(conn)
+			if err != nil {
+				return
+			}
+			if req == nil || req.Type != stun.BindingRequest {
+				continue
+			}
+			local := conn.LocalAddr().(*net.TCPAddr)
+			res, err := stun.Build(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: local.IP, Port: local.Port},
+				stun.NewShortTermIntegrity(peerPwd),
+				stun.Fingerprint)
+			if err != nil {
+				return
+			}
+			if err := writeSTUN(conn, res); err != nil {
+				return
+			}
+		}
+	}()
+
+	// check the pair, then nominate it once the node has checked it too.
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(10 * time.Second)
+	for nominate := false; ; nominate = true {
+		setters := []stun.Setter{stun.BindingRequest, stun.TransactionID,
+			stun.NewUsername(nodeUfrag + ":" + peerUfrag),
+			ice.AttrControlling(1),
+			ice.PriorityAttr(1)}
+		if nominate {
+			setters = append(setters, ice.UseCandidate())
+		}
+		setters = append(setters, stun.NewShortTermIntegrity(nodePwd), stun.Fingerprint)
+		req, err := stun.Build(setters...)
+		if err != nil {
+			return 0, err
+		}
+		if err := writeSTUN(conn, req); err != nil {
+			return 0, err
+		}
+		select {
+		case <-connected:
+			pair, err := selectedPair(nodePeerConnection)
+			if err != nil {
+				return 0, err
+			}
+			return pair.Local.Port, nil
+		case <-ticker.C:
+		case <-timeout:
+			return 0, errors.New("timed out connecting")
+		}
+	}
+}
+
+// selectedPair returns the selected candidate pair.
+func selectedPair(peerConnection *webrtc.PeerConnection) (*webrtc.ICECandidatePair, error) {
+	pair, err := peerConnection.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, errors.New("no selected candidate pair")
+	}
+	return pair, nil
+}
+
+// iceParameters returns the ice credentials and candidates of the first media section.
+func iceParameters(description webrtc.SessionDescription) (ufrag, pwd string, candidates []ice.Candidate, err error) {
+	parsed, err := description.Unmarshal()
+	if err != nil {
+		return "", "", nil, err
+	}
+	if len(parsed.MediaDescriptions) == 0 {
+		return "", "", nil, errors.New("no media sections")
+	}
+	media := parsed.MediaDescriptions[0]
+	ufrag, _ = media.Attribute("ice-ufrag")
+	pwd, _ = media.Attribute("ice-pwd")
+	for _, attribute := range media.Attributes {
+		if attribute.Key != "candidate" {
+			continue
+		}
+		candidate, err := ice.UnmarshalCandidate(attribute.Value)
+		if err != nil {
+			return "", "", nil, err
+		}
+		candidates = append(candidates, candidate)
+	}
+	return ufrag, pwd, candidates, nil
+}
+
+// readSTUN reads a framed packet, returning nil if it isn't a STUN message.
+func readSTUN(conn net.Conn) (*stun.Message, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	if !stun.IsMessage(buf) {
+		return nil, nil
+	}
+	m := &stun.Message{Raw: buf}
+	if err := m.Decode(); err != nil {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// writeSTUN writes a STUN message framed as in RFC 4571.
+func writeSTUN(conn net.Conn, m *stun.Message) error {
+	buf := make([]byte, 2+len(m.Raw))
+	binary.BigEndian.PutUint16(buf, uint16(len(m.Raw)))
+	copy(buf[2:], m.Raw)
+	_, err := conn.Write(buf)
+	return err
+}
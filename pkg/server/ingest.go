@@ -0,0 +1,285 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/muxable/cdn/api"
+	"github.com/muxable/cdn/internal/metrics"
+	"github.com/muxable/cdn/internal/rtsp"
+	"github.com/muxable/cdn/internal/store"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	ErrIngestNotFound      = errors.New("ingest not found")
+	ErrIngestAddressDenied = errors.New("ingest or push address is loopback or link-local")
+)
+
+// ingestDialer refuses loopback and link-local addresses so ingests and pushes can't reach the node's own
+// services or cloud metadata endpoints. The check runs on the resolved address to defeat DNS
+// rebinding.
+var ingestDialer = &net.Dialer{
+	Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || isLocalIP(ip) {
+			return ErrIngestAddressDenied
+		}
+		return nil
+	},
+}
+
+// checkDialHost fails with ErrIngestAddressDenied if ingestDialer would refuse any address host
+// resolves to. Resolution errors are left to the dial.
+func checkDialHost(ctx context.Context, host string) error {
+	if ingestDialer.Control == nil {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if err := ingestDialer.Control("tcp", net.JoinHostPort(addr.IP.String(), "0"), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isLocalIP reports whether ip is only reachable from the node itself or its link.
+func isLocalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+}
+
+// rtspTrack exposes an rtsp track under the stream id it's ingested as.
+type rtspTrack struct {
+	*rtsp.Track
+	streamID string
+}
+
+func (t *rtspTrack) StreamID() string {
+	return t.streamID
+}
+
+func (t *rtspTrack) RID() string {
+	return ""
+}
+
+var _ store.TrackSource = (*rtspTrack)(nil)
+
+// ingest is an RTSP stream pulled by this node.
+type ingest struct {
+	sync.Mutex
+
+	ID        string
+	StreamID  string
+	URL       string
+	TrackIDs  []string
+	StartedAt time.Time
+	StoppedAt time.Time
+	LastError string
+
+	client *rtsp.Client
+	// done is closed once the session ended and the tracks were released.
+	done chan struct{}
+}
+
+// Ingest pulls an RTSP stream and publishes its tracks from this node as the given stream id.
+func (s *CDNServer) Ingest(ctx context.Context, req *api.IngestRequest) (*api.IngestResponse, error) {
+	if err := s.authorizeAdmin(ctx, req.StreamId); err != nil {
+		return nil, err
+	}
+
+	release, err := s.admit(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := rtsp.Dial(ctx, req.Url, ingestDialer)
+	if errors.Is(err, ErrIngestAddressDenied) {
+		release()
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	trackIDs := make([]string, len(client.Tracks))
+	for i, track := range client.Tracks {
+		// declare us as the publisher of this stream.
+		if err := s.claimTrack(ctx, req.StreamId, track.ID(), req.Policy, nil); err != nil {
+			client.Close()
+			release()
+			return nil, err
+		}
+		trackIDs[i] = track.ID()
+	}
+
+	if err := client.Play(); err != nil {
+		client.Close()
+		release()
+		return nil, err
+	}
+
+	s.streamMutex.Lock()
+	s.linkedStreamIDs[req.StreamId] = true
+	s.streamMutex.Unlock()
+
+	for _, track := range client.Tracks {
+		// save the track in the local store.
+		if err := s.config.LocalStore.AddTrack(&store.TrackRemote{TrackSource: &rtspTrack{Track: track, streamID: req.StreamId}}); err != nil {
+			zap.L().Error("failed to add track", zap.Error(err))
+		}
+	}
+
+	in := &ingest{
+		ID:        uuid.NewString(),
+		StreamID:  req.StreamId,
+		URL:       req.Url,
+		TrackIDs:  trackIDs,
+		StartedAt: time.Now(),
+		client:    client,
+		done:      make(chan struct{}),
+	}
+	s.ingestMutex.Lock()
+	s.ingests[in.ID] = in
+	s.ingestMutex.Unlock()
+
+	zap.L().Info("ingesting rtsp stream", zap.String("streamId", req.StreamId), zap.String("ingestId", in.ID), zap.Strings("trackIds", trackIDs))
+
+	metrics.Publishers.WithLabelValues(req.StreamId).Inc()
+
+	go func() {
+		defer close(in.done)
+		defer release()
+		defer metrics.Publishers.WithLabelValues(req.StreamId).Dec()
+		err := client.Wait()
+		if err != nil && err != io.EOF {
+			zap.L().Warn("rtsp session ended", zap.String("streamId", req.StreamId), zap.Error(err))
+		}
+		in.Lock()
+		in.StoppedAt = time.Now()
+		if err != nil && err != io.EOF {
+			in.LastError = err.Error()
+		}
+		in.Unlock()
+		for _, trackID := range trackIDs {
+			s.releaseTrack(req.StreamId, trackID)
+		}
+
+		// keep the finished ingest listed for a while so its error can be inspected.
+		time.AfterFunc(finishedRetention, func() {
+			s.ingestMutex.Lock()
+			delete(s.ingests, in.ID)
+			s.ingestMutex.Unlock()
+		})
+	}()
+
+	return &api.IngestResponse{TrackIds: trackIDs, IngestId: in.ID}, nil
+}
+
+// StopIngest tears down an ingest's RTSP session and unpublishes its tracks.
+func (s *CDNServer) StopIngest(ctx context.Context, req *api.StopIngestRequest) (*api.IngestSession, error) {
+	s.ingestMutex.Lock()
+	in, ok := s.ingests[req.IngestId]
+	s.ingestMutex.Unlock()
+	if !ok {
+		return nil, status.Error(codes.NotFound, ErrIngestNotFound.Error())
+	}
+	if err := s.authorizeAdmin(ctx, in.StreamID); err != nil {
+		return nil, err
+	}
+
+	if err := in.client.Close(); err != nil {
+		zap.L().Warn("failed to close rtsp session", zap.Error(err))
+	}
+	// the session ends once the read loop notices the closed connection.
+	<-in.done
+
+	zap.L().Info("stopped ingest", zap.String("streamId", in.StreamID), zap.String("ingestId", in.ID))
+
+	return ingestToProto(in), nil
+}
+
+// ListIngests lists the ingests started on this node of streams the caller administers. Finished
+// ingests are listed for finishedRetention.
+func (s *CDNServer) ListIngests(ctx context.Context, req *api.ListIngestsRequest) (*api.ListIngestsResponse, error) {
+	s.ingestMutex.Lock()
+	defer s.ingestMutex.Unlock()
+
+	res := &api.ListIngestsResponse{}
+	for _, in := range s.ingests {
+		if req.StreamId != "" && in.StreamID != req.StreamId {
+			continue
+		}
+		if s.authorizeAdmin(ctx, in.StreamID) != nil {
+			continue
+		}
+		res.Ingests = append(res.Ingests, ingestToProto(in))
+	}
+	sort.Slice(res.Ingests, func(i, j int) bool {
+		return res.Ingests[i].StartedAt.AsTime().Before(res.Ingests[j].StartedAt.AsTime())
+	})
+	return res, nil
+}
+
+// stopIngests closes every active ingest, they can't move to another node.
+func (s *CDNServer) stopIngests() {
+	s.ingestMutex.Lock()
+	defer s.ingestMutex.Unlock()
+
+	for _, in := range s.ingests {
+		in.Lock()
+		active := in.StoppedAt.IsZero()
+		in.Unlock()
+		if !active {
+			continue
+		}
+		if err := in.client.Close(); err != nil {
+			zap.L().Warn("failed to close rtsp session", zap.String("ingestId", in.ID), zap.Error(err))
+		}
+	}
+}
+
+func ingestToProto(in *ingest) *api.IngestSession {
+	in.Lock()
+	defer in.Unlock()
+	return &api.IngestSession{
+		Id:        in.ID,
+		StreamId:  in.StreamID,
+		Url:       redactCredentials(in.URL),
+		TrackIds:  in.TrackIDs,
+		Active:    in.StoppedAt.IsZero(),
+		LastError: in.LastError,
+		StartedAt: timestamppb.New(in.StartedAt),
+		StoppedAt: optionalTimestamp(in.StoppedAt),
+	}
+}
+
+// redactCredentials hides the password of a url.
+func redactCredentials(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "****")
+	}
+	return u.String()
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+	"github.com/muxable/cdn/api"
+	"github.com/muxable/cdn/internal/rtsp/rtsptest"
+	"github.com/muxable/cdn/internal/store"
+	"github.com/muxable/cdn/pkg/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// relayPeerContext returns a context whose caller presented a verified client certificate.
+func relayPeerContext(ctx context.Context) context.Context {
+	return peer.NewContext(ctx, &peer.Peer{
+		Addr:     &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}},
+	})
+}
+
+func TestIngestRequiresAdmin(t *testing.T) {
+	s := NewCDNServer(Configuration{LocalStore: store.NewLocalTrackStore()})
+
+	_, err := s.Ingest(context.Background(), &api.IngestRequest{StreamId: "camera", Url: "rtsp://192.0.2.1/stream"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got %v, want PermissionDenied", err)
+	}
+
+	s = NewCDNServer(Configuration{LocalStore: store.NewLocalTrackStore(), Authorizer: auth.NewHMACAuthorizer([]byte("secret"))})
+	publisher := auth.NewContext(context.Background(), &auth.Claims{Roles: []auth.Role{auth.RolePublish}, StreamIDs: []string{"camera"}})
+	_, err = s.Ingest(publisher, &api.IngestRequest{StreamId: "camera", Url: "rtsp://192.0.2.1/stream"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got %v, want PermissionDenied", err)
+	}
+}
+
+func TestIngestRefusesLocalTargets(t *testing.T) {
+	server, err := rtsptest.NewServer("../../test/input.ivf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	s := NewCDNServer(Configuration{LocalStore: store.NewLocalTrackStore(), Authorizer: auth.NewHMACAuthorizer([]byte("secret"))})
+	admin := auth.NewContext(context.Background(), &auth.Claims{Roles: []auth.Role{auth.RoleAdmin}, StreamIDs: []string{"camera"}})
+
+	for _, url := range []string{server.URL, "rtsp://[::1]:554/stream", "rtsp://169.254.169.254/stream"} {
+		_, err := s.Ingest(admin, &api.IngestRequest{StreamId: "camera", Url: url})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("%s: got %v, want InvalidArgument", url, err)
+		}
+	}
+}
+
+// TestIngest publishes the test server's stream through the directory, so it needs the Firestore
+// emulator.
+func TestIngest(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+
+	// the test server listens on loopback.
+	dialer := ingestDialer
+	ingestDialer = &net.Dialer{}
+	defer func() { ingestDialer = dialer }()
+
+	server, err := rtsptest.NewServer("../../test/input.ivf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := firestore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	local := store.NewLocalTrackStore()
+	s := NewCDNServer(Configuration{LocalStore: local, Firestore: client, InboundAddress: "127.0.0.1:50051"})
+	streamID := uuid.NewString()
+
+	tracks := local.Subscribe(ctx, streamID)
+
+	res, err := s.Ingest(relayPeerContext(ctx), &api.IngestRequest{StreamId: streamID, Url: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.TrackIds) != 1 || res.TrackIds[0] != "video0" {
+		t.Fatalf("got tracks %v, want [video0]", res.TrackIds)
+	}
+
+	select {
+	case tl := <-tracks:
+		if tl.ID() != "video0" || tl.Codec().MimeType != "video/VP8" {
+			t.Fatalf("got track %s with codec %s", tl.ID(), tl.Codec().MimeType)
+		}
+		reader := tl.NewReader()
+		defer reader.Close()
+		if _, err := reader.ReadRTP(); err != nil {
+			t.Fatal(err)
+		}
+	case <-ctx.Done():
+		t.Fatal("track was not added to the store")
+	}
+
+	record, err := s.lookupStream(ctx, streamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record["publisher"] != "127.0.0.1:50051" {
+		t.Fatalf("got publisher %v", record["publisher"])
+	}
+
+	list, err := s.ListIngests(relayPeerContext(ctx), &api.ListIngestsRequest{StreamId: streamID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Ingests) != 1 || !list.Ingests[0].Active || list.Ingests[0].Id != res.IngestId {
+		t.Fatalf("got ingests %v", list.Ingests)
+	}
+
+	stopped, err := s.StopIngest(relayPeerContext(ctx), &api.StopIngestRequest{IngestId: res.IngestId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stopped.Active {
+		t.Fatal("ingest is still active after stopping")
+	}
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/muxable/cdn/internal/metrics"
+	"github.com/muxable/cdn/internal/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsHandler returns an http handler that exposes the node's metrics in the Prometheus text
+// format. Every series is labelled with the node's region so nodes can be aggregated.
+func MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registerer := prometheus.WrapRegistererWith(prometheus.Labels{"region": store.GetTag()}, registry)
+	registerer.MustRegister(metrics.Collectors()...)
+	registerer.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
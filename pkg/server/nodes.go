@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/muxable/cdn/internal/store"
+	"go.uber.org/zap"
+)
+
+const (
+	// heartbeatInterval is how often a node publishes its load to the directory.
+	heartbeatInterval = 10 * time.Second
+	// nodeTTL is how long a node is considered alive after its last heartbeat.
+	nodeTTL = 3 * heartbeatInterval
+)
+
+func (s *CDNServer) nodeRef() *firestore.DocumentRef {
+	return s.config.Firestore.Collection("nodes").Doc(url.PathEscape(s.config.InboundAddress))
+}
+
+// heartbeat publishes this node's load to the directory until the context is cancelled so other
+// nodes can redirect sessions to it.
+func (s *CDNServer) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		load := s.admission.Load()
+		start := time.Now()
+		_, err := s.nodeRef().Set(ctx, map[string]interface{}{
+			"address":       s.config.InboundAddress,
+			"tag":           store.GetTag(),
+			"publishers":    load.Publishers,
+			"subscribers":   load.Subscribers,
+			"egressBitrate": load.EgressBitrate,
+			"full":          s.admission.Full() || s.isDraining(),
+			"updatedAt":     time.Now(),
+		})
+		observe("heartbeat", start, err)
+		if err != nil && ctx.Err() == nil {
+			zap.L().Warn("failed to publish heartbeat", zap.Error(err))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			// use bg context to avoid cancellation.
+			if _, err := s.nodeRef().Delete(context.Background()); err != nil {
+				zap.L().Warn("failed to remove node", zap.Error(err))
+			}
+			return
+		}
+	}
+}
+
+// alternateNode returns the address of a live node that isn't full, preferring nodes in this
+// node's region and then the least loaded. It returns an empty string if there is none.
+func (s *CDNServer) alternateNode(ctx context.Context) (_ string, err error) {
+	ctx, end := startOperation(ctx, "alternateNode", "")
+	defer func() { end(err) }()
+
+	snapshots, err := s.config.Firestore.Collection("nodes").Where("updatedAt", ">", time.Now().Add(-nodeTTL)).Documents(ctx).GetAll()
+	if err != nil {
+		return "", err
+	}
+
+	tag := store.GetTag()
+	best, bestLocal, bestSubscribers := "", false, int64(0)
+	for _, snapshot := range snapshots {
+		data := snapshot.Data()
+		address, _ := data["address"].(string)
+		if address == "" || address == s.config.InboundAddress {
+			continue
+		}
+		if full, _ := data["full"].(bool); full {
+			continue
+		}
+		local := data["tag"] == tag
+		subscribers, _ := data["subscribers"].(int64)
+		if best == "" || local && !bestLocal || local == bestLocal && subscribers < bestSubscribers {
+			best, bestLocal, bestSubscribers = address, local, subscribers
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/muxable/cdn/pkg/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// authorizeViewer checks that a viewer may subscribe to the stream with either a playback token or
+// the caller's credentials, subject to the stream's policy. It returns the token's expiry, which
+// is zero if no token was used.
+func (s *CDNServer) authorizeViewer(ctx context.Context, streamID, token string) (time.Time, error) {
+	if token != "" {
+		if s.config.PlaybackSigner == nil {
+			return time.Time{}, status.Error(codes.Unauthenticated, "playback tokens are not enabled")
+		}
+		expiry, err := s.config.PlaybackSigner.Verify(streamID, token)
+		if errors.Is(err, auth.ErrPlaybackTokenExpired) {
+			return time.Time{}, status.Error(codes.Unauthenticated, err.Error())
+		}
+		if err != nil {
+			return time.Time{}, status.Error(codes.PermissionDenied, err.Error())
+		}
+		return expiry, s.enforcePolicy(ctx, streamID, true)
+	}
+	if err := s.enforcePolicy(ctx, streamID, false); err != nil {
+		return time.Time{}, err
+	}
+	if s.config.PlaybackSigner != nil && s.config.Authorizer == nil && !auth.IsRelayPeer(ctx) {
+		return time.Time{}, status.Error(codes.Unauthenticated, "playback token required")
+	}
+	return time.Time{}, s.authorize(ctx, auth.RoleSubscribe, streamID)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/muxable/cdn/api"
+	"github.com/muxable/cdn/internal/store"
+	"github.com/muxable/cdn/pkg/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ErrRegionNotAllowed = errors.New("stream is not available in this region")
+
+// policyCacheTTL bounds how stale a policy can be, since HLS viewers are checked on every request.
+const policyCacheTTL = 10 * time.Second
+
+type cachedPolicy struct {
+	policy  *api.StreamPolicy
+	fetched time.Time
+}
+
+// streamPolicy returns the stream's policy from the directory.
+func (s *CDNServer) streamPolicy(ctx context.Context, streamID string) (*api.StreamPolicy, error) {
+	s.policyMutex.Lock()
+	cached, ok := s.policies[streamID]
+	s.policyMutex.Unlock()
+	if ok && time.Since(cached.fetched) < policyCacheTTL {
+		return cached.policy, nil
+	}
+
+	record, err := s.lookupStream(ctx, streamID)
+	if err != nil {
+		return nil, err
+	}
+	policy := policyFromRecord(record)
+
+	s.policyMutex.Lock()
+	s.policies[streamID] = cachedPolicy{policy: policy, fetched: time.Now()}
+	s.policyMutex.Unlock()
+
+	return policy, nil
+}
+
+// policyFromRecord reads the policy fields of a directory record.
+func policyFromRecord(record map[string]interface{}) *api.StreamPolicy {
+	policy := &api.StreamPolicy{}
+	if visibility, ok := record["visibility"].(string); ok {
+		policy.Visibility = api.StreamPolicy_Visibility(api.StreamPolicy_Visibility_value[strings.ToUpper(visibility)])
+	}
+	if regions, ok := record["allowedRegions"].([]interface{}); ok {
+		for _, region := range regions {
+			if region, ok := region.(string); ok {
+				policy.AllowedRegions = append(policy.AllowedRegions, region)
+			}
+		}
+	}
+	return policy
+}
+
+// policyToRecord returns the policy fields of a directory record.
+func policyToRecord(policy *api.StreamPolicy) map[string]interface{} {
+	regions := policy.GetAllowedRegions()
+	if regions == nil {
+		// store an empty array rather than null so the field is always queryable.
+		regions = []string{}
+	}
+	return map[string]interface{}{
+		"visibility":     strings.ToLower(policy.GetVisibility().String()),
+		"allowedRegions": regions,
+	}
+}
+
+// allowedInRegion reports whether the policy allows the stream to be served in the region.
+func allowedInRegion(policy *api.StreamPolicy, region string) bool {
+	if len(policy.GetAllowedRegions()) == 0 {
+		return true
+	}
+	for _, allowed := range policy.GetAllowedRegions() {
+		if allowed == region {
+			return true
+		}
+	}
+	return false
+}
+
+// enforcePolicy checks the stream's policy for a viewer. tokenUsed reports whether the viewer
+// presented a valid playback token.
+func (s *CDNServer) enforcePolicy(ctx context.Context, streamID string, tokenUsed bool) error {
+	if auth.IsRelayPeer(ctx) {
+		// relay peers enforce the policy for their own viewers.
+		return nil
+	}
+	policy, err := s.streamPolicy(ctx, streamID)
+	if errors.Is(err, ErrStreamNotFound) {
+		// the policy isn't known until the stream is published, so only admit viewers that could
+		// watch it if it turns out to be private.
+		if tokenUsed {
+			return nil
+		}
+		return auth.Check(ctx, auth.RoleSubscribe, streamID)
+	}
+	if err != nil {
+		return err
+	}
+	if !allowedInRegion(policy, store.GetTag()) {
+		return status.Error(codes.PermissionDenied, ErrRegionNotAllowed.Error())
+	}
+	if policy.GetVisibility() == api.StreamPolicy_PRIVATE && !tokenUsed {
+		return auth.Check(ctx, auth.RoleSubscribe, streamID)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+	"github.com/muxable/cdn/api"
+	"github.com/muxable/cdn/internal/store"
+	"github.com/muxable/cdn/pkg/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestPolicy reads and writes the directory, so it needs the Firestore emulator.
+func TestPolicy(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := firestore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	s := NewCDNServer(Configuration{LocalStore: store.NewLocalTrackStore(), Firestore: client, InboundAddress: "127.0.0.1:50051"})
+	streamID := uuid.NewString()
+
+	// an unpublished stream is treated as private.
+	if err := s.enforcePolicy(ctx, streamID, false); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("got %v, want Unauthenticated", err)
+	}
+	if err := s.enforcePolicy(ctx, streamID, true); err != nil {
+		t.Errorf("got %v with a playback token", err)
+	}
+	viewer := auth.NewContext(ctx, &auth.Claims{Roles: []auth.Role{auth.RoleSubscribe}, StreamIDs: []string{streamID}})
+	if err := s.enforcePolicy(viewer, streamID, false); err != nil {
+		t.Errorf("got %v with subscribe credentials", err)
+	}
+
+	// claiming another track without a policy keeps the stored one.
+	if err := s.claimTrack(ctx, streamID, "video", &api.StreamPolicy{Visibility: api.StreamPolicy_PRIVATE}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.claimTrack(ctx, streamID, "audio", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	record, err := s.lookupStream(ctx, streamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if visibility := policyFromRecord(record).GetVisibility(); visibility != api.StreamPolicy_PRIVATE {
+		t.Errorf("got visibility %s, want PRIVATE", visibility)
+	}
+}
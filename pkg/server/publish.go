@@ -1,19 +1,32 @@
 package server
 
 import (
-	"context"
 	"errors"
+	"sync"
 
-	"cloud.google.com/go/firestore"
 	"github.com/muxable/cdn/api"
+	"github.com/muxable/cdn/internal/metrics"
 	"github.com/muxable/cdn/internal/store"
+	"github.com/muxable/cdn/pkg/auth"
 	"github.com/muxable/signal/pkg/signal"
 	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+var ErrStreamNotAnnounced = errors.New("track stream id doesn't match the announced stream")
+
 func (s *CDNServer) Publish(conn api.CDN_PublishServer) error {
-	peerConnection, err := webrtc.NewPeerConnection(s.config.WebRTCConfiguration)
+	release, err := s.admit(conn.Context(), true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	peerConnection, err := s.api.NewPeerConnection(s.config.WebRTCConfiguration)
 	if err != nil {
 		return err
 	}
@@ -23,6 +36,22 @@ func (s *CDNServer) Publish(conn api.CDN_PublishServer) error {
 
 	peerConnection.OnNegotiationNeeded(signaller.Renegotiate)
 
+	var sendMutex sync.Mutex
+	send := func(response *api.PublishResponse) error {
+		sendMutex.Lock()
+		defer sendMutex.Unlock()
+		return conn.Send(response)
+	}
+
+	// advertise the node's ICE servers before signalling starts, clients wait for them.
+	iceServers, err := s.iceServers()
+	if err != nil {
+		return err
+	}
+	if err := send(&api.PublishResponse{IceServers: iceServers}); err != nil {
+		return err
+	}
+
 	go func() {
 		for {
 			signal, err := signaller.ReadSignal()
@@ -30,34 +59,78 @@ func (s *CDNServer) Publish(conn api.CDN_PublishServer) error {
 				zap.L().Error("failed to read signal", zap.Error(err))
 				return
 			}
-			if err := conn.Send(&api.PublishResponse{Signal: signal}); err != nil {
+			if err := send(&api.PublishResponse{Signal: signal}); err != nil {
 				zap.L().Error("failed to send signal", zap.Error(err))
 				return
 			}
 		}
 	}()
 
+	go func() {
+		select {
+		case <-s.reconnect:
+			// the streams were released so the publisher can claim them on another node.
+			if err := send(&api.PublishResponse{Reconnect: s.reconnectMessage()}); err != nil {
+				zap.L().Error("failed to send reconnect", zap.Error(err))
+			}
+		case <-conn.Context().Done():
+		}
+	}()
+
+	span := trace.SpanFromContext(conn.Context())
+
+	peerConnection.OnICEConnectionStateChange(func(ics webrtc.ICEConnectionState) {
+		span.AddEvent("ice connection state change", trace.WithAttributes(attribute.String("state", ics.String())))
+	})
+
+	peerConnection.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		metrics.PeerConnectionStates.WithLabelValues("publish", pcs.String()).Inc()
+	})
+
+	// the policy applies to every stream claimed in this session. Once announced, the session may
+	// only publish the announced stream.
+	var policy *api.StreamPolicy
+	var announce *api.Announce
+	streamIDs := make(map[string]bool)
+	var policyMutex sync.Mutex
+	defer func() {
+		policyMutex.Lock()
+		for streamID := range streamIDs {
+			metrics.Publishers.WithLabelValues(streamID).Dec()
+		}
+		policyMutex.Unlock()
+	}()
+
 	peerConnection.OnTrack(func(tr *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
 		zap.L().Info("track received", zap.String("kind", tr.Kind().String()))
+		span.AddEvent("track received", trace.WithAttributes(streamAttribute(tr.StreamID()), attribute.String("cdn.track_id", tr.ID())))
 
-		ref := s.config.Firestore.Collection("streams").Doc(tr.StreamID())
+		policyMutex.Lock()
+		announced := announce
+		policyMutex.Unlock()
+		err := s.authorize(conn.Context(), auth.RolePublish, tr.StreamID())
+		if err == nil && announced != nil && tr.StreamID() != announced.StreamId {
+			err = ErrStreamNotAnnounced
+		}
+		if err != nil {
+			zap.L().Warn("rejected track", zap.String("streamId", tr.StreamID()), zap.Error(err))
+			span.RecordError(err)
+			// closing from within OnTrack would deadlock.
+			go peerConnection.Close()
+			return
+		}
 
 		// declare us as the publisher of this stream.
-		if err := s.config.Firestore.RunTransaction(conn.Context(), func(ctx context.Context, tx *firestore.Transaction) error {
-			doc, err := tx.Get(ref)
-			if err != nil && doc == nil {
-				return err
-			}
-			if doc.Exists() && doc.Data()["publisher"] != s.config.InboundAddress {
-				return errors.New("stream already published")
-			}
-			return tx.Set(ref, map[string]interface{}{
-				"publisher": s.config.InboundAddress,
-				"trackIds":  firestore.ArrayUnion(tr.ID()),
-				"updatedAt": firestore.ServerTimestamp,
-			}, firestore.MergeAll)
-		}); err != nil {
+		policyMutex.Lock()
+		if !streamIDs[tr.StreamID()] {
+			streamIDs[tr.StreamID()] = true
+			metrics.Publishers.WithLabelValues(tr.StreamID()).Inc()
+		}
+		err = s.claimTrack(conn.Context(), tr.StreamID(), tr.ID(), policy, announce)
+		policyMutex.Unlock()
+		if err != nil {
 			zap.L().Error("failed to declare publisher", zap.Error(err))
+			span.RecordError(err)
 			return
 		}
 
@@ -69,20 +142,14 @@ func (s *CDNServer) Publish(conn api.CDN_PublishServer) error {
 			buf := make([]byte, 1500)
 			for {
 				if _, _, err := r.Read(buf); err != nil {
-					// remove the track id, use bg context to avoid cancellation.
-					if _, err := ref.Update(context.Background(), []firestore.Update{
-						{Path: "trackIds", Value: firestore.ArrayRemove(tr.ID())},
-						{Path: "updatedAt", Value: firestore.ServerTimestamp},
-					}); err != nil {
-						zap.L().Error("failed to declare publisher", zap.Error(err))
-					}
+					s.releaseTrack(tr.StreamID(), tr.ID())
 					return
 				}
 			}
 		}()
 
 		// save the track in the local store.
-		if err := s.config.LocalStore.AddTrack(&store.TrackRemote{TrackRemote: tr}); err != nil {
+		if err := s.config.LocalStore.AddTrack(&store.TrackRemote{TrackSource: &store.TrackRemoteReader{TrackRemote: tr}}); err != nil {
 			zap.L().Error("failed to add track", zap.Error(err))
 			return
 		}
@@ -93,6 +160,48 @@ func (s *CDNServer) Publish(conn api.CDN_PublishServer) error {
 		if err != nil {
 			return nil
 		}
+		if in.Policy != nil {
+			policyMutex.Lock()
+			policy = in.Policy
+			// apply the policy to streams that were claimed before it arrived.
+			for streamID := range streamIDs {
+				if err := s.setPolicy(conn.Context(), streamID, policy); err != nil {
+					zap.L().Error("failed to update policy", zap.String("streamId", streamID), zap.Error(err))
+				}
+			}
+			policyMutex.Unlock()
+		}
+		if in.Announce != nil {
+			streamID := in.Announce.StreamId
+			if streamID == "" {
+				return status.Error(codes.InvalidArgument, "announce requires a stream id")
+			}
+			if err := s.authorize(conn.Context(), auth.RolePublish, streamID); err != nil {
+				return err
+			}
+			policyMutex.Lock()
+			if announce != nil && announce.StreamId != streamID {
+				policyMutex.Unlock()
+				return status.Error(codes.InvalidArgument, "the announced stream id can't change")
+			}
+			for claimed := range streamIDs {
+				if claimed != streamID {
+					policyMutex.Unlock()
+					return status.Error(codes.InvalidArgument, ErrStreamNotAnnounced.Error())
+				}
+			}
+			announce = in.Announce
+			if streamIDs[streamID] {
+				// update the metadata of the stream that's already claimed.
+				if err := s.setAnnounce(conn.Context(), streamID, announce); err != nil {
+					zap.L().Error("failed to update metadata", zap.String("streamId", streamID), zap.Error(err))
+				}
+			}
+			policyMutex.Unlock()
+		}
+		if in.Signal == nil {
+			continue
+		}
 		if err := signaller.WriteSignal(in.Signal); err != nil {
 			zap.L().Error("failed to write signal", zap.Error(err))
 			return nil
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/muxable/cdn/api"
+	"github.com/muxable/cdn/internal/rtmp"
+	"github.com/muxable/cdn/internal/store"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var ErrPushNotFound = errors.New("push not found")
+
+// StartPush pushes the H.264 track of a stream to an RTMP server, retrying until stopped.
+func (s *CDNServer) StartPush(ctx context.Context, req *api.StartPushRequest) (*api.Push, error) {
+	if err := s.authorizeAdmin(ctx, req.StreamId); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(req.Url)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if u.Scheme != "rtmp" {
+		return nil, status.Error(codes.InvalidArgument, "push url must be rtmp")
+	}
+	// the push connects in the background, so refuse denied hosts up front. ingestDialer still
+	// checks every connection in case the host resolves differently later.
+	if err := checkDialHost(ctx, u.Hostname()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	pusher := rtmp.StartPush(uuid.NewString(), req.StreamId, req.Url, ingestDialer, func(ctx context.Context, streamID string) (chan *store.TrackLocal, error) {
+		if err := s.link(ctx, streamID); err != nil {
+			return nil, err
+		}
+		return s.config.LocalStore.Subscribe(ctx, streamID), nil
+	})
+
+	s.pushMutex.Lock()
+	s.prunePushes()
+	s.pushes[pusher.ID] = pusher
+	s.pushMutex.Unlock()
+
+	zap.L().Info("started push", zap.String("streamId", req.StreamId), zap.String("pushId", pusher.ID))
+
+	return pushToProto(pusher), nil
+}
+
+// StopPush stops a push and closes its connection.
+func (s *CDNServer) StopPush(ctx context.Context, req *api.StopPushRequest) (*api.Push, error) {
+	s.pushMutex.Lock()
+	pusher, ok := s.pushes[req.PushId]
+	s.pushMutex.Unlock()
+	if !ok {
+		return nil, status.Error(codes.NotFound, ErrPushNotFound.Error())
+	}
+	if err := s.authorizeAdmin(ctx, pusher.StreamID); err != nil {
+		return nil, err
+	}
+
+	pusher.Stop()
+
+	zap.L().Info("stopped push", zap.String("streamId", pusher.StreamID), zap.String("pushId", pusher.ID))
+
+	return pushToProto(pusher), nil
+}
+
+// ListPushes lists the pushes started on this node of streams the caller administers. Stopped
+// pushes are listed for finishedRetention.
+func (s *CDNServer) ListPushes(ctx context.Context, req *api.ListPushesRequest) (*api.ListPushesResponse, error) {
+	s.pushMutex.Lock()
+	defer s.pushMutex.Unlock()
+	s.prunePushes()
+
+	res := &api.ListPushesResponse{}
+	for _, pusher := range s.pushes {
+		if req.StreamId != "" && pusher.StreamID != req.StreamId {
+			continue
+		}
+		if s.authorizeAdmin(ctx, pusher.StreamID) != nil {
+			continue
+		}
+		res.Pushes = append(res.Pushes, pushToProto(pusher))
+	}
+	sort.Slice(res.Pushes, func(i, j int) bool {
+		return res.Pushes[i].StartedAt.AsTime().Before(res.Pushes[j].StartedAt.AsTime())
+	})
+	return res, nil
+}
+
+// prunePushes forgets pushes stopped more than finishedRetention ago. The caller must hold pushMutex.
+func (s *CDNServer) prunePushes() {
+	for id, pusher := range s.pushes {
+		pusher.Lock()
+		stoppedAt := pusher.StoppedAt
+		pusher.Unlock()
+		if !stoppedAt.IsZero() && time.Since(stoppedAt) > finishedRetention {
+			delete(s.pushes, id)
+		}
+	}
+}
+
+func pushToProto(pusher *rtmp.Pusher) *api.Push {
+	status := pusher.Status()
+	pusher.Lock()
+	defer pusher.Unlock()
+	return &api.Push{
+		Id:          pusher.ID,
+		StreamId:    pusher.StreamID,
+		Url:         redactStreamKey(pusher.URL),
+		State:       api.Push_State(status.State),
+		LastError:   status.LastError,
+		Attempts:    int32(status.Attempts),
+		BytesSent:   status.BytesSent,
+		StartedAt:   timestamppb.New(pusher.StartedAt),
+		ConnectedAt: optionalTimestamp(status.ConnectedAt),
+		StoppedAt:   optionalTimestamp(pusher.StoppedAt),
+	}
+}
+
+// redactStreamKey hides the stream key, which is the last path element of an rtmp url.
+func redactStreamKey(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	u.Path = path.Join(path.Dir(u.Path), "****")
+	u.RawQuery = ""
+	return u.String()
+}
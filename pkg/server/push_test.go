@@ -0,0 +1,24 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/muxable/cdn/api"
+	"github.com/muxable/cdn/internal/store"
+	"github.com/muxable/cdn/pkg/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStartPushRefusesLocalTargets(t *testing.T) {
+	s := NewCDNServer(Configuration{LocalStore: store.NewLocalTrackStore(), Authorizer: auth.NewHMACAuthorizer([]byte("secret"))})
+	admin := auth.NewContext(context.Background(), &auth.Claims{Roles: []auth.Role{auth.RoleAdmin}, StreamIDs: []string{"camera"}})
+
+	for _, url := range []string{"rtmp://127.0.0.1/live/key", "rtmp://localhost:1935/live/key", "rtmp://[::1]/live/key", "rtmp://169.254.169.254/live/key"} {
+		_, err := s.StartPush(admin, &api.StartPushRequest{StreamId: "camera", Url: url})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("%s: got %v, want InvalidArgument", url, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/muxable/cdn/api"
+	"github.com/muxable/cdn/internal/record"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	ErrRecordingNotFound  = errors.New("recording not found")
+	ErrPublishedElsewhere = errors.New("stream is published on another node")
+)
+
+// finishedRetention is how long stopped recordings, pushes and ingests are listed before they're
+// forgotten.
+const finishedRetention = time.Hour
+
+// StartRecording records every track of a stream published on this node to disk.
+func (s *CDNServer) StartRecording(ctx context.Context, req *api.StartRecordingRequest) (*api.Recording, error) {
+	if err := s.authorizeAdmin(ctx, req.StreamId); err != nil {
+		return nil, err
+	}
+
+	publisher, err := s.lookupPublisher(ctx, req.StreamId)
+	if err != nil {
+		return nil, err
+	}
+	if publisher != s.config.InboundAddress {
+		st := status.New(codes.FailedPrecondition, ErrPublishedElsewhere.Error())
+		if detailed, derr := st.WithDetails(&errdetails.ErrorInfo{
+			Reason:   "PUBLISHED_ELSEWHERE",
+			Domain:   "api.CDN",
+			Metadata: map[string]string{"publisher": publisher},
+		}); derr == nil {
+			st = detailed
+		}
+		return nil, st.Err()
+	}
+
+	options := record.Options{MaxFileSize: req.MaxFileBytes}
+	if req.MaxFileDuration != nil {
+		options.MaxFileDuration = req.MaxFileDuration.AsDuration()
+	}
+
+	recorder, err := record.Start(uuid.NewString(), s.config.RecordingDirectory, req.StreamId, s.config.LocalStore.Subscribe, options)
+	if errors.Is(err, record.ErrInvalidStreamID) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.recordingMutex.Lock()
+	s.pruneRecordings()
+	s.recordings[recorder.ID] = recorder
+	s.recordingMutex.Unlock()
+
+	zap.L().Info("started recording", zap.String("streamId", req.StreamId), zap.String("recordingId", recorder.ID))
+
+	return recordingToProto(recorder), nil
+}
+
+// StopRecording stops an active recording and closes its files.
+func (s *CDNServer) StopRecording(ctx context.Context, req *api.StopRecordingRequest) (*api.Recording, error) {
+	s.recordingMutex.Lock()
+	recorder, ok := s.recordings[req.RecordingId]
+	s.recordingMutex.Unlock()
+	if !ok {
+		return nil, status.Error(codes.NotFound, ErrRecordingNotFound.Error())
+	}
+	if err := s.authorizeAdmin(ctx, recorder.StreamID); err != nil {
+		return nil, err
+	}
+
+	recorder.Stop()
+
+	zap.L().Info("stopped recording", zap.String("streamId", recorder.StreamID), zap.String("recordingId", recorder.ID))
+
+	return recordingToProto(recorder), nil
+}
+
+// ListRecordings lists the recordings made by this node of streams the caller administers. Stopped
+// recordings are listed for finishedRetention.
+func (s *CDNServer) ListRecordings(ctx context.Context, req *api.ListRecordingsRequest) (*api.ListRecordingsResponse, error) {
+	s.recordingMutex.Lock()
+	defer s.recordingMutex.Unlock()
+	s.pruneRecordings()
+
+	res := &api.ListRecordingsResponse{}
+	for _, recorder := range s.recordings {
+		if req.StreamId != "" && recorder.StreamID != req.StreamId {
+			continue
+		}
+		if s.authorizeAdmin(ctx, recorder.StreamID) != nil {
+			continue
+		}
+		res.Recordings = append(res.Recordings, recordingToProto(recorder))
+	}
+	sort.Slice(res.Recordings, func(i, j int) bool {
+		return res.Recordings[i].StartedAt.AsTime().Before(res.Recordings[j].StartedAt.AsTime())
+	})
+	return res, nil
+}
+
+// pruneRecordings forgets recordings stopped more than finishedRetention ago. The caller must hold
+// recordingMutex.
+func (s *CDNServer) pruneRecordings() {
+	for id, recorder := range s.recordings {
+		recorder.Lock()
+		stoppedAt := recorder.StoppedAt
+		recorder.Unlock()
+		if !stoppedAt.IsZero() && time.Since(stoppedAt) > finishedRetention {
+			delete(s.recordings, id)
+		}
+	}
+}
+
+func recordingToProto(recorder *record.Recorder) *api.Recording {
+	recorder.Lock()
+	recording := &api.Recording{
+		Id:        recorder.ID,
+		StreamId:  recorder.StreamID,
+		Active:    recorder.StoppedAt.IsZero(),
+		StartedAt: timestamppb.New(recorder.StartedAt),
+		StoppedAt: optionalTimestamp(recorder.StoppedAt),
+	}
+	recorder.Unlock()
+
+	for _, f := range recorder.Files() {
+		recording.Files = append(recording.Files, &api.Recording_File{
+			Path:      f.Path,
+			TrackId:   f.TrackID,
+			MimeType:  f.MimeType,
+			Size:      f.Size,
+			StartedAt: timestamppb.New(f.StartedAt),
+			EndedAt:   optionalTimestamp(f.EndedAt),
+		})
+	}
+	return recording
+}
+
+// optionalTimestamp converts a time to a timestamp, leaving it unset for the zero time.
+func optionalTimestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
@@ -2,18 +2,29 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 
 	"cloud.google.com/go/firestore"
 	"github.com/muxable/cdn/api"
+	"github.com/muxable/cdn/internal/admission"
+	"github.com/muxable/cdn/internal/record"
+	"github.com/muxable/cdn/internal/rtmp"
 	"github.com/muxable/cdn/internal/store"
+	"github.com/muxable/cdn/pkg/auth"
 	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 
 	firebase "firebase.google.com/go/v4"
 )
@@ -28,32 +39,191 @@ type Configuration struct {
 	LocalStore          *store.LocalTrackStore
 	Firestore           *firestore.Client
 	InboundAddress      string
+
+	// SettingEngine is applied to every PeerConnection, including relays.
+	SettingEngine webrtc.SettingEngine
+	// TURNServer, if non-nil, is advertised to every session with short-lived credentials.
+	TURNServer *TURNServer
+
+	// Authorizer validates the bearer token of every call. If nil, all calls are allowed.
+	Authorizer auth.Authorizer
+	// RelayCredentials are attached to subscriptions to other nodes when relaying.
+	RelayCredentials credentials.PerRPCCredentials
+	// PlaybackSigner verifies playback tokens presented by viewers. If set without an Authorizer,
+	// viewers other than relay peers must present one.
+	PlaybackSigner *auth.PlaybackSigner
+	// RelayTLSConfig secures relay connections to other nodes. If nil, relays are plaintext.
+	RelayTLSConfig *tls.Config
+
+	// Limits bounds the sessions admitted by this node.
+	Limits admission.Limits
+
+	// RecordingDirectory is where recordings are written, defaults to "recordings".
+	RecordingDirectory string
 }
 
 type CDNServer struct {
 	api.UnimplementedCDNServer
 	config Configuration
+	api    *webrtc.API
 
 	linkedStreamIDs map[string]bool
 	streamMutex     sync.Mutex
+
+	recordings     map[string]*record.Recorder
+	recordingMutex sync.Mutex
+
+	pushes    map[string]*rtmp.Pusher
+	pushMutex sync.Mutex
+
+	ingests     map[string]*ingest
+	ingestMutex sync.Mutex
+
+	policies    map[string]cachedPolicy
+	policyMutex sync.Mutex
+
+	admission *admission.Controller
+
+	// draining is closed when the node stops accepting sessions and reconnect once connected
+	// sessions should move to alternate.
+	draining  chan struct{}
+	reconnect chan struct{}
+	alternate string
+	drainOnce sync.Once
 }
 
 func NewCDNServer(config Configuration) *CDNServer {
+	if config.RecordingDirectory == "" {
+		config.RecordingDirectory = "recordings"
+	}
+	var egress func() uint64
+	if config.LocalStore != nil {
+		egress = config.LocalStore.EgressBytes
+	}
+	webrtcAPI, err := newAPI(config.SettingEngine)
+	if err != nil {
+		// only fails if the default codecs conflict.
+		panic(err)
+	}
 	return &CDNServer{
-		config:      config,
+		config:          config,
+		api:             webrtcAPI,
 		linkedStreamIDs: make(map[string]bool),
+		recordings:      make(map[string]*record.Recorder),
+		pushes:          make(map[string]*rtmp.Pusher),
+		ingests:         make(map[string]*ingest),
+		policies:        make(map[string]cachedPolicy),
+		admission:       admission.NewController(config.Limits, egress),
+		draining:        make(chan struct{}),
+		reconnect:       make(chan struct{}),
+	}
+}
+
+// authorizeAdmin checks that the caller may perform internal operations on the stream. Relay peers
+// may, as may tokens granting the admin role. Without an authorizer only relay peers may.
+func (s *CDNServer) authorizeAdmin(ctx context.Context, streamID string) error {
+	if auth.IsRelayPeer(ctx) {
+		return nil
 	}
+	if s.config.Authorizer == nil {
+		return status.Error(codes.PermissionDenied, "requires a relay certificate or an admin token")
+	}
+	return auth.Check(ctx, auth.RoleAdmin, streamID)
 }
 
-func ServeCDN(addr string) error {
+// authorize checks that the caller may perform role on the stream if an authorizer is configured.
+func (s *CDNServer) authorize(ctx context.Context, role auth.Role, streamID string) error {
+	if s.config.Authorizer == nil {
+		return nil
+	}
+	return auth.Check(ctx, role, streamID)
+}
+
+// transportCredentials returns the credentials for dialing other nodes.
+func (s *CDNServer) transportCredentials() credentials.TransportCredentials {
+	if s.config.RelayTLSConfig == nil {
+		return insecure.NewCredentials()
+	}
+	return credentials.NewTLS(s.config.RelayTLSConfig)
+}
+
+// defaultBufferWindow is how much of each track is buffered if no window is configured.
+const defaultBufferWindow = 30 * time.Second
+
+// ServeOptions configures ServeCDN.
+type ServeOptions struct {
+	// HTTPAddress serves HLS and Prometheus metrics over http if non-empty.
+	HTTPAddress string
+	// InboundAddress is the address other nodes relay from, defaults to the listen address.
+	InboundAddress string
+
+	// ICEServers are used by the node's PeerConnections, defaults to Google's STUN server.
+	ICEServers []webrtc.ICEServer
+	// ProjectID is the Firebase project of the Firestore directory, defaults to "rtirl-a1d7f".
+	ProjectID string
+
+	// Authorizer, if non-nil, requires calls to carry a bearer token it accepts.
+	Authorizer auth.Authorizer
+	// RelayCredentials are used to subscribe to other nodes.
+	RelayCredentials credentials.PerRPCCredentials
+	// PlaybackSigner, if non-nil, lets viewers subscribe with playback tokens.
+	PlaybackSigner *auth.PlaybackSigner
+
+	// Limits bounds the sessions admitted by this node.
+	Limits admission.Limits
+
+	// TLS, if non-nil, serves gRPC and http over TLS and secures relays with mTLS.
+	TLS *TLSOptions
+
+	// ICE configures candidate gathering.
+	ICE ICEOptions
+
+	// TURN, if non-nil, runs a TURN server on the node for clients behind symmetric NATs.
+	TURN *TURNOptions
+
+	// BufferWindow is how much of each track is kept for subscriptions that start behind live,
+	// defaults to 30 seconds.
+	BufferWindow time.Duration
+
+	// DrainPeriod is how long the node waits for sessions to move to other nodes before shutting
+	// down, defaults to 20 seconds.
+	DrainPeriod time.Duration
+}
+
+// ServeCDN serves the cdn over gRPC on addr.
+func ServeCDN(addr string, options ServeOptions) error {
+	return ServeCDNContext(context.Background(), addr, options)
+}
+
+// ServeCDNContext serves the cdn over gRPC on addr until the context is cancelled, then drains the
+// node and shuts down once its sessions have moved or the drain period elapses.
+func ServeCDNContext(ctx context.Context, addr string, options ServeOptions) error {
 	grpcConn, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 
+	var serverTLSConfig, relayTLSConfig *tls.Config
+	if options.TLS != nil {
+		if serverTLSConfig, err = options.TLS.ServerConfig(); err != nil {
+			return err
+		}
+		if relayTLSConfig, err = options.TLS.RelayConfig(); err != nil {
+			return err
+		}
+	}
+
 	local := store.NewLocalTrackStore()
+	local.BufferWindow = options.BufferWindow
+	if local.BufferWindow == 0 {
+		local.BufferWindow = defaultBufferWindow
+	}
 
-	app, err := firebase.NewApp(context.Background(), &firebase.Config{ProjectID: "rtirl-a1d7f"})
+	projectID := options.ProjectID
+	if projectID == "" {
+		projectID = "rtirl-a1d7f"
+	}
+	app, err := firebase.NewApp(context.Background(), &firebase.Config{ProjectID: projectID})
 	if err != nil {
 		return err
 	}
@@ -63,19 +233,123 @@ func ServeCDN(addr string) error {
 	}
 	defer client.Close()
 
-	grpcServer := grpc.NewServer()
+	// trace every call, continuing traces propagated by other nodes.
+	serverOptions := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(otelgrpc.UnaryServerInterceptor(otelgrpc.WithPropagators(propagator))),
+		grpc.ChainStreamInterceptor(otelgrpc.StreamServerInterceptor(otelgrpc.WithPropagators(propagator))),
+	}
+	if serverTLSConfig != nil {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	}
+	if options.Authorizer != nil {
+		serverOptions = append(serverOptions,
+			grpc.ChainUnaryInterceptor(auth.UnaryServerInterceptor(options.Authorizer)),
+			grpc.ChainStreamInterceptor(auth.StreamServerInterceptor(options.Authorizer)))
+	}
+	grpcServer := grpc.NewServer(serverOptions...)
+
+	iceServers := options.ICEServers
+	if iceServers == nil {
+		iceServers = []webrtc.ICEServer{
+			{URLs: []string{"stun:stun.l.google.com:19302"}},
+		}
+	}
+	inboundAddress := options.InboundAddress
+	if inboundAddress == "" {
+		inboundAddress = addr
+	}
 
-	api.RegisterCDNServer(grpcServer, NewCDNServer(Configuration{
+	settingEngine, err := options.ICE.SettingEngine()
+	if err != nil {
+		return err
+	}
+	closeMux, err := options.ICE.ListenMux(&settingEngine)
+	if err != nil {
+		return err
+	}
+	defer closeMux()
+
+	var turnServer *TURNServer
+	if options.TURN != nil {
+		turnOptions := *options.TURN
+		turnOptions.NodeICE = options.ICE
+		if turnServer, err = NewTURNServer(turnOptions); err != nil {
+			return err
+		}
+		defer turnServer.Close()
+	}
+	iceTransportPolicy := webrtc.ICETransportPolicyAll
+	if options.ICE.RelayOnly {
+		iceTransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+
+	cdnServer := NewCDNServer(Configuration{
 		WebRTCConfiguration: webrtc.Configuration{
-			ICEServers: []webrtc.ICEServer{
-				{URLs: []string{"stun:stun.l.google.com:19302"}},
-			},
+			ICEServers:         iceServers,
+			ICETransportPolicy: iceTransportPolicy,
 		},
-		Firestore:      client,
-		LocalStore:     local,
-		InboundAddress: addr,
-	}))
-	grpc_health_v1.RegisterHealthServer(grpcServer, health.NewServer())
+		SettingEngine:    settingEngine,
+		TURNServer:       turnServer,
+		Firestore:        client,
+		LocalStore:       local,
+		InboundAddress:   inboundAddress,
+		Authorizer:       options.Authorizer,
+		RelayCredentials: options.RelayCredentials,
+		PlaybackSigner:   options.PlaybackSigner,
+		RelayTLSConfig:   relayTLSConfig,
+		Limits:           options.Limits,
+	})
+
+	api.RegisterCDNServer(grpcServer, cdnServer)
+
+	heartbeatCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cdnServer.heartbeat(heartbeatCtx)
+
+	healthServer := health.NewServer()
+	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
+
+	var httpServer *http.Server
+
+	if options.HTTPAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/hls/", http.StripPrefix("/hls/", cdnServer.HLSHandler()))
+		mux.Handle("/metrics", MetricsHandler())
+
+		httpServer = &http.Server{Addr: options.HTTPAddress, Handler: mux, TLSConfig: serverTLSConfig}
+		go func() {
+			zap.L().Info("starting http server", zap.String("addr", options.HTTPAddress))
+			var err error
+			if serverTLSConfig != nil {
+				// the certificate is already loaded into the tls config.
+				err = httpServer.ListenAndServeTLS("", "")
+			} else {
+				err = httpServer.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				zap.L().Error("http server failed", zap.Error(err))
+			}
+		}()
+	}
+
+	go func() {
+		<-ctx.Done()
+		// report not serving so load balancers stop routing to this node.
+		healthServer.Shutdown()
+		cdnServer.Drain(context.Background())
+
+		period := options.DrainPeriod
+		if period == 0 {
+			period = defaultDrainPeriod
+		}
+		cdnServer.waitDrained(period)
+
+		zap.L().Info("stopping cdn server", zap.String("addr", addr))
+		if httpServer != nil {
+			httpServer.Close()
+		}
+		grpcServer.Stop()
+	}()
 
 	zap.L().Info("starting cdn server", zap.String("addr", addr))
 
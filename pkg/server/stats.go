@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+
+	"github.com/muxable/cdn/api"
+	"github.com/muxable/cdn/pkg/auth"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// peerAddress returns the address of the caller including its port, which identifies the session.
+func peerAddress(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// GetStats returns the quality of the live tracks of a stream on this node and of their
+// subscribers.
+func (s *CDNServer) GetStats(ctx context.Context, req *api.GetStatsRequest) (*api.GetStatsResponse, error) {
+	if err := s.authorize(ctx, auth.RolePublish, req.StreamId); err != nil {
+		return nil, err
+	}
+
+	response := &api.GetStatsResponse{StreamId: req.StreamId}
+	for _, ts := range s.config.LocalStore.Stats(req.StreamId) {
+		track := &api.GetStatsResponse_Track{
+			TrackId:          ts.ID,
+			Rid:              ts.RID,
+			Kind:             ts.Kind.String(),
+			MimeType:         ts.Codec.MimeType,
+			Bitrate:          ts.Bitrate,
+			PacketRate:       ts.PacketRate,
+			FrameRate:        ts.FrameRate,
+			FractionLost:     ts.FractionLost,
+			PacketsLost:      ts.PacketsLost,
+			Jitter:           durationpb.New(ts.Jitter),
+			KeyframeInterval: durationpb.New(ts.KeyframeInterval),
+			Packets:          ts.Packets,
+			Bytes:            ts.Bytes,
+		}
+		for _, subscriber := range ts.Subscribers {
+			stats := &api.GetStatsResponse_Subscriber{
+				Address:       subscriber.Address,
+				RoundTripTime: durationpb.New(subscriber.RoundTripTime),
+				FractionLost:  subscriber.FractionLost,
+				PacketsLost:   subscriber.PacketsLost,
+				Jitter:        durationpb.New(subscriber.Jitter),
+			}
+			if !subscriber.UpdatedAt.IsZero() {
+				stats.UpdatedAt = timestamppb.New(subscriber.UpdatedAt)
+			}
+			track.Subscribers = append(track.Subscribers, stats)
+		}
+		response.Tracks = append(response.Tracks, track)
+	}
+	return response, nil
+}
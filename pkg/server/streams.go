@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/muxable/cdn/api"
+	"github.com/muxable/cdn/internal/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ListStreams lists the public streams that can be served in this node's region.
+func (s *CDNServer) ListStreams(ctx context.Context, req *api.ListStreamsRequest) (*api.ListStreamsResponse, error) {
+	records, err := s.listStreams(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &api.ListStreamsResponse{}
+	for streamID, record := range records {
+		if record["publisher"] == nil || !allowedInRegion(policyFromRecord(record), store.GetTag()) {
+			continue
+		}
+		stream := &api.ListStreamsResponse_Stream{StreamId: streamID, TrackIds: recordStrings(record["trackIds"])}
+		if len(stream.TrackIds) == 0 {
+			// the publisher has left.
+			continue
+		}
+		res.Streams = append(res.Streams, stream)
+	}
+	sort.Slice(res.Streams, func(i, j int) bool {
+		return res.Streams[i].StreamId < res.Streams[j].StreamId
+	})
+	return res, nil
+}
+
+// GetStream returns the metadata and live tracks of a stream, subject to its policy.
+func (s *CDNServer) GetStream(ctx context.Context, req *api.GetStreamRequest) (*api.Stream, error) {
+	if req.StreamId == "" {
+		return nil, status.Error(codes.InvalidArgument, "stream id is required")
+	}
+	if _, err := s.authorizeViewer(ctx, req.StreamId, req.PlaybackToken); err != nil {
+		return nil, err
+	}
+	record, err := s.lookupStream(ctx, req.StreamId)
+	if errors.Is(err, ErrStreamNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &api.Stream{
+		StreamId: req.StreamId,
+		Metadata: recordStringMap(record["metadata"]),
+		Policy:   policyFromRecord(record),
+	}
+	labels := recordStringMap(record["trackLabels"])
+	for _, trackID := range recordStrings(record["trackIds"]) {
+		stream.Tracks = append(stream.Tracks, &api.Stream_Track{TrackId: trackID, Label: labels[trackID]})
+	}
+	if updatedAt, ok := record["updatedAt"].(time.Time); ok {
+		stream.UpdatedAt = timestamppb.New(updatedAt)
+	}
+	return stream, nil
+}
+
+// recordStrings reads an array of strings from a directory record field.
+func recordStrings(value interface{}) []string {
+	var strs []string
+	if values, ok := value.([]interface{}); ok {
+		for _, value := range values {
+			if str, ok := value.(string); ok {
+				strs = append(strs, str)
+			}
+		}
+	}
+	return strs
+}
+
+// recordStringMap reads a map of strings from a directory record field.
+func recordStringMap(value interface{}) map[string]string {
+	strs := make(map[string]string)
+	if values, ok := value.(map[string]interface{}); ok {
+		for key, value := range values {
+			if str, ok := value.(string); ok {
+				strs[key] = str
+			}
+		}
+	}
+	return strs
+}
@@ -2,71 +2,153 @@ package server
 
 import (
 	"context"
-	"errors"
+	"sync"
+	"time"
 
 	"github.com/muxable/cdn/api"
+	"github.com/muxable/cdn/internal/metrics"
+	"github.com/muxable/cdn/internal/stats"
+	"github.com/muxable/cdn/internal/store"
+	"github.com/muxable/cdn/pkg/auth"
 	"github.com/muxable/cdn/pkg/cdn"
 	"github.com/muxable/signal/pkg/signal"
 	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-func (s *CDNServer) relay(ctx context.Context, streamID string) error {
-	// fetch the publisher address from firestore.
-	snapshot, err := s.config.Firestore.Collection("streams").Doc(streamID).Get(ctx)
+func (s *CDNServer) relay(ctx context.Context, streamID string) (err error) {
+	start := time.Now()
+
+	ctx, span := tracer.Start(ctx, "relay", trace.WithAttributes(streamAttribute(streamID)))
+	defer func() { endSpan(span, err) }()
+
+	// fetch the publisher address from the directory.
+	publisher, err := s.lookupPublisher(ctx, streamID)
 	if err != nil {
 		return err
 	}
-	if !snapshot.Exists() || snapshot.Data()["publisher"] == nil {
-		return errors.New("stream does not exist")
-	}
-	publisher := snapshot.Data()["publisher"].(string)
 
 	if publisher == s.config.InboundAddress {
 		return nil
 	}
+	span.SetAttributes(attribute.String("cdn.publisher", publisher))
 
 	// connect to the publisher.
-	conn, err := grpc.Dial(publisher, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	dialOptions := append(tracingDialOptions(span), grpc.WithTransportCredentials(s.transportCredentials()))
+	conn, err := grpc.Dial(publisher, dialOptions...)
 	if err != nil {
 		return err
 	}
 
-	client, err := cdn.NewClient(conn)
+	// when the publisher's node drains, follow the stream to wherever it is published next.
+	options := []cdn.ClientOption{cdn.WithAPI(s.api), cdn.WithReconnectHandler(func(string) {
+		go s.relink(streamID)
+	})}
+	if s.config.RelayCredentials != nil {
+		options = append(options, cdn.WithCredentials(s.config.RelayCredentials))
+	}
+	client, err := cdn.NewClient(conn, options...)
 	if err != nil {
 		return err
 	}
 
-	// subscribe to the publisher.
-	publisherPeerConnection, err := client.Subscribe(streamID)
+	// subscribe to the publisher. the relay outlives the viewer that triggered it.
+	session, err := client.Subscribe(context.Background(), streamID)
 	if err != nil {
+		conn.Close()
 		return err
 	}
 
+	metrics.RelaySetupSeconds.Observe(time.Since(start).Seconds())
+	metrics.Relays.WithLabelValues(streamID).Inc()
+
 	// add the publisher to the local store.
-	s.config.LocalStore.AddPublisher(publisherPeerConnection)
+	s.config.LocalStore.AddPublisher(session.PeerConnection)
 
-	publisherPeerConnection.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
-		if pcs == webrtc.PeerConnectionStateClosed {
-			conn.Close()
-		}
+	session.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		metrics.PeerConnectionStates.WithLabelValues("relay", pcs.String()).Inc()
 	})
 
+	go func() {
+		<-session.Done()
+		zap.L().Info("relay ended", zap.String("streamId", streamID), zap.Error(session.Err()))
+		metrics.Relays.WithLabelValues(streamID).Dec()
+		conn.Close()
+	}()
+
 	return nil
 }
 
+// link ensures the stream is available in the local store, subscribing to the publisher if the
+// stream id is not linked on this server.
+func (s *CDNServer) link(ctx context.Context, streamID string) error {
+	s.streamMutex.Lock()
+	defer s.streamMutex.Unlock()
+
+	if s.linkedStreamIDs[streamID] {
+		return nil
+	}
+	if err := s.relay(ctx, streamID); err != nil {
+		return err
+	}
+	s.linkedStreamIDs[streamID] = true
+	return nil
+}
+
+// streamSubscription is a stream subscribed to in a Subscribe session.
+type streamSubscription struct {
+	*store.Subscription
+	cancel context.CancelFunc
+}
+
 func (s *CDNServer) Subscribe(conn api.CDN_SubscribeServer) error {
-	peerConnection, err := webrtc.NewPeerConnection(s.config.WebRTCConfiguration)
+	release, err := s.admit(conn.Context(), false)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	peerConnection, err := s.api.NewPeerConnection(s.config.WebRTCConfiguration)
 	if err != nil {
 		return err
 	}
+	defer peerConnection.Close()
 
 	signaller := signal.NewSignaller(peerConnection)
 
 	peerConnection.OnNegotiationNeeded(signaller.Renegotiate)
 
+	span := trace.SpanFromContext(conn.Context())
+
+	peerConnection.OnICEConnectionStateChange(func(ics webrtc.ICEConnectionState) {
+		span.AddEvent("ice connection state change", trace.WithAttributes(attribute.String("state", ics.String())))
+	})
+
+	peerConnection.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		metrics.PeerConnectionStates.WithLabelValues("subscribe", pcs.String()).Inc()
+	})
+
+	var sendMutex sync.Mutex
+	send := func(response *api.SubscribeResponse) error {
+		sendMutex.Lock()
+		defer sendMutex.Unlock()
+		return conn.Send(response)
+	}
+
+	// advertise the node's ICE servers before signalling starts, clients wait for them.
+	iceServers, err := s.iceServers()
+	if err != nil {
+		return err
+	}
+	if err := send(&api.SubscribeResponse{IceServers: iceServers}); err != nil {
+		return err
+	}
+
 	go func() {
 		for {
 			signal, err := signaller.ReadSignal()
@@ -74,52 +156,211 @@ func (s *CDNServer) Subscribe(conn api.CDN_SubscribeServer) error {
 				zap.L().Error("failed to read signal", zap.Error(err))
 				return
 			}
-			if err := conn.Send(&api.SubscribeResponse{Signal: signal}); err != nil {
+			if err := send(&api.SubscribeResponse{Signal: signal}); err != nil {
 				zap.L().Error("failed to send signal", zap.Error(err))
 				return
 			}
 		}
 	}()
 
+	ctx, cancel := context.WithCancel(conn.Context())
+	defer cancel()
+
+	requests := make(chan *api.SubscribeRequest)
+	go func() {
+		defer close(requests)
+		for {
+			in, err := conn.Recv()
+			if err != nil {
+				zap.L().Error("failed to receive", zap.Error(err))
+				return
+			}
+			select {
+			case requests <- in:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// the session ends when the earliest playback token expires.
+	var expiry time.Time
+	var expired <-chan time.Time
+
+	reconnect := s.reconnect
+
+	// subscriptions are keyed by stream id. senders are the tracks sent to the subscriber, the
+	// mutex keeps filter updates from racing tracks being added.
+	subscriptions := make(map[string]*streamSubscription)
+	senders := make(map[*store.TrackLocal]*webrtc.RTPSender)
+	var senderMutex sync.Mutex
+	tracksChanged := false
+
+	defer func() {
+		for streamID := range subscriptions {
+			metrics.Subscribers.WithLabelValues(streamID).Dec()
+		}
+	}()
+
+	// tell the subscriber which stream each transceiver carries once their mids are negotiated.
+	peerConnection.OnSignalingStateChange(func(ss webrtc.SignalingState) {
+		if ss != webrtc.SignalingStateStable {
+			return
+		}
+		senderMutex.Lock()
+		if !tracksChanged {
+			senderMutex.Unlock()
+			return
+		}
+		tracksChanged = false
+		trackMap := &api.TrackMap{}
+		for _, transceiver := range peerConnection.GetTransceivers() {
+			for tl, rtpSender := range senders {
+				if transceiver.Sender() == rtpSender {
+					trackMap.Tracks = append(trackMap.Tracks, &api.TrackMap_Track{
+						Mid:      transceiver.Mid(),
+						StreamId: tl.StreamID(),
+						TrackId:  tl.ID(),
+						Rid:      tl.RID(),
+					})
+				}
+			}
+		}
+		senderMutex.Unlock()
+		if err := send(&api.SubscribeResponse{TrackMap: trackMap}); err != nil {
+			zap.L().Error("failed to send track map", zap.Error(err))
+		}
+	})
+
+	// removeTracks removes the senders of the tracks, which renegotiates through the signaller.
+	removeTracks := func(locals []*store.TrackLocal) {
+		senderMutex.Lock()
+		defer senderMutex.Unlock()
+		for _, tl := range locals {
+			rtpSender, ok := senders[tl]
+			if !ok {
+				continue
+			}
+			delete(senders, tl)
+			tracksChanged = true
+			if err := peerConnection.RemoveTrack(rtpSender); err != nil {
+				zap.L().Error("failed to remove track", zap.Error(err))
+				span.RecordError(err)
+				continue
+			}
+			span.AddEvent("track removed", trace.WithAttributes(streamAttribute(tl.StreamID()), attribute.String("cdn.track_id", tl.ID())))
+		}
+	}
+
 	for {
-		in, err := conn.Recv()
-		if err != nil {
-			zap.L().Error("failed to receive", zap.Error(err))
-			return nil
+		var in *api.SubscribeRequest
+		select {
+		case in = <-requests:
+			if in == nil {
+				return nil
+			}
+		case <-expired:
+			zap.L().Info("playback token expired", zap.Time("expiry", expiry))
+			return status.Error(codes.Unauthenticated, auth.ErrPlaybackTokenExpired.Error())
+		case <-reconnect:
+			// keep serving until the subscriber has moved or the node shuts down.
+			reconnect = nil
+			if err := send(&api.SubscribeResponse{Reconnect: s.reconnectMessage()}); err != nil {
+				zap.L().Error("failed to send reconnect", zap.Error(err))
+			}
+			continue
 		}
 
 		switch operation := in.Operation.(type) {
 		case *api.SubscribeRequest_Subscription_:
-			// if the stream id is not linked on this server, subscribe to the publisher.
-			s.streamMutex.Lock()
-			if !s.linkedStreamIDs[operation.Subscription.StreamId] {
-				if err := s.relay(context.Background(), operation.Subscription.StreamId); err != nil {
-					zap.L().Error("failed to relay", zap.Error(err))
-					s.streamMutex.Unlock()
-					return nil
-				}
-				s.linkedStreamIDs[operation.Subscription.StreamId] = true
+			streamID := operation.Subscription.StreamId
+			if _, ok := subscriptions[streamID]; ok {
+				return status.Error(codes.AlreadyExists, "already subscribed to the stream")
+			}
+			if offset := operation.Subscription.StartOffset.AsDuration(); offset < 0 || offset > s.config.LocalStore.BufferWindow {
+				return status.Errorf(codes.InvalidArgument, "start offset must be between 0 and the node's buffer window of %s", s.config.LocalStore.BufferWindow)
+			}
+			subscriptionCtx, subscriptionSpan := tracer.Start(ctx, "subscription", trace.WithAttributes(streamAttribute(streamID)))
+			tokenExpiry, err := s.authorizeViewer(subscriptionCtx, streamID, operation.Subscription.PlaybackToken)
+			if err != nil {
+				endSpan(subscriptionSpan, err)
+				return err
+			}
+			if !tokenExpiry.IsZero() && (expiry.IsZero() || tokenExpiry.Before(expiry)) {
+				expiry = tokenExpiry
+				expired = time.After(time.Until(expiry))
 			}
-			s.streamMutex.Unlock()
+			// use bg context to avoid cancelling the relay when this viewer leaves.
+			if err := s.link(trace.ContextWithSpan(context.Background(), subscriptionSpan), streamID); err != nil {
+				zap.L().Error("failed to relay", zap.Error(err))
+				endSpan(subscriptionSpan, err)
+				return nil
+			}
+			endSpan(subscriptionSpan, nil)
+
+			metrics.Subscribers.WithLabelValues(streamID).Inc()
+
+			streamCtx, cancelStream := context.WithCancel(ctx)
+			subscription := &streamSubscription{
+				Subscription: s.config.LocalStore.SubscribeFiltered(streamCtx, streamID, operation.Subscription.StartOffset.AsDuration(), trackFilter(operation.Subscription.Filter)),
+				cancel:       cancelStream,
+			}
+			subscriptions[streamID] = subscription
 
 			go func() {
-				for tl := range s.config.LocalStore.Subscribe(conn.Context(), operation.Subscription.StreamId) {
+				for tl := range subscription.Tracks() {
+					senderMutex.Lock()
+					if tl.Closed() {
+						// the filter changed before the track was added.
+						senderMutex.Unlock()
+						continue
+					}
 					rtpSender, err := peerConnection.AddTrack(tl)
+					if err == nil {
+						senders[tl] = rtpSender
+						tracksChanged = true
+					}
+					senderMutex.Unlock()
 					if err != nil {
 						zap.L().Error("failed to add track", zap.Error(err))
+						span.RecordError(err)
 						return
 					}
+					span.AddEvent("track added", trace.WithAttributes(streamAttribute(tl.StreamID()), attribute.String("cdn.track_id", tl.ID())))
 
-					go func() {
+					tl.Stats.SetAddress(peerAddress(ctx))
+					go func(stats *stats.Sender) {
 						for {
-							if _, _, err := rtpSender.ReadRTCP(); err != nil {
+							packets, _, err := rtpSender.ReadRTCP()
+							if err != nil {
 								return
 							}
+							stats.WriteRTCP(packets)
 						}
-					}()
+					}(tl.Stats)
 				}
 			}()
 
+		case *api.SubscribeRequest_UpdateSubscription_:
+			streamID := operation.UpdateSubscription.StreamId
+			subscription, ok := subscriptions[streamID]
+			if !ok {
+				return status.Error(codes.FailedPrecondition, "not subscribed to the stream")
+			}
+			removeTracks(s.config.LocalStore.SetFilter(subscription.Subscription, trackFilter(operation.UpdateSubscription.Filter)))
+
+		case *api.SubscribeRequest_Unsubscription_:
+			streamID := operation.Unsubscription.StreamId
+			subscription, ok := subscriptions[streamID]
+			if !ok {
+				return status.Error(codes.FailedPrecondition, "not subscribed to the stream")
+			}
+			delete(subscriptions, streamID)
+			metrics.Subscribers.WithLabelValues(streamID).Dec()
+			// detach every track before ending the subscription.
+			removeTracks(s.config.LocalStore.SetFilter(subscription.Subscription, func(store.TrackSource) bool { return false }))
+			subscription.cancel()
+
 		case *api.SubscribeRequest_Signal:
 			if err := signaller.WriteSignal(operation.Signal); err != nil {
 				return err
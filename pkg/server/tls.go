@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// TLSOptions configures transport security between clients and nodes.
+type TLSOptions struct {
+	// CertFile and KeyFile hold the node's certificate. It's served to clients and presented as
+	// the client certificate when relaying from other nodes.
+	CertFile string
+	KeyFile  string
+
+	// CAFile holds the CA that signs node certificates. Callers presenting a certificate signed by
+	// it are relay peers. If empty, relay dials verify against the system roots and no caller is
+	// treated as a relay peer.
+	CAFile string
+}
+
+func (o *TLSOptions) load() (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	if o.CAFile == "" {
+		return cert, nil, nil
+	}
+	pem, err := os.ReadFile(o.CAFile)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return tls.Certificate{}, nil, errors.New("no certificates found in ca file")
+	}
+	return cert, pool, nil
+}
+
+// ServerConfig returns the server's TLS configuration. Client certificates are optional so end
+// users can connect without one.
+func (o *TLSOptions) ServerConfig() (*tls.Config, error) {
+	cert, pool, err := o.load()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if pool != nil {
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// RelayConfig returns the TLS configuration for dialing other nodes.
+func (o *TLSOptions) RelayConfig() (*tls.Config, error) {
+	cert, pool, err := o.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool, MinVersion: tls.VersionTLS12}, nil
+}
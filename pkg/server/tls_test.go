@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/muxable/cdn/pkg/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a node certificate for 127.0.0.1, usable by servers and clients, and its key to dir.
+func (ca *testCA) issue(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return certFile, keyFile
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveTLS serves a test method with the TLS config, authorizing calls like ServeCDN does, and
+// sends the context of every call on calls.
+func serveTLS(t *testing.T, config *tls.Config) (string, <-chan context.Context) {
+	calls := make(chan context.Context, 1)
+	server := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(config)),
+		grpc.StreamInterceptor(auth.StreamServerInterceptor(auth.NewHMACAuthorizer([]byte("secret")))),
+		grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+			calls <- stream.Context()
+			if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+				return err
+			}
+			return stream.SendMsg(&emptypb.Empty{})
+		}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String(), calls
+}
+
+// call calls the test method with the TLS config.
+func call(addr string, config *tls.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Invoke(ctx, "/test.Test/Call", &emptypb.Empty{}, &emptypb.Empty{})
+}
+
+func TestRelayPeers(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, ca.pem)
+
+	serverCert, serverKey := ca.issue(t, dir, "server")
+	serverConfig, err := (&TLSOptions{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile}).ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, calls := serveTLS(t, serverConfig)
+
+	t.Run("node certificate", func(t *testing.T) {
+		nodeCert, nodeKey := ca.issue(t, dir, "node")
+		relayConfig, err := (&TLSOptions{CertFile: nodeCert, KeyFile: nodeKey, CAFile: caFile}).RelayConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := call(addr, relayConfig); err != nil {
+			t.Fatal(err)
+		}
+		ctx := <-calls
+		if !auth.IsRelayPeer(ctx) {
+			t.Fatal("node was not treated as a relay peer")
+		}
+		if err := auth.Check(ctx, auth.RoleSubscribe, "stream"); err != nil {
+			t.Fatalf("relay peer may not subscribe: %v", err)
+		}
+		if err := auth.Check(ctx, auth.RolePublish, "stream"); err == nil {
+			t.Fatal("relay peer may publish")
+		}
+	})
+
+	t.Run("no certificate", func(t *testing.T) {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		if err := call(addr, &tls.Config{RootCAs: pool}); err != nil {
+			t.Fatal(err)
+		}
+		if auth.IsRelayPeer(<-calls) {
+			t.Fatal("client without a certificate was treated as a relay peer")
+		}
+	})
+
+	t.Run("certificate from another ca", func(t *testing.T) {
+		other := newTestCA(t)
+		otherDir := t.TempDir()
+		cert, key := other.issue(t, otherDir, "rogue")
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		if err := call(addr, &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{pair}}); err == nil {
+			t.Fatal("certificate from another ca was accepted")
+		}
+		select {
+		case <-calls:
+			t.Fatal("call with an untrusted certificate reached the server")
+		default:
+		}
+	})
+}
+
+func TestServerConfigWithoutCA(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, dir, "server")
+	config, err := (&TLSOptions{CertFile: cert, KeyFile: key}).ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.NoClientCert || config.ClientCAs != nil {
+		t.Fatal("client certificates are verified without a ca")
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+var tracer = otel.Tracer("github.com/muxable/cdn/pkg/server")
+
+// propagator carries the trace context over gRPC metadata so a trace follows a stream from the
+// viewer's node through every relay hop to the origin.
+var propagator = propagation.TraceContext{}
+
+// streamAttribute labels a span with the stream it concerns.
+func streamAttribute(streamID string) attribute.KeyValue {
+	return attribute.String("cdn.stream_id", streamID)
+}
+
+// endSpan records err on the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingDialOptions instrument a connection to another node. Streams opened on the connection are
+// parented to span, as the cdn client opens them from a background context.
+func tracingDialOptions(span trace.Span) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor(otelgrpc.WithPropagators(propagator))),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return streamer(trace.ContextWithSpanContext(ctx, span.SpanContext()), desc, cc, method, opts...)
+		}, otelgrpc.StreamClientInterceptor(otelgrpc.WithPropagators(propagator))),
+	}
+}
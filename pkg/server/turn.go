@@ -0,0 +1,234 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+var ErrTURNPeerDenied = errors.New("turn peer is not a public address or the node")
+
+// defaultTURNCredentialTTL is how long TURN credentials are valid for if no TTL is configured.
+// Allocations can't be refreshed once their credentials expire so it bounds relayed sessions, which
+// are handed new credentials when they reconnect.
+const defaultTURNCredentialTTL = 10 * time.Minute
+
+// TURNOptions configures the TURN server embedded in the node.
+type TURNOptions struct {
+	// Address is the UDP address the TURN server listens on, defaults to 0.0.0.0:3478.
+	Address string
+	// PublicIP is the IP clients reach the node on, it's advertised to clients and used as the
+	// relay address.
+	PublicIP string
+	// RelayPortMin and RelayPortMax restrict the UDP ports of allocations, zero allows any port.
+	RelayPortMin, RelayPortMax uint16
+	// Realm defaults to "cdn".
+	Realm string
+
+	// Secret signs the credentials handed to sessions. They expire after CredentialTTL, defaults
+	// to 10 minutes, and sessions get new ones when they reconnect.
+	Secret        string
+	CredentialTTL time.Duration
+
+	// NodeICE is the ICE configuration of the node's PeerConnections. Their host candidates are
+	// usually private addresses, the relay forwards to them but to no other private address.
+	NodeICE ICEOptions
+}
+
+// TURNServer is a TURN server that issues short-lived credentials to the node's sessions.
+type TURNServer struct {
+	server *turn.Server
+	url    string
+	secret string
+	ttl    time.Duration
+}
+
+// NewTURNServer starts a TURN server accepting the time-windowed credentials it issues.
+func NewTURNServer(options TURNOptions) (*TURNServer, error) {
+	if options.Secret == "" {
+		return nil, errors.New("turn secret is required")
+	}
+	publicIP := net.ParseIP(options.PublicIP)
+	if publicIP == nil {
+		return nil, fmt.Errorf("turn public ip %q is not an IP", options.PublicIP)
+	}
+	address := options.Address
+	if address == "" {
+		address = "0.0.0.0:3478"
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	realm := options.Realm
+	if realm == "" {
+		realm = "cdn"
+	}
+	ttl := options.CredentialTTL
+	if ttl == 0 {
+		ttl = defaultTURNCredentialTTL
+	}
+
+	var generator turn.RelayAddressGenerator = &turn.RelayAddressGeneratorStatic{RelayAddress: publicIP, Address: "0.0.0.0"}
+	if options.RelayPortMin != 0 || options.RelayPortMax != 0 {
+		generator = &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: publicIP,
+			Address:      "0.0.0.0",
+			MinPort:      options.RelayPortMin,
+			MaxPort:      options.RelayPortMax,
+		}
+	}
+
+	// every session gets credentials, so only relay to the public internet and the node itself.
+	node, err := newNodePeers(options.NodeICE)
+	if err != nil {
+		return nil, err
+	}
+	generator = &filteredRelayAddressGenerator{RelayAddressGenerator: generator, node: node}
+
+	conn, err := net.ListenPacket("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       realm,
+		AuthHandler: turn.NewLongTermAuthHandler(options.Secret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{PacketConn: conn, RelayAddressGenerator: generator},
+		},
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &TURNServer{
+		server: server,
+		url:    fmt.Sprintf("turn:%s?transport=udp", net.JoinHostPort(publicIP.String(), port)),
+		secret: options.Secret,
+		ttl:    ttl,
+	}, nil
+}
+
+// ICEServer returns the TURN server with fresh credentials.
+func (t *TURNServer) ICEServer() (webrtc.ICEServer, error) {
+	username, password, err := turn.GenerateLongTermCredentials(t.secret, t.ttl)
+	if err != nil {
+		return webrtc.ICEServer{}, err
+	}
+	return webrtc.ICEServer{
+		URLs:           []string{t.url},
+		Username:       username,
+		Credential:     password,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}, nil
+}
+
+// Close stops the TURN server and its allocations.
+func (t *TURNServer) Close() error {
+	return t.server.Close()
+}
+
+// filteredRelayAddressGenerator allocates relays that only exchange packets with public peers and
+// the node's own PeerConnections, so the TURN server can't be used to reach the node's loopback,
+// private network or metadata services.
+type filteredRelayAddressGenerator struct {
+	turn.RelayAddressGenerator
+	node *nodePeers
+}
+
+func (g *filteredRelayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &filteredPacketConn{PacketConn: conn, node: g.node}, addr, nil
+}
+
+// filteredPacketConn refuses to send to denied peers and drops packets from them.
+type filteredPacketConn struct {
+	net.PacketConn
+	node *nodePeers
+}
+
+func (c *filteredPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.allowed(addr) {
+		return 0, ErrTURNPeerDenied
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *filteredPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.allowed(addr) {
+			return n, addr, err
+		}
+	}
+}
+
+// allowed reports whether addr is a UDP address on the public internet or of the node itself.
+func (c *filteredPacketConn) allowed(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	ip := udpAddr.IP
+	if !isLocalIP(ip) && !ip.IsPrivate() && !ip.IsMulticast() {
+		return true
+	}
+	return c.node.contains(udpAddr)
+}
+
+// nodePeers matches the host candidates of the node's PeerConnections: its interface and 1:1 NAT
+// addresses on the ports its candidates are bound to.
+type nodePeers struct {
+	ips              map[string]bool
+	muxPort          int
+	portMin, portMax uint16
+}
+
+func newNodePeers(options ICEOptions) (*nodePeers, error) {
+	node := &nodePeers{ips: make(map[string]bool), portMin: options.PortMin, portMax: options.PortMax}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			node.ips[ipNet.IP.String()] = true
+		}
+	}
+	for _, ip := range options.NAT1To1IPs {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			node.ips[parsed.String()] = true
+		}
+	}
+	if options.UDPMuxAddress != "" {
+		addr, err := net.ResolveUDPAddr("udp", options.UDPMuxAddress)
+		if err != nil {
+			return nil, err
+		}
+		node.muxPort = addr.Port
+	}
+	return node, nil
+}
+
+func (n *nodePeers) contains(addr *net.UDPAddr) bool {
+	if !n.ips[addr.IP.String()] || addr.IP.IsUnspecified() {
+		return false
+	}
+	switch {
+	case n.muxPort != 0:
+		// host candidates are all on the mux.
+		return addr.Port == n.muxPort
+	case n.portMin != 0 || n.portMax != 0:
+		return addr.Port >= int(n.portMin) && addr.Port <= int(n.portMax)
+	default:
+		// without a port range candidates are bound to any unprivileged port.
+		return addr.Port >= 1024
+	}
+}
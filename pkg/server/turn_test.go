@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// freeUDPAddress returns a loopback address with a port that was free when it was checked.
+func freeUDPAddress(t *testing.T) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestFilteredPacketConn(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	node, err := newNodePeers(ICEOptions{UDPMuxAddress: "127.0.0.1:5000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &filteredPacketConn{PacketConn: conn, node: node}
+	for _, peer := range []string{"127.0.0.1:9", "127.0.0.1:5001", "10.0.0.1:5000", "192.168.1.1:9", "169.254.169.254:80", "[::1]:9", "224.0.0.1:9"} {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := relay.WriteTo([]byte("x"), addr); !errors.Is(err, ErrTURNPeerDenied) {
+			t.Errorf("WriteTo(%s) = %v, want %v", peer, err, ErrTURNPeerDenied)
+		}
+	}
+	for _, peer := range []string{"8.8.8.8:53", "127.0.0.1:5000"} {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !relay.allowed(addr) {
+			t.Errorf("%s should be allowed", peer)
+		}
+	}
+}
+
+func TestTURNRelaysToNode(t *testing.T) {
+	nodeOptions := loopbackICEOptions(webrtc.NetworkTypeUDP4)
+	nodeOptions.UDPMuxAddress = freeUDPAddress(t)
+	node := listenMux(t, nodeOptions)
+
+	turnAddress := freeUDPAddress(t)
+	turnServer, err := NewTURNServer(TURNOptions{
+		Address:  turnAddress,
+		PublicIP: "127.0.0.1",
+		Secret:   "secret",
+		NodeICE:  nodeOptions,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer turnServer.Close()
+	iceServer, err := turnServer.ICEServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client only reaches the node through the relay, which forwards to the node's loopback
+	// mux candidate.
+	peer := listenMux(t, ICEOptions{NetworkTypes: []webrtc.NetworkType{webrtc.NetworkTypeUDP4}})
+	pair, err := connectPeers(node, peer, webrtc.Configuration{
+		ICEServers:         []webrtc.ICEServer{iceServer},
+		ICETransportPolicy: webrtc.ICETransportPolicyRelay,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair.Remote.Typ != webrtc.ICECandidateTypeRelay {
+		t.Errorf("remote candidate is %s, want relay", pair.Remote.Typ)
+	}
+	_, port, _ := net.SplitHostPort(nodeOptions.UDPMuxAddress)
+	if strconv.Itoa(int(pair.Local.Port)) != port {
+		t.Errorf("local port is %d, want the mux port %s", pair.Local.Port, port)
+	}
+}